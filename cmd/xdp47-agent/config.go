@@ -0,0 +1,336 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/example/xdp47/internal/agentstate"
+    "github.com/example/xdp47/internal/installer"
+    "github.com/example/xdp47/internal/probe"
+)
+
+// defaultConfigPath is read when XDP47_CONFIG is unset; a missing file is fine.
+const defaultConfigPath = "/etc/xdp47/agent.json"
+
+// config is the agent configuration: defaults, then the JSON config file,
+// then XDP47_* environment variables, each overriding the previous.
+type config struct {
+    ControlURLs       []string          `json:"control_urls"` // tried in order; the next one on connection errors
+    Tenant            string            `json:"tenant"`
+    DeviceID          string            `json:"device_id,omitempty"` // normally claimed and kept in the state store
+    Labels            map[string]string `json:"labels"`
+    Location          string            `json:"location"`
+    Version           string            `json:"version"` // what a fresh install runs
+    Channel           string            `json:"channel"`
+    HeartbeatInterval probe.Duration    `json:"heartbeat_interval"`
+    StateDir          string            `json:"state_dir"`
+    ProcRoot          string            `json:"proc_root"`
+    DiskPaths         []string          `json:"disk_paths"`
+    OutboxMax         int               `json:"outbox_max"`
+    BackoffMax        probe.Duration    `json:"backoff_max"`
+    Probes            []probe.Spec      `json:"probes"`
+    Installer         installerConfig   `json:"installer"`
+    SelfUpdate        selfUpdateConfig  `json:"self_update"`
+    Exec              execConfig        `json:"exec"`
+    TLS               tlsConfig         `json:"tls"`
+    DiagListen        string            `json:"diag_listen"` // "" = <state_dir>/agent.sock, "off", a socket path or loopback host:port
+}
+
+type installerConfig struct {
+    Driver        string         `json:"driver"` // hook|tarball|file; "" = adopt desired version as-is
+    Hook          string         `json:"hook"`
+    Source        string         `json:"source"`
+    Root          string         `json:"root"`
+    Keep          int            `json:"keep"`
+    HealthCmd     string         `json:"health_cmd"`
+    HealthTimeout probe.Duration `json:"health_timeout"`
+}
+
+// selfUpdateConfig is where the agent gets its own binary for agent rollouts.
+type selfUpdateConfig struct {
+    Source  string         `json:"source"`  // URL or path, {version} expanded; <source>.sha256 next to it
+    Timeout probe.Duration `json:"timeout"` // the new binary must heartbeat within this, else it is reverted
+}
+
+// execConfig guards remote exec (templates the control plane hands out with
+// heartbeat answers). Its caps apply on top of the template's own.
+type execConfig struct {
+    Enabled        bool           `json:"enabled"`          // off unless set
+    MaxTimeout     probe.Duration `json:"max_timeout"`      // longest a command may run
+    MaxOutputBytes int            `json:"max_output_bytes"` // per stream
+}
+
+// tlsConfig is used for https control URLs.
+type tlsConfig struct {
+    CAFile     string `json:"ca_file"`   // extra roots for the control plane certificate
+    CertFile   string `json:"cert_file"` // client certificate (mTLS)
+    KeyFile    string `json:"key_file"`
+    ServerName string `json:"server_name"`
+}
+
+func defaultConfig() config {
+    return config{
+        ControlURLs:       []string{"http://127.0.0.1:8080"},
+        Tenant:            "demo-tenant",
+        Labels:            map[string]string{"store": "demo", "role": "kiosk"},
+        HeartbeatInterval: probe.Duration(5 * time.Second),
+        StateDir:          agentstate.DefaultDir(),
+        ProcRoot:          "/proc",
+        DiskPaths:         []string{"/"},
+        OutboxMax:         1000,
+        BackoffMax:        probe.Duration(defaultBackoffMax),
+        Installer: installerConfig{
+            Keep:          3,
+            HealthTimeout: probe.Duration(30 * time.Second),
+        },
+        SelfUpdate: selfUpdateConfig{Timeout: probe.Duration(2 * time.Minute)},
+        Exec:       execConfig{MaxTimeout: probe.Duration(10 * time.Minute), MaxOutputBytes: 1 << 20},
+    }
+}
+
+func configPath() string {
+    return getenv("XDP47_CONFIG", defaultConfigPath)
+}
+
+// loadConfig builds the configuration from path (may be missing) and the environment.
+func loadConfig(path string) (config, error) {
+    cfg := defaultConfig()
+    b, err := os.ReadFile(path)
+    switch {
+    case err == nil:
+        defLabels := cfg.Labels
+        cfg.Labels = nil // a map would be merged into, not replaced
+        dec := json.NewDecoder(strings.NewReader(string(b)))
+        dec.DisallowUnknownFields()
+        if err := dec.Decode(&cfg); err != nil {
+            return cfg, fmt.Errorf("%s: %w", path, err)
+        }
+        if cfg.Labels == nil {
+            cfg.Labels = defLabels
+        }
+    case errors.Is(err, os.ErrNotExist) && path == defaultConfigPath:
+    default:
+        return cfg, err
+    }
+    if err := cfg.applyEnv(); err != nil {
+        return cfg, err
+    }
+    return cfg, cfg.validate()
+}
+
+func (c *config) applyEnv() error {
+    if v := os.Getenv("XDP47_CONTROL_URL"); v != "" {
+        c.ControlURLs = splitList(v)
+    }
+    str := map[string]*string{
+        "XDP47_TENANT":          &c.Tenant,
+        "XDP47_DEVICE_ID":       &c.DeviceID,
+        "XDP47_DEVICE_LOCATION": &c.Location,
+        "XDP47_AGENT_VERSION":   &c.Version,
+        "XDP47_AGENT_CHANNEL":   &c.Channel,
+        "XDP47_STATE_DIR":       &c.StateDir,
+        "XDP47_PROC_ROOT":       &c.ProcRoot,
+        "XDP47_INSTALLER":       &c.Installer.Driver,
+        "XDP47_APPLY_CMD":       &c.Installer.Hook,
+        "XDP47_ARTIFACT_SOURCE": &c.Installer.Source,
+        "XDP47_INSTALL_ROOT":    &c.Installer.Root,
+        "XDP47_HEALTH_CMD":      &c.Installer.HealthCmd,
+        "XDP47_AGENT_SOURCE":    &c.SelfUpdate.Source,
+        "XDP47_DIAG_LISTEN":     &c.DiagListen,
+        "XDP47_TLS_CA":          &c.TLS.CAFile,
+        "XDP47_TLS_CERT":        &c.TLS.CertFile,
+        "XDP47_TLS_KEY":         &c.TLS.KeyFile,
+    }
+    for k, p := range str {
+        if v := os.Getenv(k); v != "" {
+            *p = v
+        }
+    }
+    if c.Installer.Driver == "" && c.Installer.Hook != "" {
+        c.Installer.Driver = installer.DriverHook
+    }
+    if v := os.Getenv("XDP47_DEVICE_LABELS"); v != "" {
+        c.Labels = map[string]string{}
+        for _, kv := range splitList(v) {
+            if k, v, ok := strings.Cut(kv, "="); ok {
+                c.Labels[k] = v
+            }
+        }
+    }
+    if v := os.Getenv("XDP47_DISK_PATHS"); v != "" {
+        c.DiskPaths = splitList(v)
+    }
+    ints := map[string]*int{
+        "XDP47_OUTBOX_MAX":   &c.OutboxMax,
+        "XDP47_INSTALL_KEEP": &c.Installer.Keep,
+        "XDP47_EXEC_MAX_OUTPUT": &c.Exec.MaxOutputBytes,
+    }
+    for k, p := range ints {
+        if v := os.Getenv(k); v != "" {
+            n, err := strconv.Atoi(v)
+            if err != nil {
+                return fmt.Errorf("%s: %w", k, err)
+            }
+            *p = n
+        }
+    }
+    durs := map[string]*probe.Duration{
+        "XDP47_HEARTBEAT_INTERVAL": &c.HeartbeatInterval,
+        "XDP47_BACKOFF_MAX":        &c.BackoffMax,
+        "XDP47_HEALTH_TIMEOUT":     &c.Installer.HealthTimeout,
+        "XDP47_AGENT_UPDATE_TIMEOUT": &c.SelfUpdate.Timeout,
+        "XDP47_EXEC_MAX_TIMEOUT":     &c.Exec.MaxTimeout,
+    }
+    for k, p := range durs {
+        if v := os.Getenv(k); v != "" {
+            d, err := time.ParseDuration(v)
+            if err != nil {
+                return fmt.Errorf("%s: %w", k, err)
+            }
+            *p = probe.Duration(d)
+        }
+    }
+    if v := os.Getenv("XDP47_EXEC_ENABLED"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil {
+            return fmt.Errorf("XDP47_EXEC_ENABLED: %w", err)
+        }
+        c.Exec.Enabled = b
+    }
+    // probes: XDP47_PROBES (JSON array) or XDP47_PROBES_FILE
+    raw := os.Getenv("XDP47_PROBES")
+    if f := os.Getenv("XDP47_PROBES_FILE"); f != "" {
+        b, err := os.ReadFile(f)
+        if err != nil {
+            return err
+        }
+        raw = string(b)
+    }
+    if strings.TrimSpace(raw) != "" {
+        specs, err := probe.Parse([]byte(raw))
+        if err != nil {
+            return fmt.Errorf("probes: %w", err)
+        }
+        c.Probes = specs
+    }
+    return nil
+}
+
+func (c *config) validate() error {
+    if len(c.ControlURLs) == 0 {
+        return errors.New("control_urls required")
+    }
+    for i, u := range c.ControlURLs {
+        c.ControlURLs[i] = strings.TrimRight(u, "/")
+    }
+    if c.Tenant == "" {
+        return errors.New("tenant required")
+    }
+    if c.HeartbeatInterval <= 0 {
+        return errors.New("heartbeat_interval must be > 0")
+    }
+    if c.BackoffMax <= 0 {
+        return errors.New("backoff_max must be > 0")
+    }
+    if c.OutboxMax <= 0 {
+        return errors.New("outbox_max must be > 0")
+    }
+    if c.SelfUpdate.Timeout <= 0 {
+        return errors.New("self_update.timeout must be > 0")
+    }
+    if c.Exec.MaxTimeout <= 0 || c.Exec.MaxOutputBytes <= 0 {
+        return errors.New("exec.max_timeout and exec.max_output_bytes must be > 0")
+    }
+    seen := map[string]bool{}
+    for i := range c.Probes {
+        if err := c.Probes[i].Validate(); err != nil {
+            return err
+        }
+        if seen[c.Probes[i].Name] {
+            return fmt.Errorf("duplicate probe %q", c.Probes[i].Name)
+        }
+        seen[c.Probes[i].Name] = true
+    }
+    if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+        return errors.New("tls: cert_file and key_file go together")
+    }
+    if _, _, err := c.diagAddr(); err != nil {
+        return err
+    }
+    return nil
+}
+
+// httpClient returns a client for the control plane with the TLS material applied.
+func (c config) httpClient() (*http.Client, error) {
+    tc := &tls.Config{ServerName: c.TLS.ServerName, MinVersion: tls.VersionTLS12}
+    if c.TLS.CAFile != "" {
+        pem, err := os.ReadFile(c.TLS.CAFile)
+        if err != nil {
+            return nil, err
+        }
+        pool, err := x509.SystemCertPool()
+        if err != nil {
+            pool = x509.NewCertPool()
+        }
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("%s: no certificates", c.TLS.CAFile)
+        }
+        tc.RootCAs = pool
+    }
+    if c.TLS.CertFile != "" {
+        cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+        if err != nil {
+            return nil, err
+        }
+        tc.Certificates = []tls.Certificate{cert}
+    }
+    tr := http.DefaultTransport.(*http.Transport).Clone()
+    tr.TLSClientConfig = tc
+    return &http.Client{Timeout: 5 * time.Second, Transport: tr}, nil
+}
+
+// downloadClient is client without its per-request timeout: artifact
+// downloads keep the control plane's TLS settings but are bounded by the
+// reconcile deadline (applyTimeout) instead.
+func downloadClient(client *http.Client) *http.Client {
+    return &http.Client{Transport: client.Transport}
+}
+
+// installer returns the configured installer (nil = none); it downloads
+// with client.
+func (c config) installer(client *http.Client) (installer.Installer, error) {
+    if c.Installer.Driver == "" {
+        return nil, nil
+    }
+    return installer.New(installer.Config{
+        Driver: c.Installer.Driver,
+        Hook:   c.Installer.Hook,
+        Source: c.Installer.Source,
+        Root:   c.Installer.Root,
+        Client: client,
+    })
+}
+
+func splitList(s string) []string {
+    var out []string
+    for _, p := range strings.Split(s, ",") {
+        if p = strings.TrimSpace(p); p != "" {
+            out = append(out, p)
+        }
+    }
+    return out
+}
+
+func getenv(k, def string) string {
+    v := os.Getenv(k)
+    if v == "" { return def }
+    return v
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "sync"
+    "text/tabwriter"
+    "time"
+
+    "github.com/example/xdp47/internal/agentstate"
+    "github.com/example/xdp47/internal/probe"
+)
+
+// Local diagnostics: a listener on a unix socket (or a loopback port) that
+// tells a technician at the device what the agent thinks is going on.
+// `xdp47-agent status` reads it. Nothing here is reachable from the network.
+
+// runtimeDir is created by systemd (RuntimeDirectory=xdp47); when it exists
+// the socket goes there, so `status` finds it whatever the caller's $HOME.
+const runtimeDir = "/run/xdp47"
+
+// diagStatus is what GET /status returns.
+type diagStatus struct {
+    AgentVersion string        `json:"agent_version"`
+    DeviceID     string        `json:"device_id"` // "" while claiming
+    Tenant       string        `json:"tenant"`
+    Status       string        `json:"status"` // as sent with the last heartbeat
+    Control      diagControl   `json:"control"`
+    Heartbeat    diagHeartbeat `json:"heartbeat"`
+    Desired      *desired      `json:"desired"` // nil until the control plane answered
+    Running      desired       `json:"running"`
+    InSync       bool          `json:"in_sync"`
+    Probes       []probe.Result `json:"probes"`
+    Outbox       diagOutbox    `json:"outbox"`
+    SelfUpdate   *agentstate.AgentUpdate `json:"self_update,omitempty"`
+    Exec         diagExec      `json:"exec"`
+    UpdatedAt    time.Time     `json:"updated_at"`
+}
+
+type diagControl struct {
+    URL         string     `json:"url"` // the one in use
+    URLs        []string   `json:"urls"`
+    Reachable   bool       `json:"reachable"`
+    LastContact *time.Time `json:"last_contact,omitempty"`
+    LastError   string     `json:"last_error,omitempty"`
+    LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+    TokenRejected  bool    `json:"token_rejected,omitempty"` // 401: reports stay queued
+    Decommissioned bool    `json:"decommissioned,omitempty"` // 410
+}
+
+type diagHeartbeat struct {
+    Result   string     `json:"result"` // ok|stale|rejected: ...|failed: ...|queued ...
+    At       *time.Time `json:"at,omitempty"`
+    Interval string     `json:"interval"`
+}
+
+type diagOutbox struct {
+    Queued int        `json:"queued"`
+    Max    int        `json:"max"`
+    Oldest *time.Time `json:"oldest,omitempty"`
+}
+
+type diagExec struct {
+    Enabled bool `json:"enabled"`
+    Running int  `json:"running"`
+}
+
+// diagServer serves the latest snapshot published by the heartbeat loop.
+type diagServer struct {
+    mu sync.Mutex
+    st diagStatus
+}
+
+func (d *diagServer) set(st diagStatus) {
+    d.mu.Lock()
+    d.st = st
+    d.mu.Unlock()
+}
+
+func (d *diagServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path != "/status" || r.Method != http.MethodGet {
+        http.NotFound(w, r)
+        return
+    }
+    d.mu.Lock()
+    st := d.st
+    d.mu.Unlock()
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(st)
+}
+
+// diagAddr resolves diag_listen: "" is agent.sock in the runtime or state
+// dir, "off" disables it, a path (or unix:path) is a socket, anything else
+// must be a loopback host:port. network is "" when disabled.
+func (c config) diagAddr() (network, addr string, err error) {
+    v := c.DiagListen
+    switch {
+    case v == "off":
+        return "", "", nil
+    case v == "":
+        if fi, err := os.Stat(runtimeDir); err == nil && fi.IsDir() {
+            return "unix", filepath.Join(runtimeDir, "agent.sock"), nil
+        }
+        return "unix", filepath.Join(c.StateDir, "agent.sock"), nil
+    case strings.HasPrefix(v, "unix:"):
+        return "unix", strings.TrimPrefix(v, "unix:"), nil
+    case strings.Contains(v, "/"):
+        return "unix", v, nil
+    }
+    host, _, err := net.SplitHostPort(v)
+    if err != nil {
+        return "", "", fmt.Errorf("diag_listen: %w", err)
+    }
+    if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+        return "", "", fmt.Errorf("diag_listen: %s is not a loopback address", host)
+    }
+    return "tcp", v, nil
+}
+
+// listenDiag starts the diagnostics listener (if enabled).
+func listenDiag(cfg config, d *diagServer) error {
+    network, addr, err := cfg.diagAddr()
+    if err != nil || network == "" {
+        return err
+    }
+    if network == "unix" {
+        // a socket left behind by a previous run
+        if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+            os.Remove(addr)
+        }
+    }
+    ln, err := net.Listen(network, addr)
+    if err != nil {
+        return err
+    }
+    if network == "unix" {
+        if err := os.Chmod(addr, 0o600); err != nil {
+            ln.Close()
+            return err
+        }
+    }
+    log.Printf("diagnostics on %s %s", network, addr)
+    srv := &http.Server{Handler: d, ReadHeaderTimeout: 5 * time.Second}
+    go func() {
+        if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+            log.Printf("diagnostics: %v", err)
+        }
+    }()
+    return nil
+}
+
+// publish hands the diagnostics listener a fresh snapshot. Only the loop
+// goroutine calls it, so it may read the sender directly.
+func (a *agent) publish() {
+    if a.diag == nil {
+        return
+    }
+    st := a.state.State()
+    running := desired{AgentVersion: agentVersion}
+    running.Version, running.Channel = a.rc.running()
+    ds := diagStatus{
+        AgentVersion: agentVersion,
+        DeviceID:     a.out.deviceID,
+        Tenant:       a.cfg.Tenant,
+        Status:       a.lastStatus,
+        Control: diagControl{
+            URL: a.out.control(), URLs: slices.Clone(a.out.controls), Reachable: a.out.reachable,
+            LastContact: timePtr(a.out.lastContact), LastError: a.out.lastError, LastErrorAt: timePtr(a.out.lastErrorAt),
+            TokenRejected: a.out.badToken, Decommissioned: a.out.gone,
+        },
+        Heartbeat: diagHeartbeat{Result: a.out.hbResult, At: timePtr(a.out.hbAt), Interval: time.Duration(a.cfg.HeartbeatInterval).String()},
+        Desired:   a.desired,
+        Running:   running,
+        Probes:    a.probes.Results(),
+        Outbox:    diagOutbox{Queued: len(st.Outbox), Max: a.cfg.OutboxMax},
+        SelfUpdate: st.AgentUpdate,
+        Exec:      diagExec{Enabled: a.cfg.Exec.Enabled, Running: a.exec.inFlight()},
+        UpdatedAt: time.Now().UTC(),
+    }
+    if d := a.desired; d != nil {
+        ds.InSync = (d.Version == "" || d.Version == running.Version) &&
+            (d.Channel == "" || d.Channel == running.Channel) &&
+            (d.AgentVersion == "" || d.AgentVersion == running.AgentVersion)
+    }
+    if len(st.Outbox) > 0 {
+        ds.Outbox.Oldest = timePtr(st.Outbox[0].CreatedAt)
+    }
+    a.diag.set(ds)
+}
+
+func timePtr(t time.Time) *time.Time {
+    if t.IsZero() {
+        return nil
+    }
+    t = t.UTC()
+    return &t
+}
+
+// runStatus implements `xdp47-agent status [-json] [-addr A]`.
+func runStatus(args []string) int {
+    fs := flag.NewFlagSet("status", flag.ExitOnError)
+    asJSON := fs.Bool("json", false, "print the raw JSON")
+    addrFlag := fs.String("addr", "", "diagnostics socket path or host:port (default: from the agent config)")
+    fs.Parse(args)
+
+    cfg, err := loadConfig(configPath())
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "warning: config: %v (using defaults)\n", err)
+        cfg = defaultConfig()
+    }
+    if *addrFlag != "" {
+        cfg.DiagListen = *addrFlag
+    }
+    network, addr, err := cfg.diagAddr()
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    if network == "" {
+        fmt.Fprintln(os.Stderr, "diagnostics listener is off (diag_listen)")
+        return 1
+    }
+    client := &http.Client{
+        Timeout: 5 * time.Second,
+        Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+            var d net.Dialer
+            return d.DialContext(ctx, network, addr)
+        }},
+    }
+    resp, err := client.Get("http://agent/status")
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "agent not reachable on %s %s: %v\n", network, addr, err)
+        return 1
+    }
+    defer resp.Body.Close()
+    b, err := io.ReadAll(resp.Body)
+    if err != nil || resp.StatusCode != http.StatusOK {
+        fmt.Fprintf(os.Stderr, "status: %s %v\n", resp.Status, err)
+        return 1
+    }
+    if *asJSON {
+        os.Stdout.Write(b)
+        return 0
+    }
+    var st diagStatus
+    if err := json.Unmarshal(b, &st); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    printStatus(os.Stdout, st)
+    return 0
+}
+
+func printStatus(out io.Writer, st diagStatus) {
+    w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+    defer w.Flush()
+    ago := func(t *time.Time) string {
+        if t == nil {
+            return "never"
+        }
+        return time.Since(*t).Round(time.Second).String() + " ago"
+    }
+    dev := st.DeviceID
+    if dev == "" {
+        dev = "(not claimed yet)"
+    }
+    fmt.Fprintf(w, "device\t%s (tenant %s)\n", dev, st.Tenant)
+    fmt.Fprintf(w, "agent\t%s\n", st.AgentVersion)
+    status := st.Status
+    if status == "" {
+        status = "unknown (no heartbeat yet)"
+    }
+    fmt.Fprintf(w, "status\t%s\n", status)
+
+    reach := "UNREACHABLE"
+    if st.Control.Reachable {
+        reach = "reachable"
+    }
+    fmt.Fprintf(w, "control\t%s  %s, last contact %s\n", st.Control.URL, reach, ago(st.Control.LastContact))
+    if st.Control.LastError != "" {
+        fmt.Fprintf(w, "\tlast error %s: %s\n", ago(st.Control.LastErrorAt), st.Control.LastError)
+    }
+    if st.Control.TokenRejected {
+        fmt.Fprintf(w, "\tDEVICE TOKEN REJECTED (401); reports are kept in the outbox\n")
+    }
+    if st.Control.Decommissioned {
+        fmt.Fprintf(w, "\tDEVICE DECOMMISSIONED (410); remove the agent or its state dir to claim anew\n")
+    }
+    hb := st.Heartbeat.Result
+    if hb == "" {
+        hb = "none sent yet"
+    }
+    fmt.Fprintf(w, "heartbeat\t%s, %s (every %s)\n", hb, ago(st.Heartbeat.At), st.Heartbeat.Interval)
+
+    ver := func(d desired) string {
+        s := d.Version
+        if d.Channel != "" {
+            s += "@" + d.Channel
+        }
+        if s == "" {
+            s = "-"
+        }
+        return s
+    }
+    sync := "in sync"
+    if !st.InSync {
+        sync = "OUT OF SYNC"
+    }
+    if st.Desired == nil {
+        fmt.Fprintf(w, "version\trunning %s, desired unknown\n", ver(st.Running))
+    } else {
+        fmt.Fprintf(w, "version\trunning %s, desired %s (%s)\n", ver(st.Running), ver(*st.Desired), sync)
+        if st.Desired.AgentVersion != "" {
+            fmt.Fprintf(w, "agent binary\trunning %s, desired %s\n", st.Running.AgentVersion, st.Desired.AgentVersion)
+        }
+    }
+    if u := st.SelfUpdate; u != nil {
+        fmt.Fprintf(w, "self-update\t%s -> %s, reverted at %s without a heartbeat\n", u.From, u.To, u.Deadline.Local().Format(time.TimeOnly))
+    }
+    oldest := ""
+    if st.Outbox.Oldest != nil {
+        oldest = ", oldest " + ago(st.Outbox.Oldest)
+    }
+    fmt.Fprintf(w, "outbox\t%d queued (max %d)%s\n", st.Outbox.Queued, st.Outbox.Max, oldest)
+    if st.Exec.Enabled {
+        fmt.Fprintf(w, "remote exec\tenabled, %d running\n", st.Exec.Running)
+    } else {
+        fmt.Fprintf(w, "remote exec\tdisabled\n")
+    }
+
+    if len(st.Probes) == 0 {
+        fmt.Fprintf(w, "probes\tnone configured\n")
+    }
+    for i, p := range st.Probes {
+        label := ""
+        if i == 0 {
+            label = "probes"
+        }
+        status := p.Status
+        if status == "" {
+            status = "pending"
+        }
+        line := fmt.Sprintf("%s\t%s (%s)  %s", label, p.Name, p.Type, status)
+        if p.Detail != "" {
+            line += ": " + p.Detail
+        }
+        if p.Failures > 0 {
+            line += fmt.Sprintf(" [%d failure(s)]", p.Failures)
+        }
+        fmt.Fprintln(w, line)
+    }
+    fmt.Fprintf(w, "updated\t%s\n", ago(&st.UpdatedAt))
+}
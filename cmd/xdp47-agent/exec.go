@@ -0,0 +1,147 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "os/exec"
+    "sync"
+    "time"
+)
+
+// execRequest is a command the control plane hands out with a heartbeat
+// answer, rendered from one of the tenant's exec templates.
+type execRequest struct {
+    ID             string `json:"id"`
+    Command        string `json:"command"`
+    TimeoutSeconds int    `json:"timeout_seconds"`
+    MaxOutputBytes int    `json:"max_output_bytes"`
+}
+
+// execResult goes back to /api/devices/{id}/exec-results through the outbox.
+type execResult struct {
+    ID         string    `json:"id"`
+    ExitCode   *int      `json:"exit_code"` // nil when the command did not run to completion
+    Stdout     string    `json:"stdout"`
+    Stderr     string    `json:"stderr"`
+    Truncated  bool      `json:"truncated"`
+    TimedOut   bool      `json:"timed_out"`
+    Error      string    `json:"error,omitempty"`
+    StartedAt  time.Time `json:"started_at"`
+    FinishedAt time.Time `json:"finished_at"`
+}
+
+// executor runs remote exec requests with `sh -c`, each in its own goroutine,
+// and delivers the results on done for the loop goroutine to send.
+type executor struct {
+    mu      sync.Mutex
+    cfg     execConfig
+    running map[string]bool
+
+    done chan execResult
+}
+
+func newExecutor() *executor {
+    return &executor{running: map[string]bool{}, done: make(chan execResult, 16)}
+}
+
+func (x *executor) setConfig(c execConfig) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.cfg = c
+}
+
+// start runs the requests it is not already running.
+func (x *executor) start(reqs []execRequest) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    for _, req := range reqs {
+        if x.running[req.ID] {
+            continue
+        }
+        x.running[req.ID] = true
+        go func(req execRequest, cfg execConfig) {
+            res := x.run(req, cfg)
+            x.mu.Lock()
+            delete(x.running, req.ID)
+            x.mu.Unlock()
+            x.done <- res
+        }(req, x.cfg)
+    }
+}
+
+// inFlight is the number of commands running now.
+func (x *executor) inFlight() int {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    return len(x.running)
+}
+
+func (x *executor) run(req execRequest, cfg execConfig) execResult {
+    res := execResult{ID: req.ID, StartedAt: time.Now().UTC()}
+    if !cfg.Enabled {
+        log.Printf("exec %s refused: remote exec is disabled", req.ID)
+        res.Error = "remote exec is disabled on this device (exec.enabled)"
+        res.FinishedAt = time.Now().UTC()
+        return res
+    }
+
+    timeout := time.Duration(req.TimeoutSeconds) * time.Second
+    if timeout <= 0 || timeout > time.Duration(cfg.MaxTimeout) {
+        timeout = time.Duration(cfg.MaxTimeout)
+    }
+    limit := req.MaxOutputBytes
+    if limit <= 0 || limit > cfg.MaxOutputBytes {
+        limit = cfg.MaxOutputBytes
+    }
+    log.Printf("exec %s: %s (timeout %s)", req.ID, req.Command, timeout)
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    stdout, stderr := &capped{max: limit}, &capped{max: limit}
+    cmd := exec.CommandContext(ctx, "sh", "-c", req.Command)
+    cmd.Stdout, cmd.Stderr = stdout, stderr
+    cleanup := processGroup(cmd)
+    // background children that keep the pipes open must not hold the result back
+    cmd.WaitDelay = 2 * time.Second
+    err := cmd.Run()
+    cleanup()
+
+    res.Stdout, res.Stderr = stdout.buf.String(), stderr.buf.String()
+    res.Truncated = stdout.truncated || stderr.truncated
+    var exitErr *exec.ExitError
+    switch {
+    case err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded):
+        res.TimedOut = true
+        res.Error = fmt.Sprintf("killed after %s", timeout)
+    case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+        code := exitErr.ExitCode()
+        res.ExitCode = &code
+    case err != nil && !errors.Is(err, exec.ErrWaitDelay):
+        res.Error = err.Error()
+    default:
+        code := 0
+        res.ExitCode = &code
+    }
+    res.FinishedAt = time.Now().UTC()
+    return res
+}
+
+// capped keeps the first max bytes written to it.
+type capped struct {
+    buf       bytes.Buffer
+    max       int
+    truncated bool
+}
+
+func (c *capped) Write(p []byte) (int, error) {
+    n := len(p)
+    if room := c.max - c.buf.Len(); len(p) > room {
+        c.truncated = true
+        p = p[:max(room, 0)]
+    }
+    c.buf.Write(p)
+    return n, nil
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+    "os/exec"
+    "syscall"
+)
+
+// processGroup runs cmd in its own process group, killed on timeout. The
+// returned func kills what is left of the group once cmd is done, so nothing
+// the command started in the background outlives it.
+func processGroup(cmd *exec.Cmd) func() {
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    cmd.Cancel = func() error {
+        return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+    }
+    return func() {
+        if cmd.Process != nil {
+            _ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+        }
+    }
+}
@@ -1,70 +1,355 @@
 package main
 
 import (
-    "bytes"
-    "encoding/json"
+    "context"
+    "fmt"
     "log"
-    "math/rand"
-    "net/http"
     "os"
-    "strings"
+    "os/signal"
+    "slices"
+    "sync"
+    "syscall"
     "time"
+
+    "github.com/example/xdp47/internal/agentstate"
+    "github.com/example/xdp47/internal/collector"
+    "github.com/example/xdp47/internal/installer"
+    "github.com/example/xdp47/internal/probe"
+    "github.com/example/xdp47/internal/selfupdate"
 )
 
-func getenv(k, def string) string {
-    v := os.Getenv(k)
-    if v == "" { return def }
-    return v
+// agent holds everything the heartbeat loop needs; apply swaps in a new config.
+type agent struct {
+    cfg   config
+    state *agentstate.Store
+    rc    *reconciler
+    up    *updater
+    out   *sender
+    exec  *executor
+    coll  *collector.Collector
+
+    probes     *probe.Runner
+    stopProbes context.CancelFunc
+
+    sampleMu sync.Mutex
+    sample   *collector.Metrics
+
+    diag       *diagServer
+    desired    *desired // last desired state from the control plane
+    lastStatus string   // sent with the last heartbeat
+
+    // desired states for the reconcile goroutine; holds at most the latest
+    wants chan desired
+}
+
+func (a *agent) latest() *collector.Metrics {
+    a.sampleMu.Lock()
+    defer a.sampleMu.Unlock()
+    return a.sample
+}
+
+// apply (re)configures the parts that can change at runtime: control URLs and
+// TLS, installer, probes, collector. Tenant, device ID and state dir are fixed
+// for the life of the process.
+func (a *agent) apply(cfg config) error {
+    client, err := cfg.httpClient()
+    if err != nil {
+        return err
+    }
+    inst, err := cfg.installer(downloadClient(client))
+    if err != nil {
+        return err
+    }
+    a.out.client = client
+    a.out.controls, a.out.cur = cfg.ControlURLs, 0
+    a.out.max = cfg.OutboxMax
+    a.out.retry.max = time.Duration(cfg.BackoffMax)
+    a.rc.configure(inst, installer.Health{Cmd: cfg.Installer.HealthCmd, Timeout: time.Duration(cfg.Installer.HealthTimeout)},
+        cfg.Installer.Keep)
+    a.up.configure(cfg.SelfUpdate.Source, time.Duration(cfg.SelfUpdate.Timeout), downloadClient(client))
+    a.exec.setConfig(cfg.Exec)
+    if a.coll == nil || cfg.ProcRoot != a.cfg.ProcRoot || !slices.Equal(cfg.DiskPaths, a.cfg.DiskPaths) {
+        a.coll = collector.New(collector.Options{ProcRoot: cfg.ProcRoot, DiskPaths: cfg.DiskPaths})
+    }
+
+    // local health probes decide the reported status
+    if a.stopProbes != nil {
+        a.stopProbes()
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    a.probes, a.stopProbes = probe.NewRunner(cfg.Probes, a.latest), cancel
+    go a.probes.Run(ctx)
+    if len(cfg.Probes) > 0 {
+        log.Printf("running %d health probe(s)", len(cfg.Probes))
+    }
+    a.cfg = cfg
+    return nil
+}
+
+// reload re-reads the config file (SIGHUP). A bad file keeps the old config.
+func (a *agent) reload() {
+    cfg, err := loadConfig(configPath())
+    if err != nil {
+        log.Printf("reload: %v (keeping current config)", err)
+        return
+    }
+    if cfg.Tenant != a.cfg.Tenant || cfg.StateDir != a.cfg.StateDir || cfg.DeviceID != a.cfg.DeviceID || cfg.DiagListen != a.cfg.DiagListen {
+        log.Printf("reload: tenant, device_id, state_dir and diag_listen changes need a restart")
+        cfg.Tenant, cfg.StateDir, cfg.DeviceID, cfg.DiagListen = a.cfg.Tenant, a.cfg.StateDir, a.cfg.DeviceID, a.cfg.DiagListen
+    }
+    if err := a.apply(cfg); err != nil {
+        log.Printf("reload: %v (keeping current config)", err)
+        return
+    }
+    log.Printf("reload: config applied from %s", configPath())
+}
+
+// want hands d to the reconcile goroutine, replacing a desired state it has
+// not picked up yet. Only the loop goroutine calls it.
+func (a *agent) want(d desired) {
+    select {
+    case <-a.wants:
+    default:
+    }
+    a.wants <- d
+}
+
+// reconcileLoop applies desired states off the loop goroutine, so a slow
+// download or health check never holds up heartbeats.
+func (a *agent) reconcileLoop() {
+    for d := range a.wants {
+        a.rc.reconcile(d)
+        a.up.reconcile(d)
+    }
+}
+
+// beat samples the host and sends one heartbeat.
+func (a *agent) beat() {
+    m := a.coll.Collect()
+    a.sampleMu.Lock()
+    a.sample = &m
+    a.sampleMu.Unlock()
+    status, failing := a.probes.Status()
+    a.lastStatus = probe.Worst(probe.Worst(a.rc.status(), a.up.status()), status)
+    version, channel := a.rc.running()
+    hb := map[string]interface{}{
+        "ts":      m.TS.Format(time.RFC3339Nano),
+        "cpu":     m.CPU.UsagePercent,
+        "mem":     m.Memory.UsedPercent,
+        "metrics": m,
+        "status":  a.lastStatus,
+        "probes":  failing,
+        "version": version,
+        "channel": channel,
+        "agent_version": agentVersion,
+        "tags":    map[string]string{"agent": "xdp47"},
+    }
+    labels, location, changed := a.inventoryChanges()
+    if labels != nil {
+        hb["labels"] = labels
+    }
+    if location != nil {
+        hb["location"] = *location
+    }
+    a.out.send(kindHeartbeat, hb)
+    if changed {
+        // queued or sent, it reaches the control plane; do not send it again
+        if err := a.state.SetInventory(agentstate.Inventory{Labels: a.cfg.Labels, Location: a.cfg.Location}); err != nil {
+            log.Printf("state store: save inventory: %v", err)
+        }
+    }
+}
+
+// inventoryChanges is what changed in the configured labels and location
+// since they were last sent. Labels map to their new value, or to nil when
+// removed from the config; the control plane merges them into the device's
+// labels, so labels set by operators (PATCH /api/devices/{id}) stay until the
+// config changes the same key. Nothing is sent for an unchanged config, so a
+// restart or reload does not undo operator edits.
+func (a *agent) inventoryChanges() (map[string]*string, *string, bool) {
+    inv := a.state.State().Inventory
+    if inv == nil {
+        inv = &agentstate.Inventory{} // never sent: every configured label is new
+    }
+    var labels map[string]*string
+    for k, v := range a.cfg.Labels {
+        if old, ok := inv.Labels[k]; !ok || old != v {
+            if labels == nil {
+                labels = map[string]*string{}
+            }
+            labels[k] = &v
+        }
+    }
+    for k := range inv.Labels {
+        if _, ok := a.cfg.Labels[k]; !ok {
+            if labels == nil {
+                labels = map[string]*string{}
+            }
+            labels[k] = nil
+        }
+    }
+    var location *string
+    if a.cfg.Location != inv.Location {
+        location = &a.cfg.Location
+    }
+    return labels, location, labels != nil || location != nil
+}
+
+// revertOverdue puts the previous binary back and execs into it when this is
+// a self-update whose heartbeat deadline has passed. It runs before config
+// and state are loaded: a new binary that fails there (say, it rejects the
+// current config) never gets to its watchdog, but systemd keeps restarting
+// it until this catches it.
+func revertOverdue() {
+    exe, err := selfupdate.Executable()
+    if err != nil {
+        return
+    }
+    reverted, err := selfupdate.RevertOverdue(exe, agentVersion, time.Now())
+    if err != nil {
+        log.Printf("self-update: %v", err)
+        return
+    }
+    if reverted {
+        log.Printf("self-update: %s is past its deadline without a heartbeat; reverted, restarting %s", agentVersion, exe)
+        err := selfupdate.Exec(exe)
+        log.Fatalf("self-update: exec %s: %v", exe, err)
+    }
 }
 
 func main() {
-    control := getenv("XDP47_CONTROL_URL", "http://127.0.0.1:8080")
-    tenant := getenv("XDP47_TENANT", "demo-tenant")
-    deviceID := getenv("XDP47_DEVICE_ID", "")
-    labelStr := getenv("XDP47_DEVICE_LABELS", "store=demo,role=kiosk")
-
-    labels := map[string]string{}
-    for _, kv := range strings.Split(labelStr, ",") {
-        if kv == "" { continue }
-        parts := strings.SplitN(kv, "=", 2)
-        if len(parts) == 2 {
-            labels[parts[0]] = parts[1]
+    if len(os.Args) > 1 {
+        switch os.Args[1] {
+        case "version":
+            fmt.Println(agentVersion)
+            return
+        case "status":
+            os.Exit(runStatus(os.Args[2:]))
         }
     }
+    log.Printf("xdp47-agent %s", agentVersion)
+    revertOverdue()
+
+    cfg, err := loadConfig(configPath())
+    if err != nil { log.Fatalf("config: %v", err) }
+
+    // identity and installed version survive restarts (see internal/agentstate)
+    state, err := agentstate.Open(cfg.StateDir)
+    if err != nil { log.Fatalf("state store: %v", err) }
+    defer state.Close()
 
+    a := &agent{
+        state: state,
+        rc:    &reconciler{version: cfg.Version, channel: cfg.Channel, state: state},
+        up:    &updater{state: state},
+        diag:  &diagServer{},
+        exec:  newExecutor(),
+        out:   &sender{state: state, retry: backoff{base: 5 * time.Second}},
+        wants: make(chan desired, 1),
+    }
+    if a.up.exe, err = selfupdate.Executable(); err != nil {
+        log.Printf("self-update disabled: %v", err)
+    }
+    st := state.State()
+    if st.Current.Version != "" {
+        a.rc.version, a.rc.channel = st.Current.Version, st.Current.Channel
+    }
+    if err := a.apply(cfg); err != nil { log.Fatalf("config: %v", err) }
+    if err := listenDiag(cfg, a.diag); err != nil {
+        log.Printf("diagnostics listener: %v", err)
+    }
+    a.publish()
+
+    deviceID := cfg.DeviceID
+    if deviceID == "" && st.Identity.DeviceID != "" && st.Identity.Tenant == cfg.Tenant {
+        deviceID = st.Identity.DeviceID
+        log.Printf("using stored device_id=%s (%s)", deviceID, state.Dir())
+    }
+    if deviceID != "" && deviceID == st.Identity.DeviceID {
+        a.out.token = st.Identity.Token
+    }
     if deviceID == "" {
-        // claim
-        body := map[string]interface{}{"tenant": tenant, "labels": labels}
-        buf, _ := json.Marshal(body)
-        resp, err := http.Post(control+"/api/devices/claim", "application/json", bytes.NewReader(buf))
-        if err != nil { log.Fatalf("claim error: %v", err) }
-        defer resp.Body.Close()
-        var out map[string]string
-        json.NewDecoder(resp.Body).Decode(&out)
-        deviceID = out["device_id"]
-        if deviceID == "" { log.Fatal("empty device_id after claim") }
+        // claim; the control plane may not be up yet (boot, WAN down), so keep trying
+        body := map[string]interface{}{"tenant": cfg.Tenant, "labels": cfg.Labels, "location": cfg.Location,
+            "version": a.rc.version, "channel": a.rc.channel}
+        retry := backoff{base: time.Second, max: time.Duration(cfg.BackoffMax)}
+        for {
+            out, err := a.out.claim(body)
+            if err == nil {
+                deviceID, a.out.token = out["device_id"], out["token"]
+                id := agentstate.Identity{DeviceID: deviceID, Tenant: cfg.Tenant, Token: out["token"], ClaimedAt: time.Now().UTC()}
+                if err := state.SetIdentity(id); err != nil {
+                    log.Printf("state store: save identity: %v", err)
+                }
+                break
+            }
+            a.publish()
+            wait := retry.next()
+            log.Printf("claim error: %v (retrying in %s)", err, wait.Round(time.Millisecond))
+            time.Sleep(wait)
+        }
         log.Printf("claimed device_id=%s", deviceID)
+        // the claim carried them
+        if err := state.SetInventory(agentstate.Inventory{Labels: cfg.Labels, Location: cfg.Location}); err != nil {
+            log.Printf("state store: save inventory: %v", err)
+        }
+    }
+    a.out.deviceID = deviceID
+    a.out.onDesired = func(d desired) {
+        a.desired = &d
+        a.up.confirm() // a heartbeat got through
+        a.want(d)
+    }
+    a.out.onExec = a.exec.start
+    // reconcile events come from the reconcile goroutine, which may also exec
+    // into a new binary right after; they go to the on-disk outbox and the
+    // loop sends them with its next flush
+    a.rc.emit = func(typ, detail string) {
+        if _, err := state.Enqueue(kindEvent, []event{{TS: time.Now().UTC(), Type: typ, Detail: detail}}); err != nil {
+            log.Printf("outbox: %v", err)
+        }
     }
+    a.up.emit = a.rc.emit
+    a.up.resume()
+    go a.reconcileLoop()
+
+    if d, err := a.out.desired(); err != nil {
+        log.Printf("desired state error: %v", err)
+    } else {
+        a.desired = &d
+        a.want(d)
+    }
+    a.publish()
+
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
 
-    // heartbeat loop (every 5s)
-    client := &http.Client{ Timeout: 5 * time.Second }
+    // heartbeat loop; the response carries the desired state.
+    // Heartbeats are sampled even while offline and replayed later.
+    interval := time.Duration(a.cfg.HeartbeatInterval)
+    tick := time.NewTicker(interval)
+    defer tick.Stop()
     for {
-        hb := map[string]interface{}{
-            "ts":   time.Now().UTC().Format(time.RFC3339Nano),
-            "cpu":  5 + rand.Float64()*30,
-            "mem":  50 + rand.Float64()*100,
-            "status": "ok",
-            "tags": map[string]string{"agent":"xdp47"},
+        a.out.flush()
+        a.beat()
+        a.publish()
+        // exec results go out as they come in, between heartbeats
+        for waiting := true; waiting; {
+            select {
+            case <-hup:
+                a.reload()
+                a.publish()
+                waiting = false
+            case <-tick.C:
+                waiting = false
+            case res := <-a.exec.done:
+                a.out.send(kindExecResult, res)
+                a.publish()
+            }
         }
-        buf, _ := json.Marshal(hb)
-        req, _ := http.NewRequest("POST", control+"/api/devices/"+deviceID+"/heartbeat", bytes.NewReader(buf))
-        req.Header.Set("Content-Type", "application/json")
-        resp, err := client.Do(req)
-        if err != nil {
-            log.Printf("heartbeat error: %v", err)
-        } else {
-            resp.Body.Close()
+        if d := time.Duration(a.cfg.HeartbeatInterval); d != interval {
+            interval = d
+            tick.Reset(interval)
         }
-        time.Sleep(5 * time.Second)
     }
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math/rand"
+    "net/http"
+    "time"
+
+    "github.com/example/xdp47/internal/agentstate"
+)
+
+// defaultBackoffMax caps the backoff when no positive max is set.
+const defaultBackoffMax = 2 * time.Minute
+
+// backoff is capped exponential backoff with full jitter.
+type backoff struct {
+    base, max time.Duration
+    attempt   int
+}
+
+// next returns the wait before the next attempt, in (0, max].
+func (b *backoff) next() time.Duration {
+    limit := b.max
+    if limit <= 0 {
+        limit = defaultBackoffMax
+    }
+    d := b.base << min(b.attempt, 20)
+    if d <= 0 || d > limit {
+        d = limit
+    }
+    b.attempt++
+    return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+func (b *backoff) reset() { b.attempt = 0 }
+
+// Outbox kinds and the endpoint each is posted to.
+const (
+    kindHeartbeat = "heartbeat"
+    kindEvent     = "event"
+    kindExecResult = "exec_result"
+)
+
+// sender posts heartbeats and events to the control plane. Whatever cannot be
+// delivered goes to the on-disk outbox (bounded; oldest dropped first) and is
+// replayed in order, with its original timestamps, once the control plane
+// answers again. On connection errors it moves on to the next control URL.
+// Only the loop goroutine uses it.
+type sender struct {
+    client   *http.Client
+    controls []string
+    cur      int
+    deviceID string
+    token    string // issued at claim; sent as a bearer token
+    state    *agentstate.Store
+    max      int // outbox bound
+
+    retry     backoff
+    nextTry   time.Time
+    onDesired func(desired)
+    onExec    func([]execRequest)
+
+    // what was last seen of the control plane (for diagnostics)
+    reachable   bool
+    lastContact time.Time
+    lastError   string
+    lastErrorAt time.Time
+    hbResult    string // ok|stale|rejected: ...|failed: ...|queued (backoff)
+    hbAt        time.Time
+    gone        bool // told it was decommissioned (logged once)
+    badToken    bool // the control plane rejects our token (401); cleared by the next success
+}
+
+func (s *sender) control() string { return s.controls[s.cur%len(s.controls)] }
+
+func (s *sender) url(kind string) string {
+    switch kind {
+    case kindEvent:
+        return s.control() + "/api/devices/" + s.deviceID + "/events"
+    case kindExecResult:
+        return s.control() + "/api/devices/" + s.deviceID + "/exec-results"
+    }
+    return s.control() + "/api/devices/" + s.deviceID + "/heartbeat"
+}
+
+// do sends req-building fn against the current control URL, failing over to
+// the next one when the connection itself fails.
+func (s *sender) do(fn func(base string) (*http.Request, error)) (*http.Response, error) {
+    var lastErr error
+    for range s.controls {
+        req, err := fn(s.control())
+        if err != nil {
+            return nil, err
+        }
+        if s.token != "" {
+            req.Header.Set("Authorization", "Bearer "+s.token)
+        }
+        resp, err := s.client.Do(req)
+        if err == nil {
+            s.reachable, s.lastContact = true, time.Now()
+            return resp, nil
+        }
+        lastErr = err
+        s.reachable, s.lastError, s.lastErrorAt = false, err.Error(), time.Now()
+        if len(s.controls) > 1 {
+            s.cur = (s.cur + 1) % len(s.controls)
+            log.Printf("control %s unreachable, trying %s", req.URL.Host, s.control())
+        }
+    }
+    return nil, lastErr
+}
+
+// claim registers a new device and returns the control plane's answer.
+func (s *sender) claim(body map[string]interface{}) (map[string]string, error) {
+    buf, _ := json.Marshal(body)
+    resp, err := s.do(func(base string) (*http.Request, error) {
+        return jsonRequest(http.MethodPost, base+"/api/devices/claim", buf)
+    })
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("claim: %s", resp.Status)
+    }
+    var out map[string]string
+    if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+        return nil, err
+    }
+    if out["device_id"] == "" {
+        return nil, errors.New("empty device_id after claim")
+    }
+    return out, nil
+}
+
+// desired fetches the desired state directly (the heartbeat answer carries it too).
+func (s *sender) desired() (desired, error) {
+    var d desired
+    resp, err := s.do(func(base string) (*http.Request, error) {
+        return http.NewRequest(http.MethodGet, base+"/api/devices/"+s.deviceID+"/desired", nil)
+    })
+    if err != nil {
+        return d, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return d, fmt.Errorf("desired: %s", resp.Status)
+    }
+    err = json.NewDecoder(resp.Body).Decode(&d)
+    return d, err
+}
+
+func jsonRequest(method, url string, body []byte) (*http.Request, error) {
+    req, err := http.NewRequest(method, url, bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    return req, nil
+}
+
+// send delivers body now if the outbox is empty and the control plane is
+// not in backoff; otherwise (or on failure) it queues body behind the rest.
+func (s *sender) send(kind string, body any) {
+    if len(s.state.Pending()) == 0 && !time.Now().Before(s.nextTry) {
+        raw, err := json.Marshal(body)
+        if err == nil {
+            if err = s.post(kind, raw); err == nil {
+                s.retry.reset()
+                return
+            }
+        }
+        log.Printf("%s error: %v (queued)", kind, err)
+        s.nextTry = time.Now().Add(s.retry.next())
+    } else if kind == kindHeartbeat {
+        s.hbResult, s.hbAt = "queued (outbox not empty or in backoff)", time.Now()
+    }
+    if _, err := s.state.Enqueue(kind, body); err != nil {
+        log.Printf("outbox: %v", err)
+        return
+    }
+    if n, err := s.state.Trim(s.max); err != nil {
+        log.Printf("outbox: %v", err)
+    } else if n > 0 {
+        log.Printf("outbox full: dropped %d oldest item(s)", n)
+    }
+}
+
+// flush replays the outbox oldest first and stops at the first failure.
+func (s *sender) flush() {
+    pending := s.state.Pending()
+    if len(pending) == 0 || time.Now().Before(s.nextTry) {
+        return
+    }
+    for i, ob := range pending {
+        if err := s.post(ob.Kind, ob.Body); err != nil {
+            log.Printf("outbox replay: %v (%d left)", err, len(pending)-i)
+            s.nextTry = time.Now().Add(s.retry.next())
+            return
+        }
+        if err := s.state.Ack(ob.Seq); err != nil {
+            log.Printf("outbox: %v", err)
+            return
+        }
+    }
+    s.retry.reset()
+    log.Printf("outbox: replayed %d item(s)", len(pending))
+}
+
+func (s *sender) post(kind string, body []byte) error {
+    result := func(r string) {
+        if kind == kindHeartbeat {
+            s.hbResult, s.hbAt = r, time.Now()
+        }
+    }
+    resp, err := s.do(func(string) (*http.Request, error) {
+        return jsonRequest(http.MethodPost, s.url(kind), body)
+    })
+    if err != nil {
+        result("failed: " + err.Error())
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 500 {
+        s.lastError, s.lastErrorAt = kind+": "+resp.Status, time.Now()
+        result("failed: " + resp.Status)
+        return fmt.Errorf("%s", resp.Status)
+    }
+    if resp.StatusCode != http.StatusOK {
+        msg, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+        log.Printf("%s rejected: %s: %s", kind, resp.Status, bytes.TrimSpace(msg))
+        switch resp.StatusCode {
+        case http.StatusGone:
+            if !s.gone {
+                s.gone = true
+                log.Printf("this device (%s) was decommissioned on the control plane; remove the agent or its state dir (%s) to claim anew",
+                    s.deviceID, s.state.Dir())
+            }
+        case http.StatusUnauthorized:
+            if !s.badToken {
+                s.badToken = true
+                log.Printf("the control plane rejects this device's token (%s); reports stay queued until it accepts it again",
+                    s.deviceID)
+            }
+        }
+        s.lastError, s.lastErrorAt = fmt.Sprintf("%s rejected: %s", kind, resp.Status), time.Now()
+        result("rejected: " + resp.Status)
+        switch resp.StatusCode {
+        case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+            // the payload itself is refused; retrying it will not help, drop it
+            return nil
+        }
+        // anything else (401 after a token rotation or restore, 404, 409, 410)
+        // may be fixed on the control plane: keep it queued and back off
+        return fmt.Errorf("%s", resp.Status)
+    }
+    s.badToken = false
+    if kind == kindHeartbeat {
+        var out struct {
+            Stale   bool     `json:"stale"`
+            Desired *desired `json:"desired"`
+            Exec    []execRequest `json:"exec"`
+        }
+        _ = json.NewDecoder(resp.Body).Decode(&out)
+        if out.Stale {
+            result("stale") // a replayed one, older than what the control plane has
+        } else {
+            result("ok")
+        }
+        if s.onDesired != nil && out.Desired != nil {
+            s.onDesired(*out.Desired)
+        }
+        if s.onExec != nil && len(out.Exec) > 0 {
+            s.onExec(out.Exec)
+        }
+    }
+    return nil
+}
+
+// event is a device event, e.g. a version being applied or rolled back.
+type event struct {
+    TS     time.Time `json:"ts"`
+    Type   string    `json:"type"`
+    Detail string    `json:"detail,omitempty"`
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+    "math"
+    "testing"
+    "time"
+)
+
+func TestBackoffNext(t *testing.T) {
+    tests := []struct {
+        name      string
+        base, max time.Duration
+        limit     time.Duration // every wait must be in (0, limit]
+    }{
+        {"normal", time.Second, time.Minute, time.Minute},
+        {"zero max", time.Second, 0, defaultBackoffMax},
+        {"negative max", time.Second, -time.Second, defaultBackoffMax},
+        {"zero base", 0, time.Minute, time.Minute},
+        {"negative base", -time.Second, time.Minute, time.Minute},
+        {"zero both", 0, 0, defaultBackoffMax},
+        {"overflowing base", math.MaxInt64 / 2, time.Minute, time.Minute},
+        {"huge max", time.Second, math.MaxInt64, math.MaxInt64},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            b := backoff{base: tt.base, max: tt.max}
+            for i := 0; i < 70; i++ {
+                if d := b.next(); d <= 0 || d > tt.limit {
+                    t.Fatalf("attempt %d: next() = %s, want in (0, %s]", i, d, tt.limit)
+                }
+            }
+            b.reset()
+            if b.attempt != 0 {
+                t.Fatalf("reset left attempt = %d", b.attempt)
+            }
+        })
+    }
+}
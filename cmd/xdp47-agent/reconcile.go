@@ -0,0 +1,138 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/example/xdp47/internal/agentstate"
+    "github.com/example/xdp47/internal/installer"
+)
+
+// desired is the state the control plane wants this device in
+// (GET /api/devices/{id}/desired, also returned with every heartbeat).
+type desired struct {
+    Version string `json:"version"`
+    Channel string `json:"channel"`
+    AgentVersion string `json:"agent_version"` // agent binary; see updater
+}
+
+// applyTimeout bounds one install or agent self-update, downloads included.
+const applyTimeout = 10 * time.Minute
+
+// reconciler moves the agent from what it runs to what the control plane wants.
+// The switch is done by inst (see internal/installer); without one the agent
+// just adopts the desired version, which is enough for demos. When the new
+// version fails its health check the installer has already switched back.
+//
+// reconcile runs on the reconcile goroutine (see agent.reconcileLoop); the
+// loop goroutine reads the running version and reconfigures through mu.
+type reconciler struct {
+    state *agentstate.Store
+    emit  func(typ, detail string) // device events; nil = none
+
+    mu      sync.Mutex
+    version string // actually running
+    channel string
+    inst    installer.Installer
+    health  installer.Health
+    keep    int    // versions kept on disk
+    failed  string // desired version whose apply failed; not retried until it changes
+}
+
+// configure sets the installer used from the next reconcile on.
+func (rc *reconciler) configure(inst installer.Installer, health installer.Health, keep int) {
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    rc.inst, rc.health, rc.keep = inst, health, keep
+}
+
+// running returns the version and channel running now.
+func (rc *reconciler) running() (version, channel string) {
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    return rc.version, rc.channel
+}
+
+func (rc *reconciler) reconcile(d desired) {
+    rc.mu.Lock()
+    if d.Version == "" {
+        d.Version = rc.version
+    }
+    if d.Channel == "" {
+        d.Channel = rc.channel
+    }
+    key := d.Version + "@" + d.Channel
+    if d.Version == rc.version && d.Channel == rc.channel || key == rc.failed {
+        rc.mu.Unlock()
+        return
+    }
+    from := installer.Artifact{Version: rc.version, Channel: rc.channel}
+    inst, health, keep := rc.inst, rc.health, rc.keep
+    rc.mu.Unlock()
+
+    log.Printf("reconcile: %s@%s -> %s@%s", from.Version, from.Channel, d.Version, d.Channel)
+    if inst != nil {
+        ctx, cancel := context.WithTimeout(context.Background(), applyTimeout)
+        to := installer.Artifact{Version: d.Version, Channel: d.Channel}
+        err := installer.Apply(ctx, inst, from, to, health, keep)
+        cancel()
+        if err != nil {
+            if errors.Is(err, installer.ErrUnhealthyNoPrevious) {
+                // the new version is live but unhealthy; adopt it and report warn
+                log.Printf("reconcile: %v; running %s", err, d.Version)
+                rc.event("apply_unhealthy", fmt.Sprintf("%s: %v", d.Version, err))
+                rc.mu.Lock()
+                rc.version, rc.channel, rc.failed = d.Version, d.Channel, key
+                rc.mu.Unlock()
+                if rc.state != nil {
+                    if err := rc.state.SetCurrent(d.Version, d.Channel, keep); err != nil {
+                        log.Printf("state store: save version: %v", err)
+                    }
+                }
+                return
+            }
+            if errors.Is(err, installer.ErrUnhealthy) {
+                log.Printf("reconcile: %v; still running %s", err, from.Version)
+                rc.event("version_rolled_back", fmt.Sprintf("%s: %v; running %s", d.Version, err, from.Version))
+            } else {
+                log.Printf("reconcile: apply failed: %v", err)
+                rc.event("apply_failed", fmt.Sprintf("%s: %v", d.Version, err))
+            }
+            rc.mu.Lock()
+            rc.failed = key
+            rc.mu.Unlock()
+            return
+        }
+    }
+    rc.mu.Lock()
+    rc.version, rc.channel, rc.failed = d.Version, d.Channel, ""
+    rc.mu.Unlock()
+    if rc.state != nil {
+        if err := rc.state.SetCurrent(d.Version, d.Channel, keep); err != nil {
+            log.Printf("state store: save version: %v", err)
+        }
+    }
+    log.Printf("reconcile: now running %s@%s", d.Version, d.Channel)
+    rc.event("version_applied", d.Version+"@"+d.Channel)
+}
+
+func (rc *reconciler) event(typ, detail string) {
+    if rc.emit != nil {
+        rc.emit(typ, detail)
+    }
+}
+
+// status is the health reported in heartbeats: warn while the desired version
+// could not be applied.
+func (rc *reconciler) status() string {
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    if rc.failed != "" {
+        return "warn"
+    }
+    return "ok"
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/example/xdp47/internal/agentstate"
+    "github.com/example/xdp47/internal/selfupdate"
+)
+
+// agentVersion is set at build time: -ldflags "-X main.agentVersion=1.4.0".
+var agentVersion = "dev"
+
+// updater moves the agent binary to the agent version the control plane wants
+// (agent rollouts, artifact "xdp47-agent:<version>"). The update is recorded
+// in the state store before the switch; the new binary has to heartbeat within
+// timeout, otherwise it puts the previous binary back and execs into it.
+//
+// reconcile runs on the reconcile goroutine; confirm and status are called
+// from the loop goroutine and must not wait for a download, so u.mu is not
+// held while the new binary is staged.
+type updater struct {
+    exe   string
+    state *agentstate.Store
+    emit  func(typ, detail string)
+
+    mu       sync.Mutex
+    source   string        // URL or path template of the binary
+    timeout  time.Duration // for the new binary's first heartbeat
+    client   *http.Client  // for http(s) sources
+    failed   string        // desired agent version that could not be installed
+    watching *agentstate.AgentUpdate
+}
+
+// configure sets where new binaries come from (config reload).
+func (u *updater) configure(source string, timeout time.Duration, client *http.Client) {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    u.source, u.timeout, u.client = source, timeout, client
+}
+
+func (u *updater) event(typ, detail string) {
+    if u.emit != nil {
+        u.emit(typ, detail)
+    }
+}
+
+// resume finishes an update started by the previous process. The new binary
+// starts its watchdog; any other binary (the old one after a revert, or after
+// a crash before the switch) records the update as failed.
+func (u *updater) resume() {
+    st := u.state.State()
+    u.failed = st.AgentFailed
+    up := st.AgentUpdate
+    if up == nil {
+        return
+    }
+    if agentVersion != up.To {
+        log.Printf("self-update: %s did not come up; running %s", up.To, agentVersion)
+        u.fail(up.To)
+        u.event("agent_update_rolled_back", fmt.Sprintf("%s did not heartbeat within %s; back on %s",
+            up.To, up.Deadline.Sub(up.StartedAt).Round(time.Second), agentVersion))
+        return
+    }
+    u.mu.Lock()
+    u.watching = up
+    u.mu.Unlock()
+    left := time.Until(up.Deadline)
+    log.Printf("self-update: running %s (from %s), waiting up to %s for a heartbeat", up.To, up.From, left.Round(time.Second))
+    go func() {
+        time.Sleep(left)
+        u.revert()
+    }()
+}
+
+// confirm is called for every heartbeat the control plane accepted; the
+// first one after an update makes it final.
+func (u *updater) confirm() {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    up := u.watching
+    if up == nil {
+        return
+    }
+    u.watching = nil
+    if err := u.state.EndAgentUpdate(""); err != nil {
+        log.Printf("state store: end agent update: %v", err)
+    }
+    if err := selfupdate.Unmark(u.exe); err != nil {
+        log.Printf("self-update: %v", err)
+    }
+    log.Printf("self-update: %s confirmed", up.To)
+    u.event("agent_updated", up.From+" -> "+up.To)
+}
+
+// revert puts the previous binary back and execs into it, unless a heartbeat
+// got through in the meantime.
+func (u *updater) revert() {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    up := u.watching
+    if up == nil {
+        return
+    }
+    log.Printf("self-update: no heartbeat from %s before %s; reverting to %s", up.To, up.Deadline.Format(time.RFC3339), up.From)
+    if err := selfupdate.Revert(u.exe); err != nil {
+        log.Printf("self-update: revert: %v; staying on %s", err, agentVersion)
+        u.watching = nil
+        u.fail(up.To)
+        return
+    }
+    u.restart()
+}
+
+// reconcile installs the desired agent version, if it differs from this binary.
+func (u *updater) reconcile(d desired) {
+    v := d.AgentVersion
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    if v != u.failed {
+        u.failed = ""
+    }
+    if v == "" || v == agentVersion || v == u.failed || u.watching != nil {
+        return
+    }
+    if u.source == "" || u.exe == "" {
+        log.Printf("self-update: agent %s wanted, but self-update is not set up (self_update.source)", v)
+        u.failed = v
+        u.event("agent_update_failed", v+": self-update not set up on this device")
+        return
+    }
+    source, client := u.source, u.client
+
+    log.Printf("self-update: %s -> %s", agentVersion, v)
+    u.mu.Unlock()
+    ctx, cancel := context.WithTimeout(context.Background(), applyTimeout)
+    staged, err := selfupdate.Stage(ctx, client, u.exe, source, v)
+    cancel()
+    u.mu.Lock()
+    if err != nil {
+        log.Printf("self-update: %v", err)
+        u.failed = v
+        u.event("agent_update_failed", fmt.Sprintf("%s: %v", v, err))
+        return
+    }
+    now := time.Now().UTC()
+    up := agentstate.AgentUpdate{From: agentVersion, To: v, StartedAt: now, Deadline: now.Add(u.timeout)}
+    if err := u.state.BeginAgentUpdate(up); err != nil {
+        os.Remove(staged)
+        log.Printf("state store: begin agent update: %v", err)
+        return
+    }
+    // without the marker nothing reverts a binary that fails before resume
+    if err := selfupdate.Mark(u.exe, selfupdate.Marker{From: up.From, To: up.To, Deadline: up.Deadline}); err != nil {
+        os.Remove(staged)
+        log.Printf("self-update: %v", err)
+        u.fail(v)
+        u.event("agent_update_failed", fmt.Sprintf("%s: %v", v, err))
+        return
+    }
+    if err := selfupdate.Switch(u.exe, staged); err != nil {
+        os.Remove(staged)
+        log.Printf("self-update: switch: %v", err)
+        u.fail(v)
+        u.event("agent_update_failed", fmt.Sprintf("%s: %v", v, err))
+        return
+    }
+    u.event("agent_update_started", agentVersion+" -> "+v)
+    u.restart()
+}
+
+// fail records v as a version not to install again (until the desired
+// version changes). Callers hold u.mu or run before the heartbeat loop.
+func (u *updater) fail(v string) {
+    u.failed = v
+    if err := u.state.EndAgentUpdate(v); err != nil {
+        log.Printf("state store: end agent update: %v", err)
+    }
+    if u.exe != "" {
+        if err := selfupdate.Unmark(u.exe); err != nil {
+            log.Printf("self-update: %v", err)
+        }
+    }
+}
+
+// restart execs into whatever binary is at u.exe now. If that fails the
+// process exits and the supervisor starts it.
+func (u *updater) restart() {
+    u.state.Close()
+    log.Printf("self-update: restarting %s", u.exe)
+    err := selfupdate.Exec(u.exe)
+    log.Fatalf("self-update: exec %s: %v", u.exe, err)
+}
+
+// status is warn while the desired agent version could not be installed.
+func (u *updater) status() string {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    if u.failed != "" {
+        return "warn"
+    }
+    return "ok"
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/jackc/pgx/v5"
+
+    xdb "github.com/example/xdp47/internal/db"
+    "github.com/example/xdp47/internal/selector"
+)
+
+// --- device detail, update & decommission ---
+
+// decommissioned devices in memory mode (the db keeps them in devices_archive)
+var decommissioned = map[string]*xdb.ArchivedDevice{}
+
+// deviceAuth checks the device token (issued at claim) on the endpoints
+// agents write to. Devices claimed before tokens were issued have none and
+// are let through. When it returns false the response is written.
+func deviceAuth(w http.ResponseWriter, r *http.Request, id string) bool {
+    var hash string
+    if store != nil && store.Enabled {
+        h, err := store.DeviceTokenHash(r.Context(), id)
+        switch {
+        case errors.Is(err, xdb.ErrDecommissioned):
+            http.Error(w, "device decommissioned", http.StatusGone)
+            return false
+        case errors.Is(err, pgx.ErrNoRows):
+            http.Error(w, "not found", http.StatusNotFound)
+            return false
+        case err != nil:
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return false
+        }
+        hash = h
+    } else {
+        if _, ok := decommissioned[id]; ok {
+            http.Error(w, "device decommissioned", http.StatusGone)
+            return false
+        }
+        dv, ok := devices[id]
+        if !ok {
+            http.Error(w, "not found", http.StatusNotFound)
+            return false
+        }
+        hash = dv.TokenHash
+    }
+    token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if hash != "" && !xdb.TokenMatches(token, hash) {
+        http.Error(w, "bad device token", http.StatusUnauthorized)
+        return false
+    }
+    return true
+}
+
+// memDevice is the xdb view of an in-memory device. Memory mode has no
+// sweeper; connectivity is derived when read.
+func memDevice(d *Device) xdb.Device {
+    return xdb.Device{ID: d.ID, Tenant: d.Tenant, Labels: d.Labels, Location: d.Location,
+        Version: d.Version, Channel: d.Channel, Status: d.Health, ReportedVersion: d.ReportedVersion,
+        ReportedChannel: d.ReportedChannel, ReportedAgentVersion: d.ReportedAgentVersion, Probes: d.Probes,
+        LastSeen: d.LastSeen, Cordon: d.Cordon,
+        Connectivity: xdb.Connectivity(d.LastSeen, time.Now(), liveOpt.Stale, liveOpt.Offline)}
+}
+
+// getDevice: GET /api/devices/{id}?heartbeats=N&rollouts=N — the device with
+// its recent heartbeats and rollout history. Decommissioned devices are
+// returned from the archive with `decommissioned` set.
+func getDevice(w http.ResponseWriter, r *http.Request) {
+    type decom struct {
+        At     time.Time `json:"at"`
+        By     string    `json:"by"`
+        Reason string    `json:"reason,omitempty"`
+    }
+    type detail struct {
+        Device         xdb.Device                `json:"device"`
+        Decommissioned *decom                    `json:"decommissioned,omitempty"`
+        InFlight       *xdb.InFlight             `json:"in_flight,omitempty"` // while draining
+        Heartbeats     []xdb.HeartbeatRecord     `json:"heartbeats"`
+        Rollouts       []xdb.DeviceRolloutTarget `json:"rollouts"`
+    }
+    id := chi.URLParam(r, "id")
+    out := detail{Heartbeats: []xdb.HeartbeatRecord{}, Rollouts: []xdb.DeviceRolloutTarget{}}
+
+    if store != nil && store.Enabled {
+        dv, err := store.GetDevice(r.Context(), id)
+        if errors.Is(err, pgx.ErrNoRows) {
+            a, aerr := store.GetArchivedDevice(r.Context(), id)
+            if errors.Is(aerr, pgx.ErrNoRows) {
+                http.Error(w, "not found", http.StatusNotFound)
+                return
+            }
+            if aerr != nil {
+                http.Error(w, aerr.Error(), http.StatusInternalServerError)
+                return
+            }
+            dv, err = a.Device, nil
+            out.Decommissioned = &decom{At: a.DecommissionedAt, By: a.DecommissionedBy, Reason: a.Reason}
+        }
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        out.Device = dv
+        nhb, _ := strconv.Atoi(r.URL.Query().Get("heartbeats"))
+        if out.Heartbeats, err = store.ListHeartbeats(r.Context(), id, nhb); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        nro, _ := strconv.Atoi(r.URL.Query().Get("rollouts"))
+        if out.Rollouts, err = store.ListDeviceRolloutTargets(r.Context(), id, nro); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    } else if d, ok := devices[id]; ok {
+        out.Device = memDevice(d)
+    } else if a, ok := decommissioned[id]; ok {
+        out.Device = a.Device
+        out.Decommissioned = &decom{At: a.DecommissionedAt, By: a.DecommissionedBy, Reason: a.Reason}
+    } else {
+        http.Error(w, "not found", http.StatusNotFound)
+        return
+    }
+    if c := out.Device.Cordon; c != nil && c.Drain && out.Decommissioned == nil {
+        f, err := inFlight(r, out.Device)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        out.InFlight = &f
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(out)
+}
+
+// patchDevice: PATCH /api/devices/{id} with labels, location and/or channel.
+// Version is left to rollouts.
+func patchDevice(w http.ResponseWriter, r *http.Request) {
+    var p xdb.DevicePatch
+    dec := json.NewDecoder(r.Body)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&p); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err := p.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    id := chi.URLParam(r, "id")
+
+    var dv xdb.Device
+    if store != nil && store.Enabled {
+        var err error
+        dv, err = store.UpdateDevice(r.Context(), id, p)
+        if errors.Is(err, pgx.ErrNoRows) {
+            if _, aerr := store.GetArchivedDevice(r.Context(), id); aerr == nil {
+                http.Error(w, "device decommissioned", http.StatusGone)
+                return
+            }
+            http.Error(w, "not found", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    } else {
+        d, ok := devices[id]
+        if !ok {
+            if _, gone := decommissioned[id]; gone {
+                http.Error(w, "device decommissioned", http.StatusGone)
+                return
+            }
+            http.Error(w, "not found", http.StatusNotFound)
+            return
+        }
+        dv = memDevice(d)
+        p.Apply(&dv)
+        d.Labels, d.Location, d.Channel = dv.Labels, dv.Location, dv.Channel
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(dv)
+}
+
+// decommissionDevice: POST /api/devices/{id}:decommission. The device's token
+// stops working and its row moves to the archive; its history is kept.
+func decommissionDevice(w http.ResponseWriter, r *http.Request) {
+    op, ok := operator(w, r)
+    if !ok {
+        return
+    }
+    var q struct {
+        Reason string `json:"reason"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&q); err != nil && !errors.Is(err, io.EOF) {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    id := chi.URLParam(r, "id")
+
+    var a xdb.ArchivedDevice
+    if store != nil && store.Enabled {
+        var err error
+        a, err = store.DecommissionDevice(r.Context(), id, op, q.Reason)
+        if errors.Is(err, pgx.ErrNoRows) {
+            if _, aerr := store.GetArchivedDevice(r.Context(), id); aerr == nil {
+                http.Error(w, "already decommissioned", http.StatusGone)
+                return
+            }
+            http.Error(w, "not found", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    } else {
+        d, ok := devices[id]
+        if !ok {
+            if _, gone := decommissioned[id]; gone {
+                http.Error(w, "already decommissioned", http.StatusGone)
+                return
+            }
+            http.Error(w, "not found", http.StatusNotFound)
+            return
+        }
+        a = xdb.ArchivedDevice{Device: memDevice(d), DecommissionedAt: time.Now().UTC(), DecommissionedBy: op, Reason: q.Reason}
+        decommissioned[id] = &a
+        delete(devices, id)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(a)
+}
+
+// parseDeviceQuery reads the device list query:
+// ?tenant=&selector=<selector>&health=warn,crit&connectivity=stale,offline&version=&desired_version=
+// &channel=&location=&cordoned=true|false&stale=10m&sort=-last_seen&limit=&cursor=
+func parseDeviceQuery(r *http.Request) (xdb.DeviceQuery, error) {
+    v := r.URL.Query()
+    q := xdb.DeviceQuery{
+        Tenant: v.Get("tenant"), Version: v.Get("version"), DesiredVersion: v.Get("desired_version"),
+        Channel: v.Get("channel"), Location: v.Get("location"), Sort: v.Get("sort"), Cursor: v.Get("cursor"),
+    }
+    sel, err := selector.Parse(v.Get("selector"))
+    if err != nil {
+        return q, err
+    }
+    q.Selector = sel
+    if s := v.Get("cordoned"); s != "" {
+        b, err := strconv.ParseBool(s)
+        if err != nil {
+            return q, errors.New("cordoned must be true or false")
+        }
+        q.Cordoned = &b
+    }
+    if s := v.Get("health"); s != "" {
+        q.Health = strings.Split(s, ",")
+    }
+    if s := v.Get("connectivity"); s != "" {
+        q.Connectivity = strings.Split(s, ",")
+    }
+    if s := v.Get("stale"); s != "" {
+        d, err := time.ParseDuration(s)
+        if err != nil || d <= 0 {
+            return q, errors.New("stale must be a duration like 10m")
+        }
+        q.StaleFor = d
+    }
+    if s := v.Get("limit"); s != "" {
+        n, err := strconv.Atoi(s)
+        if err != nil || n < 1 {
+            return q, errors.New("limit must be a positive number")
+        }
+        q.Limit = n
+    }
+    return q, q.Validate()
+}
+
+// nextPage announces the next page's cursor, if any.
+func nextPage(w http.ResponseWriter, r *http.Request, cursor string) {
+    if cursor == "" {
+        return
+    }
+    w.Header().Set("X-Next-Cursor", cursor)
+    u := *r.URL
+    v := u.Query()
+    v.Set("cursor", cursor)
+    u.RawQuery = v.Encode()
+    w.Header().Set("Link", "<"+u.RequestURI()+">; rel=\"next\"")
+}
+
+// --- cordon & drain ---
+//
+// Rollouts skip cordoned devices (skipped_cordoned). A drain cordons the
+// device and then waits for what is in flight on it: executions handed to it
+// or queued for it, and updates it has not reported yet.
+
+// drainWaitMax caps ?wait= on :drain.
+const drainWaitMax = 10 * time.Minute
+
+// cordonDevice: POST /api/devices/{id}:cordon with an optional {"reason":...}.
+func cordonDevice(w http.ResponseWriter, r *http.Request) {
+    dv, ok := setCordon(w, r, false)
+    if !ok {
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(dv)
+}
+
+// uncordonDevice: POST /api/devices/{id}:uncordon. Ends a drain too.
+func uncordonDevice(w http.ResponseWriter, r *http.Request) {
+    op, ok := operator(w, r)
+    if !ok {
+        return
+    }
+    id := chi.URLParam(r, "id")
+    var dv xdb.Device
+    if store != nil && store.Enabled {
+        var err error
+        if dv, err = store.SetCordon(r.Context(), id, nil); !cordonFound(w, r, id, err) {
+            return
+        }
+        cordonEvent(r, id, "uncordoned", "by "+op)
+    } else {
+        d, ok := memCordonDevice(w, id)
+        if !ok {
+            return
+        }
+        d.Cordon = nil
+        dv = memDevice(d)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(dv)
+}
+
+// drainDevice: POST /api/devices/{id}:drain?wait=30s cordons the device and
+// waits up to wait (0 = not at all) for its in-flight operations. 200 when
+// nothing is in flight any more, otherwise 202 with what still is; call it
+// again (or GET the device) to keep watching.
+func drainDevice(w http.ResponseWriter, r *http.Request) {
+    wait := 30 * time.Second
+    if s := r.URL.Query().Get("wait"); s != "" {
+        d, err := time.ParseDuration(s)
+        if err != nil || d < 0 || d > drainWaitMax {
+            http.Error(w, "wait must be a duration between 0s and "+drainWaitMax.String(), http.StatusBadRequest)
+            return
+        }
+        wait = d
+    }
+    dv, ok := setCordon(w, r, true)
+    if !ok {
+        return
+    }
+    deadline := time.Now().Add(wait)
+    for {
+        f, err := inFlight(r, dv)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        if f.Idle() || !time.Now().Before(deadline) {
+            status := http.StatusOK
+            if !f.Idle() {
+                status = http.StatusAccepted
+            }
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(status)
+            _ = json.NewEncoder(w).Encode(map[string]any{"device": dv, "drained": f.Idle(), "in_flight": f})
+            return
+        }
+        select {
+        case <-r.Context().Done():
+            return
+        case <-time.After(time.Second):
+        }
+        if dv, ok = reloadDevice(w, r, dv.ID); !ok {
+            return
+        }
+    }
+}
+
+// setCordon cordons (or drains) the device for the request's operator. When
+// it returns false the response is written.
+func setCordon(w http.ResponseWriter, r *http.Request, drain bool) (xdb.Device, bool) {
+    op, ok := operator(w, r)
+    if !ok {
+        return xdb.Device{}, false
+    }
+    var q struct {
+        Reason string `json:"reason"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&q); err != nil && !errors.Is(err, io.EOF) {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return xdb.Device{}, false
+    }
+    id := chi.URLParam(r, "id")
+    c := &xdb.Cordon{At: time.Now().UTC(), By: op, Reason: q.Reason, Drain: drain}
+
+    if store != nil && store.Enabled {
+        cur, err := store.GetDevice(r.Context(), id)
+        if !cordonFound(w, r, id, err) {
+            return xdb.Device{}, false
+        }
+        keepCordon(c, cur.Cordon)
+        dv, err := store.SetCordon(r.Context(), id, c)
+        if !cordonFound(w, r, id, err) {
+            return xdb.Device{}, false
+        }
+        typ := "cordoned"
+        if drain {
+            typ = "drain"
+        }
+        detail := "by " + op
+        if q.Reason != "" {
+            detail += ": " + q.Reason
+        }
+        cordonEvent(r, id, typ, detail)
+        return dv, true
+    }
+    d, ok := memCordonDevice(w, id)
+    if !ok {
+        return xdb.Device{}, false
+    }
+    keepCordon(c, d.Cordon)
+    d.Cordon = c
+    return memDevice(d), true
+}
+
+// keepCordon carries the time (and, if none is given, the reason) of an
+// existing cordon over to c.
+func keepCordon(c, old *xdb.Cordon) {
+    if old == nil {
+        return
+    }
+    c.At = old.At
+    if c.Reason == "" {
+        c.Reason = old.Reason
+    }
+}
+
+// inFlight is what is still in flight on dv (updates only in memory mode,
+// which has no executions).
+func inFlight(r *http.Request, dv xdb.Device) (xdb.InFlight, error) {
+    if store != nil && store.Enabled {
+        return store.DeviceInFlight(r.Context(), dv)
+    }
+    return xdb.InFlight{Updates: dv.PendingUpdates()}, nil
+}
+
+// reloadDevice re-reads a device while a drain waits on it.
+func reloadDevice(w http.ResponseWriter, r *http.Request, id string) (xdb.Device, bool) {
+    if store != nil && store.Enabled {
+        dv, err := store.GetDevice(r.Context(), id)
+        return dv, cordonFound(w, r, id, err)
+    }
+    d, ok := memCordonDevice(w, id)
+    if !ok {
+        return xdb.Device{}, false
+    }
+    return memDevice(d), true
+}
+
+// cordonFound writes the response for a failed device lookup or update:
+// 410 for decommissioned devices, 404 for unknown ones.
+func cordonFound(w http.ResponseWriter, r *http.Request, id string, err error) bool {
+    if errors.Is(err, pgx.ErrNoRows) {
+        if _, aerr := store.GetArchivedDevice(r.Context(), id); aerr == nil {
+            http.Error(w, "device decommissioned", http.StatusGone)
+            return false
+        }
+        http.Error(w, "not found", http.StatusNotFound)
+        return false
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return false
+    }
+    return true
+}
+
+func memCordonDevice(w http.ResponseWriter, id string) (*Device, bool) {
+    d, ok := devices[id]
+    if !ok {
+        if _, gone := decommissioned[id]; gone {
+            http.Error(w, "device decommissioned", http.StatusGone)
+            return nil, false
+        }
+        http.Error(w, "not found", http.StatusNotFound)
+        return nil, false
+    }
+    return d, true
+}
+
+// cordonEvent records a cordon change in the device's events. Errors are
+// logged only: the change itself is stored.
+func cordonEvent(r *http.Request, id, typ, detail string) {
+    ev := []xdb.DeviceEvent{{DeviceID: id, TS: time.Now().UTC(), Type: typ, Detail: detail}}
+    if err := store.InsertDeviceEvents(r.Context(), id, ev); err != nil {
+        log.Printf("[devices] %s event for %s: %v", typ, id, err)
+    }
+}
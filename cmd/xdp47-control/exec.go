@@ -0,0 +1,325 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/jackc/pgx/v5"
+
+    xdb "github.com/example/xdp47/internal/db"
+    "github.com/example/xdp47/internal/selector"
+)
+
+// --- remote exec ---
+//
+// Operators run commands from the tenant's exec templates (an allowlist) on a
+// device or on every device matching a selector. The execution waits for the
+// device's next heartbeat, which hands it to the agent; the agent posts the
+// result to /api/devices/{id}/exec-results.
+
+// operatorHeader names the operator a request is made for; executions and
+// decommissions record it.
+const operatorHeader = "X-Operator"
+
+// execRequest is what the heartbeat answer carries for the agent.
+type execRequest struct {
+    ID             string `json:"id"`
+    Command        string `json:"command"`
+    TimeoutSeconds int    `json:"timeout_seconds"`
+    MaxOutputBytes int    `json:"max_output_bytes"`
+}
+
+func operator(w http.ResponseWriter, r *http.Request) (string, bool) {
+    op := strings.TrimSpace(r.Header.Get(operatorHeader))
+    if op == "" {
+        http.Error(w, operatorHeader+" header required", http.StatusBadRequest)
+        return "", false
+    }
+    return op, true
+}
+
+func listExecTemplates(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    rows, err := store.ListExecTemplates(r.Context(), chi.URLParam(r, "tenant"))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(rows)
+}
+
+func getExecTemplate(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    t, err := store.GetExecTemplate(r.Context(), chi.URLParam(r, "tenant"), chi.URLParam(r, "name"))
+    if errors.Is(err, pgx.ErrNoRows) {
+        http.Error(w, "not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(t)
+}
+
+func putExecTemplate(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    var t xdb.ExecTemplate
+    if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    t.Tenant, t.Name = chi.URLParam(r, "tenant"), chi.URLParam(r, "name")
+    if err := t.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err := store.PutExecTemplate(r.Context(), t); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    t.UpdatedAt = time.Now().UTC()
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(t)
+}
+
+func deleteExecTemplate(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    ok, err := store.DeleteExecTemplate(r.Context(), chi.URLParam(r, "tenant"), chi.URLParam(r, "name"))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !ok {
+        http.Error(w, "not found", http.StatusNotFound)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// execDevice queues a template for one device: POST /api/devices/{id}:exec.
+func execDevice(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    op, ok := operator(w, r)
+    if !ok {
+        return
+    }
+    var q struct {
+        Template string            `json:"template"`
+        Args     map[string]string `json:"args"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    dv, err := store.GetDevice(r.Context(), chi.URLParam(r, "id"))
+    if errors.Is(err, pgx.ErrNoRows) {
+        http.Error(w, "not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    execs, ok := queueExecs(w, r, dv.Tenant, q.Template, q.Args, op, "", []xdb.Device{dv})
+    if !ok {
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    _ = json.NewEncoder(w).Encode(execs[0])
+}
+
+// execSelector queues a template for every device of a tenant matching a
+// selector, as one batch: POST /api/exec.
+func execSelector(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    op, ok := operator(w, r)
+    if !ok {
+        return
+    }
+    var q struct {
+        Tenant   string            `json:"tenant"`
+        Selector selector.Selector `json:"selector"`
+        Template string            `json:"template"`
+        Args     map[string]string `json:"args"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if q.Tenant == "" {
+        http.Error(w, "tenant required", http.StatusBadRequest)
+        return
+    }
+    devs, err := store.FilterDevicesBySelector(r.Context(), q.Tenant, q.Selector)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if len(devs) == 0 {
+        http.Error(w, "selector matches no devices", http.StatusBadRequest)
+        return
+    }
+    batch := fmt.Sprintf("exb-%d", time.Now().UnixNano())
+    execs, ok := queueExecs(w, r, q.Tenant, q.Template, q.Args, op, batch, devs)
+    if !ok {
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    _ = json.NewEncoder(w).Encode(map[string]any{"batch_id": batch, "execs": execs})
+}
+
+// queueExecs renders the template and stores one pending execution per
+// device. On failure it has written the error response.
+func queueExecs(w http.ResponseWriter, r *http.Request, tenant, name string, args map[string]string,
+    op, batch string, devs []xdb.Device) ([]xdb.DeviceExec, bool) {
+    if name == "" {
+        http.Error(w, "template required", http.StatusBadRequest)
+        return nil, false
+    }
+    t, err := store.GetExecTemplate(r.Context(), tenant, name)
+    if errors.Is(err, pgx.ErrNoRows) {
+        http.Error(w, fmt.Sprintf("tenant %s has no exec template %q", tenant, name), http.StatusBadRequest)
+        return nil, false
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return nil, false
+    }
+    cmd, err := t.Render(args)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return nil, false
+    }
+    now := time.Now().UTC()
+    execs := make([]xdb.DeviceExec, 0, len(devs))
+    for i, dv := range devs {
+        execs = append(execs, xdb.DeviceExec{
+            ID: fmt.Sprintf("ex-%d-%d", now.UnixNano(), i), BatchID: batch, Tenant: tenant, DeviceID: dv.ID,
+            Template: t.Name, Args: args, Command: cmd, Operator: op, State: xdb.ExecPending,
+            TimeoutSeconds: t.TimeoutSeconds, MaxOutputBytes: t.MaxOutputBytes, CreatedAt: now,
+        })
+    }
+    if err := store.CreateExecs(r.Context(), execs); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return nil, false
+    }
+    log.Printf("[exec] %s: %s on %d device(s) (batch %q)", op, t.Name, len(execs), batch)
+    return execs, true
+}
+
+func getExec(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    e, err := store.GetExec(r.Context(), chi.URLParam(r, "id"))
+    if errors.Is(err, pgx.ErrNoRows) {
+        http.Error(w, "not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(e)
+}
+
+// listExecs: GET /api/exec?tenant=&device_id=&batch_id=&operator=&limit=
+func listExecs(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    q := r.URL.Query()
+    limit, _ := strconv.Atoi(q.Get("limit"))
+    rows, err := store.ListExecs(r.Context(), xdb.ExecFilter{
+        Tenant: q.Get("tenant"), DeviceID: q.Get("device_id"), BatchID: q.Get("batch_id"),
+        Operator: q.Get("operator"), Limit: limit,
+    })
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(rows)
+}
+
+// postExecResult stores what the agent reports for an execution it was handed.
+func postExecResult(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    if !deviceAuth(w, r, chi.URLParam(r, "id")) {
+        return
+    }
+    var res xdb.ExecResult
+    if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if res.ID == "" {
+        http.Error(w, "id required", http.StatusBadRequest)
+        return
+    }
+    ok, err := store.CompleteExec(r.Context(), chi.URLParam(r, "id"), res)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !ok {
+        http.Error(w, "no running execution "+res.ID+" on this device", http.StatusConflict)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]any{"ok": "true"})
+}
+
+// claimExecs returns the executions to hand a device with its heartbeat
+// answer. Errors are logged only: the heartbeat itself is already stored.
+func claimExecs(r *http.Request, id string) []execRequest {
+    if store == nil || !store.Enabled {
+        return nil
+    }
+    execs, err := store.ClaimExecs(r.Context(), id)
+    if err != nil {
+        log.Printf("[exec] claim for %s: %v", id, err)
+        return nil
+    }
+    out := make([]execRequest, 0, len(execs))
+    for _, e := range execs {
+        out = append(out, execRequest{ID: e.ID, Command: e.Command, TimeoutSeconds: e.TimeoutSeconds, MaxOutputBytes: e.MaxOutputBytes})
+    }
+    return out
+}
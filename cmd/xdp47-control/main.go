@@ -3,20 +3,25 @@
 import (
     "context"
     "encoding/json"
+    "errors"
     "fmt"
     "log"
-    "math/rand"
     "net/http"
     "os"
-    "sort"
+    "strconv"
     "strings"
     "time"
+    _ "time/tzdata" // maintenance window time zones without a system zoneinfo
 
     "github.com/go-chi/chi/v5"
     "github.com/go-chi/chi/v5/middleware"
+    "github.com/jackc/pgx/v5"
 
+    "github.com/example/xdp47/internal/collector"
     xdb "github.com/example/xdp47/internal/db"
+    "github.com/example/xdp47/internal/liveness"
     scheduler "github.com/example/xdp47/internal/scheduler"
+    "github.com/example/xdp47/internal/selector"
 )
 
 type Device struct {
@@ -28,13 +33,28 @@ type Device struct {
     Location string            `json:"location"`
     Version  string            `json:"version"`
     Channel  string            `json:"channel"`
+    ReportedVersion string     `json:"reported_version,omitempty"`
+    ReportedChannel string     `json:"reported_channel,omitempty"`
+    ReportedAgentVersion string `json:"reported_agent_version,omitempty"`
+    Metrics  json.RawMessage   `json:"-"` // latest heartbeat sample
+    Probes   json.RawMessage   `json:"probes,omitempty"`
+    TokenHash string           `json:"-"` // device credential, see deviceAuth
+    Cordon   *xdb.Cordon       `json:"cordon,omitempty"`
 }
 
 // in-memory fallback
 var devices = map[string]*Device{}
 var store *xdb.Store
 
+// liveOpt are the connectivity thresholds (see livenessOptions).
+var liveOpt liveness.Options
+
 func main() {
+    liveOpt = livenessOptions()
+    if err := liveOpt.Validate(); err != nil {
+        log.Fatalf("[liveness] %v", err)
+    }
+
     // DB connect (optional, with retry)
     dbURL := os.Getenv("XDP47_DB_URL")
     if dbURL != "" {
@@ -46,6 +66,13 @@ func main() {
                 if err = store.Migrate(ctx); err == nil {
                     _ = store.MigrateRollouts(ctx)
                     _ = store.MigrateScheduler(ctx)
+                    _ = store.MigrateTenants(ctx)
+                    _ = store.MigrateMaintenance(ctx)
+                    _ = store.MigrateDeviceEvents(ctx)
+                    _ = store.MigrateExec(ctx)
+                    _ = store.MigrateHeartbeats(ctx)
+                    _ = store.MigrateDeviceArchive(ctx)
+                    _ = store.MigrateDeviceQuery(ctx)
                     log.Printf("[db] connected & migrated: %s", redacted(dbURL))
                     break
                 }
@@ -60,6 +87,14 @@ func main() {
         log.Printf("[db] XDP47_DB_URL not set; running in memory mode")
     }
 
+    // Pick up rollouts interrupted by a restart and start queued ones.
+    if store != nil && store.Enabled {
+        go scheduler.Supervise(context.Background(), store, schedOptions(),
+            parseDurationEnv("XDP47_SCHED_SUPERVISE", 15*time.Second))
+        // Derive online/stale/offline from last_seen, so dead devices show up as such.
+        go liveness.Run(context.Background(), store, liveOpt)
+    }
+
     addr := os.Getenv("XDP47_LISTEN_ADDR")
     if addr == "" {
         addr = ":8080"
@@ -70,7 +105,11 @@ func main() {
     r.Use(middleware.Logger)
     r.Use(middleware.Recoverer)
     r.Get ("/api/rollouts/{id}/runs",  getRolloutRuns)
+    r.Get ("/api/rollouts/{id}/targets", getRolloutTargets)
     r.Post("/api/rollouts/{id}:retry", retryRollout)
+    r.Post("/api/rollouts/{id}:pause", rolloutTransition([]string{"running"}, "paused", "paused"))
+    r.Post("/api/rollouts/{id}:resume", rolloutTransition([]string{"paused"}, "running", "resumed"))
+    r.Post("/api/rollouts/{id}:cancel", rolloutTransition([]string{"draft", "queued", "running", "paused"}, "cancelled", "cancelled"))
 
 
     r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
@@ -78,11 +117,40 @@ func main() {
         _, _ = w.Write([]byte("ok"))
     })
 
+    // Tenants
+    r.Get("/api/tenants/{tenant}/settings", getTenantSettings)
+    r.Put("/api/tenants/{tenant}/settings", putTenantSettings)
+    r.Get("/api/tenants/{tenant}/exec-templates", listExecTemplates)
+    r.Get("/api/tenants/{tenant}/exec-templates/{name}", getExecTemplate)
+    r.Put("/api/tenants/{tenant}/exec-templates/{name}", putExecTemplate)
+    r.Delete("/api/tenants/{tenant}/exec-templates/{name}", deleteExecTemplate)
+
+    // Maintenance windows
+    r.Get("/api/maintenance-windows", listMaintenanceWindows)
+    r.Post("/api/maintenance-windows", createMaintenanceWindow)
+    r.Delete("/api/maintenance-windows/{id}", deleteMaintenanceWindow)
+
     // Devices
     r.Get("/api/devices", listDevices)
     r.Post("/api/devices/claim", claimHandler)
+    r.Get("/api/devices/{id}", getDevice)
+    r.Patch("/api/devices/{id}", patchDevice)
+    r.Post("/api/devices/{id}:decommission", decommissionDevice)
+    r.Post("/api/devices/{id}:cordon", cordonDevice)
+    r.Post("/api/devices/{id}:uncordon", uncordonDevice)
+    r.Post("/api/devices/{id}:drain", drainDevice)
     r.Post("/api/devices/{id}/heartbeat", heartbeatHandler)
+    r.Get("/api/devices/{id}/desired", getDesired)
+    r.Get("/api/devices/{id}/events", listDeviceEvents)
+    r.Post("/api/devices/{id}/events", postDeviceEvents)
     r.Get("/api/devices/{id}/metrics/stream", sseMetrics)
+    r.Post("/api/devices/{id}:exec", execDevice)
+    r.Post("/api/devices/{id}/exec-results", postExecResult)
+
+    // Remote exec
+    r.Post("/api/exec", execSelector)
+    r.Get("/api/exec", listExecs)
+    r.Get("/api/exec/{id}", getExec)
 
     // Rollouts
     r.Get("/api/rollouts", listRollouts)
@@ -132,6 +200,47 @@ func parseDurationEnv(key string, def time.Duration) time.Duration {
     }
     return def
 }
+
+// livenessOptions reads the connectivity thresholds from the environment.
+func livenessOptions() liveness.Options {
+    return liveness.Options{
+        Stale:   parseDurationEnv("XDP47_LIVENESS_STALE", time.Minute),
+        Offline: parseDurationEnv("XDP47_LIVENESS_OFFLINE", 5*time.Minute),
+        Every:   parseDurationEnv("XDP47_LIVENESS_INTERVAL", 15*time.Second),
+    }
+}
+
+// schedOptions reads scheduler knobs from the environment.
+func schedOptions() scheduler.Options {
+    return scheduler.Options{
+        WaveInterval:   parseDurationEnv("XDP47_SCHED_INTERVAL", 8*time.Second),
+        HeartbeatGrace: parseDurationEnv("XDP47_SCHED_GRACE", 2*time.Minute),
+        RequireOK:      parseBoolEnv("XDP47_SCHED_REQUIRE_OK", false),
+        SkipOffline:    parseBoolEnv("XDP47_SCHED_SKIP_OFFLINE", true),
+        Rollback:       getenvDefault("XDP47_SCHED_ROLLBACK", scheduler.RollbackOff),
+        MaxFailureRatio: parseFloatEnv("XDP47_SCHED_MAX_FAILURE_RATIO", 1),
+        BakePoll:       parseDurationEnv("XDP47_SCHED_BAKE_POLL", 5*time.Second),
+        WindowPoll:     parseDurationEnv("XDP47_SCHED_WINDOW_POLL", time.Minute),
+        WindowDeadline: parseDurationEnv("XDP47_SCHED_WINDOW_DEADLINE", 72*time.Hour),
+    }
+}
+
+func parseFloatEnv(key string, def float64) float64 {
+    if v := os.Getenv(key); v != "" {
+        if f, err := strconv.ParseFloat(v, 64); err == nil {
+            return f
+        }
+    }
+    return def
+}
+
+func getenvDefault(key, def string) string {
+    if v := os.Getenv(key); v != "" {
+        return v
+    }
+    return def
+}
+
 func parseBoolEnv(key string, def bool) bool {
     if v := os.Getenv(key); v != "" {
         if v == "1" || strings.EqualFold(v, "true") {
@@ -146,13 +255,22 @@ func parseBoolEnv(key string, def bool) bool {
 
 // --- devices handlers ---
 
+// listDevices: GET /api/devices with the filters, sort and cursor of
+// parseDeviceQuery. The body stays a JSON array; the next page's cursor comes
+// in X-Next-Cursor (and a Link header).
 func listDevices(w http.ResponseWriter, r *http.Request) {
+    q, err := parseDeviceQuery(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
     if store != nil && store.Enabled {
-        rows, err := store.ListDevices(r.Context())
+        rows, next, err := store.QueryDevices(r.Context(), q)
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
             return
         }
+        nextPage(w, r, next)
         w.Header().Set("Content-Type", "application/json")
         _ = json.NewEncoder(w).Encode(rows)
         return
@@ -165,22 +283,29 @@ func listDevices(w http.ResponseWriter, r *http.Request) {
         Labels   map[string]string `json:"labels"`
         LastSeen time.Time         `json:"last_seen"`
         Health   string            `json:"health"`
+        Location string            `json:"location"`
         Version  string            `json:"version"`
         Channel  string            `json:"channel"`
+        ReportedVersion string     `json:"reported_version,omitempty"`
+        Probes   json.RawMessage   `json:"probes,omitempty"`
+        Cordon   *xdb.Cordon       `json:"cordon,omitempty"`
+        Connectivity string        `json:"connectivity"`
     }
-    out := make([]devOut, 0, len(devices))
+    all := make([]xdb.Device, 0, len(devices))
     for _, d := range devices {
+        all = append(all, memDevice(d))
+    }
+    page, next := q.Page(all, time.Now())
+    out := make([]devOut, 0, len(page))
+    for _, p := range page {
+        d := devices[p.ID]
         out = append(out, devOut{
-            ID: d.ID, Tenant: d.Tenant, Labels: d.Labels, LastSeen: d.LastSeen, Health: d.Health,
-            Version: d.Version, Channel: d.Channel,
+            ID: d.ID, Tenant: d.Tenant, Labels: d.Labels, LastSeen: d.LastSeen, Health: d.Health, Location: d.Location,
+            Version: d.Version, Channel: d.Channel, ReportedVersion: d.ReportedVersion, Probes: d.Probes, Cordon: d.Cordon,
+            Connectivity: p.Connectivity,
         })
     }
-    sort.Slice(out, func(i, j int) bool {
-        if out[i].LastSeen.Equal(out[j].LastSeen) {
-            return out[i].ID < out[j].ID
-        }
-        return out[i].LastSeen.After(out[j].LastSeen)
-    })
+    nextPage(w, r, next)
     w.Header().Set("Content-Type", "application/json")
     _ = json.NewEncoder(w).Encode(out)
 }
@@ -208,6 +333,12 @@ func claimHandler(w http.ResponseWriter, r *http.Request) {
         labels[k] = fmt.Sprint(v)
     }
     now := time.Now().UTC()
+    // the agent's credential for its heartbeats, events and exec results
+    token, err := xdb.NewDeviceToken()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
 
     if store != nil && store.Enabled {
         dv := xdb.Device{
@@ -219,22 +350,36 @@ func claimHandler(w http.ResponseWriter, r *http.Request) {
             http.Error(w, err.Error(), http.StatusInternalServerError)
             return
         }
+        if err := store.SetDeviceToken(r.Context(), id, xdb.HashDeviceToken(token)); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
     } else {
         devices[id] = &Device{ID: id, Tenant: q.Tenant, Labels: labels, LastSeen: now, Health: "unknown",
-            Location: q.Location, Version: q.Version, Channel: q.Channel}
+            Location: q.Location, Version: q.Version, Channel: q.Channel, TokenHash: xdb.HashDeviceToken(token)}
     }
 
     w.Header().Set("Content-Type", "application/json")
-    _ = json.NewEncoder(w).Encode(map[string]string{"device_id": id})
+    _ = json.NewEncoder(w).Encode(map[string]string{"device_id": id, "token": token})
 }
 
 func heartbeatHandler(w http.ResponseWriter, r *http.Request) {
     id := chi.URLParam(r, "id")
+    if !deviceAuth(w, r, id) {
+        return
+    }
     type hb struct {
         TS   time.Time         `json:"ts"`
         CPU  float64           `json:"cpu"`
         MEM  float64           `json:"mem"`
         Stat string            `json:"status"` // "ok"|"warn"|"crit"
+        Ver  string            `json:"version"` // optional: version the agent runs
+        Chan string            `json:"channel"` // optional: channel the agent follows
+        AgentVer string        `json:"agent_version"` // optional: agent binary version
+        Metrics json.RawMessage `json:"metrics"` // optional: collector sample, {"schema":N,...}
+        Probes  json.RawMessage `json:"probes"`  // optional: failing probes [{name,type,status,detail,...}]
+        Labels   map[string]interface{} `json:"labels"`   // optional: labels changed in the agent config; null removes
+        Location *string                `json:"location"` // optional: ditto
         Tags map[string]string `json:"tags"`   // optional
     }
     var q hb
@@ -242,31 +387,210 @@ func heartbeatHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
-    if q.TS.IsZero() {
-        q.TS = time.Now().UTC()
+    // late (replayed) heartbeats keep their timestamp; ones from the future
+    // (bad device clock) would pin last_seen ahead, so they count as now
+    if now := time.Now().UTC(); q.TS.IsZero() || q.TS.After(now.Add(time.Minute)) {
+        q.TS = now
     }
     status := "ok"
     if q.Stat != "" {
         status = q.Stat
     }
+    if len(q.Metrics) > 0 && string(q.Metrics) != "null" {
+        var v struct {
+            Schema int `json:"schema"`
+        }
+        if err := json.Unmarshal(q.Metrics, &v); err != nil || v.Schema <= 0 {
+            http.Error(w, "metrics: object with schema version required", http.StatusBadRequest)
+            return
+        }
+    } else {
+        q.Metrics = nil
+    }
+    if len(q.Probes) > 0 && string(q.Probes) != "null" {
+        var v []map[string]any
+        if err := json.Unmarshal(q.Probes, &v); err != nil {
+            http.Error(w, "probes: array required", http.StatusBadRequest)
+            return
+        }
+        if len(v) == 0 {
+            q.Probes = nil
+        }
+    } else {
+        q.Probes = nil
+    }
 
+    // labels are changes, merged like a PATCH: null removes a label
+    var labels map[string]*string
+    if q.Labels != nil {
+        labels = map[string]*string{}
+        for k, v := range q.Labels {
+            if v == nil {
+                labels[k] = nil
+                continue
+            }
+            s := fmt.Sprint(v)
+            labels[k] = &s
+        }
+    }
+
+    var newest bool // false: a replayed heartbeat older than the last one
     if store != nil && store.Enabled {
-        if err := store.UpdateHeartbeat(r.Context(), id, status, q.TS); err != nil {
+        hb := xdb.Heartbeat{Status: status, CPU: q.CPU, Mem: q.MEM, ReportedVersion: q.Ver, ReportedChannel: q.Chan, Metrics: q.Metrics, Probes: q.Probes,
+            ReportedAgentVersion: q.AgentVer, Labels: labels, Location: q.Location, TS: q.TS}
+        var err error
+        if newest, err = store.UpdateHeartbeat(r.Context(), id, hb); err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
             return
         }
+        if err := store.RecordHeartbeat(r.Context(), id, hb, !newest); err != nil {
+            log.Printf("[heartbeat] history for %s: %v", id, err)
+        }
+        if newest {
+            // back online right away instead of at the next sweep
+            liveness.SweepOnce(r.Context(), store, liveOpt, id)
+        }
     } else {
         dv, ok := devices[id]
         if !ok {
             http.Error(w, "not found", http.StatusNotFound)
             return
         }
-        dv.LastSeen = q.TS
-        dv.Health = status
+        if newest = !q.TS.Before(dv.LastSeen); newest {
+            dv.LastSeen = q.TS
+            dv.Health = status
+            if q.Ver != "" {
+                dv.ReportedVersion = q.Ver
+            }
+            if q.Chan != "" {
+                dv.ReportedChannel = q.Chan
+            }
+            if q.AgentVer != "" {
+                dv.ReportedAgentVersion = q.AgentVer
+            }
+            if q.Metrics != nil {
+                dv.Metrics = q.Metrics
+            }
+            dv.Probes = q.Probes
+            inv := memDevice(dv)
+            xdb.DevicePatch{Labels: labels, Location: q.Location}.Apply(&inv)
+            dv.Labels, dv.Location = inv.Labels, inv.Location
+        }
     }
 
+    // the agent reconciles to the desired state it gets back here
+    desired, ok, err := desiredState(r.Context(), id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !ok {
+        http.Error(w, "not found", http.StatusNotFound)
+        return
+    }
+    out := map[string]any{"ok": "true", "stale": !newest, "desired": desired}
+    // queued remote exec goes out with the answer (see exec.go)
+    if execs := claimExecs(r, id); len(execs) > 0 {
+        out["exec"] = execs
+    }
     w.Header().Set("Content-Type", "application/json")
-    _ = json.NewEncoder(w).Encode(map[string]string{"ok": "true"})
+    _ = json.NewEncoder(w).Encode(out)
+}
+
+// maxEventsBody bounds one events post; agents send a handful at a time.
+const maxEventsBody = 1 << 20
+
+// postDeviceEvents stores events an agent reports, possibly late and out of
+// order after being offline; each keeps its own ts.
+func postDeviceEvents(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    id := chi.URLParam(r, "id")
+    if !deviceAuth(w, r, id) {
+        return
+    }
+    var events []xdb.DeviceEvent
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEventsBody)).Decode(&events); err != nil {
+        var tooBig *http.MaxBytesError
+        if errors.As(err, &tooBig) {
+            http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+            return
+        }
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    now := time.Now().UTC()
+    for i := range events {
+        if events[i].Type == "" {
+            http.Error(w, "event type required", http.StatusBadRequest)
+            return
+        }
+        if events[i].TS.IsZero() || events[i].TS.After(now.Add(time.Minute)) {
+            events[i].TS = now
+        }
+    }
+    if err := store.InsertDeviceEvents(r.Context(), id, events); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]any{"ok": "true", "stored": len(events)})
+}
+
+func listDeviceEvents(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+    rows, err := store.ListDeviceEvents(r.Context(), chi.URLParam(r, "id"), limit)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(rows)
+}
+
+// getDesired returns the version/channel a device should run and what it last reported.
+func getDesired(w http.ResponseWriter, r *http.Request) {
+    id := chi.URLParam(r, "id")
+    if !deviceAuth(w, r, id) {
+        return
+    }
+    desired, ok, err := desiredState(r.Context(), id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !ok {
+        http.Error(w, "not found", http.StatusNotFound)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(desired)
+}
+
+func desiredState(ctx context.Context, id string) (xdb.DesiredState, bool, error) {
+    if store != nil && store.Enabled {
+        dv, err := store.GetDevice(ctx, id)
+        if errors.Is(err, pgx.ErrNoRows) {
+            return xdb.DesiredState{}, false, nil
+        }
+        if err != nil {
+            return xdb.DesiredState{}, false, err
+        }
+        return dv.Desired(), true, nil
+    }
+    d, ok := devices[id]
+    if !ok {
+        return xdb.DesiredState{}, false, nil
+    }
+    dv := xdb.Device{ID: d.ID, Version: d.Version, Channel: d.Channel,
+        ReportedVersion: d.ReportedVersion, ReportedChannel: d.ReportedChannel, ReportedAgentVersion: d.ReportedAgentVersion}
+    return dv.Desired(), true, nil
 }
 
 // dobavih gi tuk
@@ -288,6 +612,21 @@ func getRolloutRuns(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(rows)
 }
 
+func getRolloutTargets(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    id := chi.URLParam(r, "id")
+    rows, err := store.ListRolloutTargets(r.Context(), id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(rows)
+}
+
 func retryRollout(w http.ResponseWriter, r *http.Request) {
 	if store == nil || !store.Enabled {
 		http.Error(w, "db store required", http.StatusPreconditionFailed)
@@ -307,6 +646,10 @@ func retryRollout(w http.ResponseWriter, r *http.Request) {
 		Channel:   old.Channel,
 		Selector:  old.Selector,
 		Waves:     old.Waves,
+		Plan:      old.Plan,
+		Rollback:  old.Rollback,
+		BakeSeconds:     old.BakeSeconds,
+		MaxFailureRatio: old.MaxFailureRatio,
 		Status:    "draft",
 		CreatedAt: time.Now().UTC(),
 	}
@@ -315,19 +658,155 @@ func retryRollout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// СЃС‚Р°СЂС‚РёСЂР°РјРµ РЅРѕРІРёСЏ
-	go func() {
-		opt := scheduler.Options{
-			WaveInterval:   parseDurationEnv("XDP47_SCHED_INTERVAL", 8*time.Second),
-			HeartbeatGrace: parseDurationEnv("XDP47_SCHED_GRACE", 2*time.Minute),
-			RequireOK:      parseBoolEnv("XDP47_SCHED_REQUIRE_OK", false),
-			SkipOffline:    parseBoolEnv("XDP47_SCHED_SKIP_OFFLINE", true),
-		}
-		_ = scheduler.StartRollout(context.Background(), store, rec, opt)
-	}()
+	status, ok := beginRollout(w, r, rec)
+	if !ok {
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]any{"id": newID, "status": "running"})
+	_ = json.NewEncoder(w).Encode(map[string]any{"id": newID, "status": status})
+}
+
+// --- tenant settings ---
+
+func getTenantSettings(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    ts, err := store.GetTenantSettings(r.Context(), chi.URLParam(r, "tenant"))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(ts)
 }
 
+func putTenantSettings(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    tenant := chi.URLParam(r, "tenant")
+    ts, err := store.GetTenantSettings(r.Context(), tenant)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if err := json.NewDecoder(r.Body).Decode(&ts); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    ts.Tenant = tenant
+    if ts.RolloutConflict != xdb.ConflictReject && ts.RolloutConflict != xdb.ConflictQueue {
+        http.Error(w, "rollout_conflict must be reject|queue", http.StatusBadRequest)
+        return
+    }
+    if err := store.PutTenantSettings(r.Context(), ts); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(ts)
+}
+
+// --- maintenance windows ---
+
+func listMaintenanceWindows(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    rows, err := store.ListMaintenanceWindows(r.Context(), r.URL.Query().Get("tenant"))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if rows == nil {
+        rows = []xdb.MaintenanceWindow{}
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(rows)
+}
+
+func createMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    var mw xdb.MaintenanceWindow
+    if err := json.NewDecoder(r.Body).Decode(&mw); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err := mw.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    mw.ID = fmt.Sprintf("mw-%d", time.Now().UnixNano())
+    mw.CreatedAt = time.Now().UTC()
+    if err := store.CreateMaintenanceWindow(r.Context(), mw); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    _ = json.NewEncoder(w).Encode(mw)
+}
+
+func deleteMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
+    ok, err := store.DeleteMaintenanceWindow(r.Context(), chi.URLParam(r, "id"))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !ok {
+        http.Error(w, "not found", http.StatusNotFound)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// --- rollout control (pause / resume / cancel) ---
+
+// rolloutTransition moves a rollout from one of the `from` states to `to` and
+// records `event` in rollout_runs. The running scheduler picks the new status
+// up between devices and between waves.
+func rolloutTransition(from []string, to, event string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if store == nil || !store.Enabled {
+            http.Error(w, "db store required", http.StatusPreconditionFailed)
+            return
+        }
+        id := chi.URLParam(r, "id")
+        ok, err := store.TransitionRolloutStatus(r.Context(), id, from, to)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        if !ok {
+            ro, err := store.GetRollout(r.Context(), id)
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusNotFound)
+                return
+            }
+            http.Error(w, fmt.Sprintf("rollout is %s; expected one of %s", ro.Status, strings.Join(from, ", ")), http.StatusConflict)
+            return
+        }
+        if err := store.InsertRolloutEvent(r.Context(), id, event); err != nil {
+            log.Printf("[sched] rollout %s: record %s: %v", id, event, err)
+        }
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(map[string]any{"id": id, "status": to})
+    }
+}
+
+// sseMetrics streams the metrics the device sends with its heartbeats: one
+// event per new sample, plus a keepalive comment while nothing arrives.
 func sseMetrics(w http.ResponseWriter, r *http.Request) {
     id := chi.URLParam(r, "id")
     if id == "" {
@@ -347,17 +826,29 @@ func sseMetrics(w http.ResponseWriter, r *http.Request) {
     ticker := time.NewTicker(1 * time.Second)
     defer ticker.Stop()
 
+    var last time.Time
+    idle := 0
     for {
         select {
         case <-r.Context().Done():
             return
-        case t := <-ticker.C:
+        case <-ticker.C:
+            m, err := latestMetrics(r.Context(), id)
+            if err != nil || m == nil || !m.TS.After(last) {
+                if idle++; idle%15 == 0 {
+                    w.Write([]byte(": keepalive\n\n"))
+                    flusher.Flush()
+                }
+                continue
+            }
+            last, idle = m.TS, 0
             payload := map[string]interface{}{
-                "ts":    t.UTC().Format(time.RFC3339Nano),
-                "cpu":   5 + rand.Float64()*30,
-                "mem":   50 + rand.Float64()*100,
-                "psi":   map[string]float64{"cpu": rand.Float64() * 0.1, "io": rand.Float64() * 0.1},
-                "event": randomEvent(),
+                "ts":      m.TS.Format(time.RFC3339Nano),
+                "cpu":     m.CPU.UsagePercent,
+                "mem":     m.Memory.UsedPercent,
+                "psi":     map[string]float64{"cpu": m.Pressure["cpu"].Some.Avg10, "io": m.Pressure["io"].Some.Avg10},
+                "event":   metricsEvent(m),
+                "metrics": m,
             }
             b, _ := json.Marshal(payload)
             w.Write([]byte("data: "))
@@ -368,19 +859,46 @@ func sseMetrics(w http.ResponseWriter, r *http.Request) {
     }
 }
 
-func randomEvent() string {
-    events := []string{"", "process_exit", "tcp_retransmit", ""}
-    return events[rand.Intn(len(events))]
+func latestMetrics(ctx context.Context, id string) (*collector.Metrics, error) {
+    var raw json.RawMessage
+    if store != nil && store.Enabled {
+        var err error
+        if raw, err = store.GetDeviceMetrics(ctx, id); err != nil {
+            return nil, err
+        }
+    } else if d, ok := devices[id]; ok {
+        raw = d.Metrics
+    }
+    if len(raw) == 0 {
+        return nil, nil
+    }
+    var m collector.Metrics
+    if err := json.Unmarshal(raw, &m); err != nil {
+        return nil, err
+    }
+    return &m, nil
+}
+
+func metricsEvent(m *collector.Metrics) string {
+    if m.TCP.RetransDelta > 0 {
+        return "tcp_retransmit"
+    }
+    return ""
 }
 
 // --- rollouts handlers (MVP) ---
 
 type rolloutReq struct {
     Tenant   string            `json:"tenant"`   // required
-    Artifact string            `json:"artifact"` // optional
+    Artifact string            `json:"artifact"` // optional; "xdp47-agent:<version>" updates the agent itself
     Channel  string            `json:"channel"`  // e.g. "dev"|"canary"|"prod"
-    Selector map[string]string `json:"selector"` // match labels
+    Selector selector.Selector `json:"selector"` // selector string or {label: value}
     Waves    int               `json:"waves"`    // number of waves
+    Plan     xdb.WavePlan      `json:"plan"`     // optional explicit sizes, e.g. [1,"5%","25%","100%"]
+    Rollback string            `json:"rollback"` // off|on_failed|on_partial (optional)
+    BakeSeconds     int        `json:"bake_seconds"`      // health watch after each wave (optional)
+    MaxFailureRatio *float64   `json:"max_failure_ratio"` // 0..1 (optional)
+    Deadline        *time.Time `json:"deadline"` // give up on devices still outside their maintenance window (optional)
 }
 
 func listRollouts(w http.ResponseWriter, r *http.Request) {
@@ -408,16 +926,38 @@ func createRollout(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "tenant required", http.StatusBadRequest)
         return
     }
+    if err := q.Plan.Validate(); err != nil {
+        http.Error(w, "plan: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    if len(q.Plan) > 0 {
+        q.Waves = len(q.Plan)
+    }
     if q.Waves <= 0 {
         q.Waves = 1
     }
-    if q.Selector == nil {
-        q.Selector = map[string]string{}
+    if !scheduler.ValidRollbackPolicy(q.Rollback) {
+        http.Error(w, "rollback must be off|on_failed|on_partial", http.StatusBadRequest)
+        return
+    }
+    if q.BakeSeconds < 0 {
+        http.Error(w, "bake_seconds must be >= 0", http.StatusBadRequest)
+        return
+    }
+    if q.MaxFailureRatio != nil && (*q.MaxFailureRatio < 0 || *q.MaxFailureRatio > 1) {
+        http.Error(w, "max_failure_ratio must be between 0 and 1", http.StatusBadRequest)
+        return
+    }
+    if v, ok := xdb.AgentArtifact(q.Artifact); ok && v == "" {
+        http.Error(w, "artifact: agent version required ("+xdb.AgentArtifactPrefix+"<version>)", http.StatusBadRequest)
+        return
     }
     id := fmt.Sprintf("ro-%d", time.Now().UnixNano())
     rec := xdb.Rollout{
         ID: id, Tenant: q.Tenant, Artifact: q.Artifact, Channel: q.Channel,
-        Selector: q.Selector, Waves: q.Waves, Status: "draft", CreatedAt: time.Now().UTC(),
+        Selector: q.Selector, Waves: q.Waves, Plan: q.Plan, Rollback: q.Rollback,
+        BakeSeconds: q.BakeSeconds, MaxFailureRatio: q.MaxFailureRatio, Deadline: q.Deadline,
+        Status: "draft", CreatedAt: time.Now().UTC(),
     }
     if store != nil && store.Enabled {
         if err := store.CreateRollout(r.Context(), rec); err != nil {
@@ -429,57 +969,111 @@ func createRollout(w http.ResponseWriter, r *http.Request) {
     _ = json.NewEncoder(w).Encode(map[string]any{"id": id, "status": "draft"})
 }
 
+// simulateRollout is a dry run of the stored rollout: same tenant, selector,
+// wave plan and scheduler options as :start, nothing is applied.
 func simulateRollout(w http.ResponseWriter, r *http.Request) {
+    if store == nil || !store.Enabled {
+        http.Error(w, "db store required", http.StatusPreconditionFailed)
+        return
+    }
     id := chi.URLParam(r, "id")
-    _ = id
-
-    // Build candidate set from devices
-    var list []Device
-    if store != nil && store.Enabled {
-        rows, err := store.ListDevices(r.Context())
-        if err != nil {
-            http.Error(w, err.Error(), http.StatusInternalServerError)
+    ro, err := store.GetRollout(r.Context(), id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+    // ?waves= overrides the wave count of an even split for quick what-ifs;
+    // the response says so, since :start runs the stored count. An explicit
+    // plan is never overridden.
+    override := 0
+    if q := r.URL.Query().Get("waves"); q != "" {
+        n, err := strconv.Atoi(q)
+        if err != nil || n < 1 {
+            http.Error(w, "waves must be a positive number", http.StatusBadRequest)
             return
         }
-        for _, d := range rows {
-            list = append(list, Device{
-                ID: d.ID, Tenant: d.Tenant, Labels: d.Labels, LastSeen: d.LastSeen,
-                Health: d.Status, Location: d.Location, Version: d.Version, Channel: d.Channel,
-            })
-        }
-    } else {
-        for _, d := range devices {
-            list = append(list, *d)
+        if len(ro.Plan) > 0 {
+            http.Error(w, "rollout has an explicit plan; waves cannot override it", http.StatusConflict)
+            return
         }
+        ro.Waves, override = n, n
+    }
+    p, err := scheduler.PlanRollout(r.Context(), store, ro)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    opt := schedOptions()
+    byID := make(map[string]xdb.Device, len(p.Devices))
+    for _, d := range p.Devices {
+        byID[d.ID] = d
     }
 
+    type devPlan struct {
+        DeviceID string `json:"device_id"`
+        Outcome  string `json:"outcome"` // applied|deferred|skipped_cordoned|skipped_offline|failed_status
+        Failure  bool   `json:"counts_as_failure,omitempty"`
+        Reason   string `json:"reason,omitempty"`
+        From     string `json:"from"`
+        To       string `json:"to"`
+    }
     type wave struct {
-        Index     int      `json:"index"`
-        DeviceIDs []string `json:"device_ids"`
+        Index     int            `json:"index"`
+        Done      bool           `json:"done,omitempty"` // already finished; not re-applied
+        DeviceIDs []string       `json:"device_ids"`
+        Devices   []devPlan      `json:"devices"`
+        Summary   map[string]int `json:"summary"`
+    }
+    windows, err := store.ListMaintenanceWindows(r.Context(), ro.Tenant)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
     }
     plan := []wave{}
-
-    waves := 1
-    if q := r.URL.Query().Get("waves"); q != "" {
-        var tmp int
-        if _, err := fmt.Sscanf(q, "%d", &tmp); err == nil && tmp > 0 {
-            waves = tmp
+    now := time.Now()
+    // matched devices no wave reaches (plans stored before "100%" was required)
+    untargeted := len(p.Devices) - p.Handled
+    for i, ids := range p.Waves {
+        untargeted -= len(ids)
+        wv := wave{Index: i + 1, Done: p.Done[i], DeviceIDs: ids, Devices: []devPlan{}, Summary: map[string]int{}}
+        for _, did := range ids {
+            d := byID[did]
+            c := scheduler.Classify(d, opt, now)
+            if c.State == xdb.TargetApplied && !xdb.MaintenanceAllowed(windows, d, now) {
+                c.State, c.Reason = xdb.TargetDeferred, "outside maintenance window"
+            }
+            from, _ := scheduler.Current(ro, d)
+            dp := devPlan{DeviceID: did, Outcome: c.State, Failure: c.Failure, Reason: c.Reason, From: from, To: from}
+            if c.State == xdb.TargetApplied || c.State == xdb.TargetDeferred {
+                dp.To = scheduler.TargetVersion(ro)
+            }
+            wv.Devices = append(wv.Devices, dp)
+            wv.Summary[c.State]++
         }
-    }
-    buckets := make([][]string, waves)
-    for i, d := range list {
-        buckets[i%waves] = append(buckets[i%waves], d.ID)
-    }
-    for i := 0; i < waves; i++ {
-        plan = append(plan, wave{Index: i + 1, DeviceIDs: buckets[i]})
+        plan = append(plan, wv)
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    _ = json.NewEncoder(w).Encode(map[string]any{
+    out := map[string]any{
         "rollout_id":    id,
+        "tenant":        ro.Tenant,
+        "selector":      ro.Selector,
+        "artifact":      ro.Artifact,
+        "channel":       ro.Channel,
         "waves":         plan,
-        "total_devices": len(list),
-    })
+        "total_devices": len(p.Devices),
+        "untargeted":    max(untargeted, 0),
+        "options": map[string]any{
+            "heartbeat_grace": opt.HeartbeatGrace.String(),
+            "require_ok":      opt.RequireOK,
+            "skip_offline":    opt.SkipOffline,
+            "window_deadline": opt.WindowDeadline.String(),
+        },
+    }
+    if override > 0 {
+        out["waves_override"] = override // not what :start runs
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(out)
 }
 
 // --- scheduler start ---
@@ -495,17 +1089,43 @@ func startRollout(w http.ResponseWriter, r *http.Request) {
         http.Error(w, err.Error(), http.StatusNotFound)
         return
     }
-    go func() {
-        opt := scheduler.Options{
-            WaveInterval:   parseDurationEnv("XDP47_SCHED_INTERVAL", 8*time.Second),
-            HeartbeatGrace: parseDurationEnv("XDP47_SCHED_GRACE", 2*time.Minute),
-            RequireOK:      parseBoolEnv("XDP47_SCHED_REQUIRE_OK", false),
-            SkipOffline:    parseBoolEnv("XDP47_SCHED_SKIP_OFFLINE", true),
-        }
-        _ = scheduler.StartRollout(context.Background(), store, ro, opt)
-    }()
+    switch ro.Status {
+    case "cancelled", "rolling_back", "rolled_back":
+        http.Error(w, "rollout is "+ro.Status+"; use retry", http.StatusConflict)
+        return
+    }
+    status, ok := beginRollout(w, r, ro)
+    if !ok {
+        return
+    }
     w.Header().Set("Content-Type", "application/json")
-    _ = json.NewEncoder(w).Encode(map[string]any{"id": id, "status": "running"})
+    _ = json.NewEncoder(w).Encode(map[string]any{"id": id, "status": status})
+}
+
+// beginRollout claims ro's devices and starts it, honoring the tenant's
+// rollout_conflict policy. On failure it writes the response and returns false.
+func beginRollout(w http.ResponseWriter, r *http.Request, ro xdb.Rollout) (string, bool) {
+    ts, err := store.GetTenantSettings(r.Context(), ro.Tenant)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return "", false
+    }
+    status, err := scheduler.Begin(r.Context(), store, ro, schedOptions(), ts.RolloutConflict == xdb.ConflictQueue)
+    var conflict *xdb.RolloutConflictError
+    switch {
+    case errors.Is(err, xdb.ErrRolloutActive):
+        http.Error(w, err.Error(), http.StatusConflict)
+        return "", false
+    case errors.As(err, &conflict):
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusConflict)
+        _ = json.NewEncoder(w).Encode(map[string]any{"error": err.Error(), "conflicts": conflict.IDs})
+        return "", false
+    case err != nil:
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return "", false
+    }
+    return status, true
 }
 
 // --- UI ---
@@ -532,6 +1152,8 @@ func uiDevices(w http.ResponseWriter, r *http.Request) {
     .labels{font-family:ui-monospace,Consolas,monospace;font-size:12px;color:#cbd5e1}
     .toolbar{display:flex;gap:12px;align-items:center;margin-top:8px}
     .chip{border:1px solid #2a2f3a;border-radius:8px;padding:6px 10px}
+    input,select,button{background:#121722;color:#e6e6e6;border:1px solid #2a2f3a;border-radius:8px;padding:6px 8px}
+    a{color:#7cb3ff}
   </style>
 </head>
 <body>
@@ -539,7 +1161,26 @@ func uiDevices(w http.ResponseWriter, r *http.Request) {
   <div class="toolbar">
     <div class="chip muted">Auto-refresh: <span id="refint">5s</span></div>
     <div class="chip muted">Now: <span id="now"></span></div>
+    <div class="chip muted" id="page"></div>
   </div>
+  <form class="toolbar" method="get">
+    <input name="tenant" placeholder="tenant">
+    <input name="selector" placeholder="selector: site in (a,b),!beta">
+    <input name="health" placeholder="health warn,crit">
+    <select name="connectivity">
+      <option value="">any connectivity</option><option value="online">online</option>
+      <option value="stale">stale</option><option value="offline">offline</option><option value="stale,offline">stale or offline</option>
+    </select>
+    <input name="version" placeholder="version">
+    <input name="location" placeholder="location">
+    <input name="stale" placeholder="stale for (10m)" size="12">
+    <select name="sort">
+      <option value="-last_seen">last seen &darr;</option><option value="last_seen">last seen &uarr;</option>
+      <option value="id">id</option><option value="tenant">tenant</option><option value="health">health</option>
+      <option value="version">version</option><option value="location">location</option><option value="-created_at">newest</option>
+    </select>
+    <button type="submit">Filter</button>
+  </form>
   <table>
     <thead>
       <tr>
@@ -557,30 +1198,68 @@ func uiDevices(w http.ResponseWriter, r *http.Request) {
   <script>
     const $tbody = document.getElementById('tbody');
     const $now = document.getElementById('now');
+    const $page = document.getElementById('page');
     const REFRESH = 5000;
-    function pill(h){
+    // the page's query string is the list query; keep the form in step with it
+    const params = new URLSearchParams(location.search);
+    for(const el of document.querySelectorAll('form [name]')){
+      if(params.get(el.name)) el.value = params.get(el.name);
+    }
+    function pill(h, probes){
       const cls = (h||'unknown').toLowerCase();
-      return '<span class="pill '+cls+'">'+(h||'unknown')+'</span>';
+      const why = (probes||[]).map(p => p.name+': '+(p.detail||p.status)).join('\n');
+      return '<span class="pill '+cls+'"'+(why ? ' title="'+esc(why)+'"' : '')+'>'+(h||'unknown')+'</span>';
+    }
+    function esc(s){
+      return String(s).replace(/[&<>"]/g, c => ({'&':'&amp;','<':'&lt;','>':'&gt;','"':'&quot;'}[c]));
     }
     function fmtLabels(labels){
       if(!labels) return '';
       return '<span class="labels">'+Object.entries(labels).map(([k,v])=>k+'='+v).join(' ')+'</span>';
     }
+    function fmtVersion(d){
+      const v = d.version||'';
+      let out = (!d.reported_version || d.reported_version===v) ? v : v+' <span class="muted">(running '+d.reported_version+')</span>';
+      const a = d.reported_agent_version||'';
+      if(a || d.agent_version){
+        const want = d.agent_version && d.agent_version!==a ? ' &rarr; '+d.agent_version : '';
+        out += '<br><span class="muted">agent '+(a||'?')+want+'</span>';
+      }
+      return out;
+    }
+    function fmtConn(c){
+      const cls = {online:'ok', stale:'warn', offline:'crit'}[c];
+      return cls ? ' <span class="pill '+cls+'">'+c+'</span>' : '';
+    }
+    function fmtCordon(c){
+      if(!c) return '';
+      const why = (c.drain ? 'drained' : 'cordoned')+' by '+c.by+(c.reason ? ': '+c.reason : '');
+      return ' <span class="pill unknown" title="'+esc(why)+'">'+(c.drain ? 'draining' : 'cordoned')+'</span>';
+    }
     function fmtTime(s){
       try{ const d=new Date(s); return d.toLocaleString(); }catch(e){ return s; }
     }
     async function load(){
       $now.textContent = new Date().toLocaleTimeString();
-      const res = await fetch('/api/devices');
+      const res = await fetch('/api/devices'+location.search);
+      if(!res.ok){
+        $tbody.innerHTML = '<tr><td colspan="7" class="crit">'+esc(await res.text())+'</td></tr>';
+        return;
+      }
       const arr = await res.json();
+      const next = res.headers.get('X-Next-Cursor');
+      let nav = arr.length+' device(s)';
+      if(params.get('cursor')){ const p = new URLSearchParams(params); p.delete('cursor'); nav += ' &middot; <a href="?'+esc(p)+'">first page</a>'; }
+      if(next){ const p = new URLSearchParams(params); p.set('cursor', next); nav += ' &middot; <a href="?'+esc(p)+'">next page &rarr;</a>'; }
+      $page.innerHTML = nav;
       $tbody.innerHTML = arr.map(d => (
         '<tr>'+
-        '<td>'+d.id+'</td>'+
+        '<td><a href="/api/devices/'+encodeURIComponent(d.id)+'">'+d.id+'</a></td>'+
         '<td>'+d.tenant+'</td>'+
         '<td>'+fmtLabels(d.labels)+'</td>'+
-        '<td>'+fmtTime(d.last_seen)+'</td>'+
-        '<td>'+pill(d.health||d.status)+'</td>'+
-        '<td>'+(d.version||'')+'</td>'+
+        '<td>'+fmtTime(d.last_seen)+fmtConn(d.connectivity)+'</td>'+
+        '<td>'+pill(d.health||d.status, d.probes)+fmtCordon(d.cordon)+'</td>'+
+        '<td>'+fmtVersion(d)+'</td>'+
         '<td>'+(d.channel||'')+'</td>'+
         '</tr>'
       )).join('');
@@ -642,10 +1321,29 @@ function httpRetry(id, btn){
   }).finally(function(){ btn.disabled = false; });
 }
 
+function httpAction(id, action, btn){
+  btn.disabled = true;
+  fetch('/api/rollouts/'+id+':'+action, {method:'POST'}).then(function(res){
+    if(!res.ok){ return res.text().then(function(t){ throw new Error(t || ('HTTP '+res.status)); }); }
+    return res.json();
+  }).then(function(data){
+    toast('Rollout '+id+' '+data.status); load();
+  }).catch(function(e){
+    toast('Error: '+e.message);
+  }).finally(function(){ btn.disabled = false; });
+}
+
 function details(id){
-  fetch('/api/rollouts/'+id+'/runs').then(function(res){ return res.json(); }).then(function(arr){
+  Promise.all([
+    fetch('/api/rollouts/'+id+'/runs').then(function(res){ return res.json(); }),
+    fetch('/api/rollouts/'+id+'/targets').then(function(res){ return res.ok ? res.json() : []; })
+  ]).then(function(res){
+    var arr = res[0], targets = res[1];
+    var trows = targets.map(function(t){
+      return '<tr><td>'+t.wave_index+'</td><td>'+t.device_id+'</td><td>'+t.state+'</td><td>'+(t.prev_version||'')+' &rarr; '+(t.new_version||'')+'</td><td>'+(t.reason||'')+'</td></tr>';
+    }).join('');
     var rows = arr.map(function(r){
-      return '<tr><td>'+r.wave_index+'</td><td>'+r.status+'</td><td>'+new Date(r.started_at).toLocaleString()+'</td><td>'+(r.finished_at?new Date(r.finished_at).toLocaleString():'')+'</td></tr>';
+      return '<tr><td>'+(r.wave_index||'-')+'</td><td>'+r.status+'</td><td>'+new Date(r.started_at).toLocaleString()+'</td><td>'+(r.finished_at?new Date(r.finished_at).toLocaleString():'')+'</td></tr>';
     }).join('');
     var modal = ''
       + '<div id="dlg" style="position:fixed;left:0;top:0;right:0;bottom:0;background:rgba(0,0,0,.4);display:flex;align-items:center;justify-content:center;">'
@@ -658,6 +1356,11 @@ function details(id){
       + '      <thead><tr><th style="text-align:left">Wave</th><th>Status</th><th>Started</th><th>Finished</th></tr></thead>'
       + '      <tbody>'+(rows || '<tr><td colspan="4">No runs yet</td></tr>')+'</tbody>'
       + '    </table>'
+      + '    <b style="display:block;margin-top:12px">Devices</b>'
+      + '    <table style="width:100%;border-collapse:collapse">'
+      + '      <thead><tr><th style="text-align:left">Wave</th><th>Device</th><th>State</th><th>Version</th><th>Reason</th></tr></thead>'
+      + '      <tbody>'+(trows || '<tr><td colspan="5">No targets yet</td></tr>')+'</tbody>'
+      + '    </table>'
       + '  </div>'
       + '</div>';
     document.body.insertAdjacentHTML('beforeend', modal);
@@ -672,12 +1375,15 @@ function row(x){
     + '<td>'+x.tenant+'</td>'
     + '<td>'+(x.artifact||'')+'</td>'
     + '<td>'+(x.channel||'')+'</td>'
-    + '<td>'+x.waves+'</td>'
+    + '<td>'+(x.plan ? x.plan.join(' / ') : x.waves)+'</td>'
     + '<td>'+pill(x.status)+'</td>'
     + '<td>'+new Date(x.created_at).toLocaleString()+'</td>'
     + '<td class="row-actions">'
       + '<button onclick="httpStart(\''+id+'\', this)">Start</button> '
       + '<button onclick="httpRetry(\''+id+'\', this)">Retry</button> '
+      + '<button onclick="httpAction(\''+id+'\', \'pause\', this)"'+(x.status==='running'?'':' disabled')+'>Pause</button> '
+      + '<button onclick="httpAction(\''+id+'\', \'resume\', this)"'+(x.status==='paused'?'':' disabled')+'>Resume</button> '
+      + '<button onclick="httpAction(\''+id+'\', \'cancel\', this)"'+(/^(draft|queued|running|paused)$/.test(x.status)?'':' disabled')+'>Cancel</button> '
       + '<button onclick="details(\''+id+'\')">Details</button>'
     + '</td>'
   + '</tr>';
@@ -0,0 +1,374 @@
+// Package agentstate is the agent's local state: device identity, installed
+// versions and outbound data not yet accepted by the control plane.
+//
+// It is a journaled file store: state.json holds a snapshot and journal.log
+// the changes made since, one JSON line each, fsync'ed before a call returns.
+// Open replays the journal (a torn last line from a crash is ignored) and
+// compacts it into a fresh snapshot.
+package agentstate
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "maps"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// Identity is who the agent is in the fleet.
+type Identity struct {
+    DeviceID  string    `json:"device_id"`
+    Tenant    string    `json:"tenant"`
+    Token     string    `json:"token,omitempty"` // credential issued at claim, if any
+    ClaimedAt time.Time `json:"claimed_at"`
+}
+
+// Installed is one version present on disk.
+type Installed struct {
+    Version     string    `json:"version"`
+    Channel     string    `json:"channel"`
+    InstalledAt time.Time `json:"installed_at"`
+}
+
+// Outbound is data waiting to be delivered to the control plane.
+type Outbound struct {
+    Seq       uint64          `json:"seq"`
+    Kind      string          `json:"kind"`
+    Body      json.RawMessage `json:"body"`
+    CreatedAt time.Time       `json:"created_at"`
+}
+
+// AgentUpdate is an agent self-update in flight: the new binary is in place
+// and has until Deadline to heartbeat, else the previous one is restored.
+type AgentUpdate struct {
+    From      string    `json:"from"`
+    To        string    `json:"to"`
+    StartedAt time.Time `json:"started_at"`
+    Deadline  time.Time `json:"deadline"`
+}
+
+// Inventory is the labels and location the agent last sent from its config.
+type Inventory struct {
+    Labels   map[string]string `json:"labels"`
+    Location string            `json:"location"`
+}
+
+// State is the full persisted state.
+type State struct {
+    Identity  Identity    `json:"identity"`
+    Current   Installed   `json:"current"`   // running version
+    Installed []Installed `json:"installed"` // newest first, current included
+    Outbox    []Outbound  `json:"outbox"`
+    NextSeq   uint64      `json:"next_seq"`
+    AgentUpdate *AgentUpdate `json:"agent_update,omitempty"`
+    AgentFailed string       `json:"agent_failed,omitempty"` // agent version that was rolled back
+    Inventory   *Inventory   `json:"inventory,omitempty"`    // nil until first sent
+}
+
+// entry is one journal line.
+type entry struct {
+    Op        string     `json:"op"` // identity|current|enqueue|ack|agent_update|agent_update_end|inventory
+    Identity  *Identity  `json:"identity,omitempty"`
+    Installed *Installed `json:"installed,omitempty"`
+    Keep      int        `json:"keep,omitempty"`
+    Outbound  *Outbound  `json:"outbound,omitempty"`
+    Seq       uint64     `json:"seq,omitempty"`
+    Update    *AgentUpdate `json:"update,omitempty"`
+    Version   string     `json:"version,omitempty"`
+    Inventory *Inventory `json:"inventory,omitempty"`
+}
+
+// compactEvery bounds the journal; past it the snapshot is rewritten.
+const compactEvery = 256
+
+// Store is safe for concurrent use.
+type Store struct {
+    mu      sync.Mutex
+    dir     string
+    st      State
+    journal *os.File
+    entries int
+}
+
+// DefaultDir is $XDP47_STATE_DIR, else $HOME/.xdp47
+// (/var/lib/xdp47/.xdp47 under the systemd unit).
+func DefaultDir() string {
+    if d := os.Getenv("XDP47_STATE_DIR"); d != "" {
+        return d
+    }
+    home, err := os.UserHomeDir()
+    if err != nil || home == "" {
+        home = "."
+    }
+    return filepath.Join(home, ".xdp47")
+}
+
+// Open loads (or creates) the store in dir.
+func Open(dir string) (*Store, error) {
+    if err := os.MkdirAll(dir, 0o700); err != nil {
+        return nil, err
+    }
+    s := &Store{dir: dir}
+    b, err := os.ReadFile(s.snapshotPath())
+    switch {
+    case err == nil:
+        if err := json.Unmarshal(b, &s.st); err != nil {
+            return nil, fmt.Errorf("agentstate: %s: %w", s.snapshotPath(), err)
+        }
+    case !errors.Is(err, os.ErrNotExist):
+        return nil, err
+    }
+    if err := s.replay(); err != nil {
+        return nil, err
+    }
+    if err := s.compact(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+func (s *Store) snapshotPath() string { return filepath.Join(s.dir, "state.json") }
+func (s *Store) journalPath() string  { return filepath.Join(s.dir, "journal.log") }
+
+func (s *Store) replay() error {
+    b, err := os.ReadFile(s.journalPath())
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    sc := bufio.NewScanner(bytes.NewReader(b))
+    sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+    for sc.Scan() {
+        var e entry
+        if json.Unmarshal(sc.Bytes(), &e) != nil {
+            break // torn write at crash; everything after it is lost anyway
+        }
+        s.apply(e)
+    }
+    return nil
+}
+
+// apply changes the in-memory state; it is used both live and on replay.
+func (s *Store) apply(e entry) {
+    switch e.Op {
+    case "identity":
+        if e.Identity != nil {
+            s.st.Identity = *e.Identity
+        }
+    case "current":
+        if e.Installed == nil {
+            return
+        }
+        s.st.Current = *e.Installed
+        list := []Installed{*e.Installed}
+        for _, in := range s.st.Installed {
+            if in.Version != e.Installed.Version {
+                list = append(list, in)
+            }
+        }
+        if e.Keep > 0 && len(list) > e.Keep {
+            list = list[:e.Keep]
+        }
+        s.st.Installed = list
+    case "enqueue":
+        if e.Outbound != nil {
+            s.st.Outbox = append(s.st.Outbox, *e.Outbound)
+            if e.Outbound.Seq >= s.st.NextSeq {
+                s.st.NextSeq = e.Outbound.Seq + 1
+            }
+        }
+    case "ack":
+        i := 0
+        for i < len(s.st.Outbox) && s.st.Outbox[i].Seq <= e.Seq {
+            i++
+        }
+        s.st.Outbox = append([]Outbound(nil), s.st.Outbox[i:]...)
+    case "agent_update":
+        if e.Update != nil {
+            u := *e.Update
+            s.st.AgentUpdate = &u
+        }
+    case "agent_update_end":
+        s.st.AgentUpdate = nil
+        s.st.AgentFailed = e.Version
+    case "inventory":
+        if e.Inventory != nil {
+            inv := *e.Inventory
+            s.st.Inventory = &inv
+        }
+    }
+}
+
+// record journals e, then applies it.
+func (s *Store) record(e entry) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.recordLocked(e)
+}
+
+func (s *Store) recordLocked(e entry) error {
+    if s.journal == nil {
+        return errors.New("agentstate: store closed")
+    }
+    line, err := json.Marshal(e)
+    if err != nil {
+        return err
+    }
+    if _, err := s.journal.Write(append(line, '\n')); err != nil {
+        return err
+    }
+    if err := s.journal.Sync(); err != nil {
+        return err
+    }
+    s.apply(e)
+    s.entries++
+    if s.entries >= compactEvery {
+        return s.compact()
+    }
+    return nil
+}
+
+// compact writes the snapshot atomically and starts an empty journal.
+// Callers hold s.mu (or own s exclusively).
+func (s *Store) compact() error {
+    b, err := json.MarshalIndent(s.st, "", "  ")
+    if err != nil {
+        return err
+    }
+    tmp := s.snapshotPath() + ".tmp"
+    if err := writeSync(tmp, b); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, s.snapshotPath()); err != nil {
+        return err
+    }
+    if s.journal != nil {
+        s.journal.Close()
+    }
+    s.journal, err = os.OpenFile(s.journalPath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+    s.entries = 0
+    return err
+}
+
+func writeSync(path string, b []byte) error {
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(b); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+// Dir returns the store's directory.
+func (s *Store) Dir() string { return s.dir }
+
+// State returns a copy of the current state.
+func (s *Store) State() State {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    st := s.st
+    st.Installed = append([]Installed(nil), s.st.Installed...)
+    st.Outbox = append([]Outbound(nil), s.st.Outbox...)
+    if s.st.AgentUpdate != nil {
+        u := *s.st.AgentUpdate
+        st.AgentUpdate = &u
+    }
+    if s.st.Inventory != nil {
+        inv := Inventory{Labels: maps.Clone(s.st.Inventory.Labels), Location: s.st.Inventory.Location}
+        st.Inventory = &inv
+    }
+    return st
+}
+
+// SetIdentity persists the device identity.
+func (s *Store) SetIdentity(id Identity) error {
+    return s.record(entry{Op: "identity", Identity: &id})
+}
+
+// SetCurrent records version/channel as running and installed; only the
+// newest keep installed versions are remembered (0 = all).
+func (s *Store) SetCurrent(version, channel string, keep int) error {
+    in := Installed{Version: version, Channel: channel, InstalledAt: time.Now().UTC()}
+    return s.record(entry{Op: "current", Installed: &in, Keep: keep})
+}
+
+// SetInventory records the labels and location just sent to the control plane.
+func (s *Store) SetInventory(inv Inventory) error {
+    inv.Labels = maps.Clone(inv.Labels)
+    return s.record(entry{Op: "inventory", Inventory: &inv})
+}
+
+// BeginAgentUpdate records a self-update that is about to switch binaries.
+func (s *Store) BeginAgentUpdate(u AgentUpdate) error {
+    return s.record(entry{Op: "agent_update", Update: &u})
+}
+
+// EndAgentUpdate clears the update in flight. failed names an agent version
+// that did not work out ("" on success); it is remembered so that it is not
+// installed again.
+func (s *Store) EndAgentUpdate(failed string) error {
+    return s.record(entry{Op: "agent_update_end", Version: failed})
+}
+
+// Enqueue appends body to the outbox and returns its sequence number.
+func (s *Store) Enqueue(kind string, body any) (uint64, error) {
+    raw, err := json.Marshal(body)
+    if err != nil {
+        return 0, err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    ob := Outbound{Seq: s.st.NextSeq, Kind: kind, Body: raw, CreatedAt: time.Now().UTC()}
+    return ob.Seq, s.recordLocked(entry{Op: "enqueue", Outbound: &ob})
+}
+
+// Pending returns the outbox, oldest first.
+func (s *Store) Pending() []Outbound {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]Outbound(nil), s.st.Outbox...)
+}
+
+// Ack drops outbox entries up to and including seq.
+func (s *Store) Ack(seq uint64) error {
+    return s.record(entry{Op: "ack", Seq: seq})
+}
+
+// Trim drops the oldest outbox entries so that at most max remain, and
+// returns how many were dropped.
+func (s *Store) Trim(max int) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n := len(s.st.Outbox) - max
+    if max < 0 || n <= 0 {
+        return 0, nil
+    }
+    return n, s.recordLocked(entry{Op: "ack", Seq: s.st.Outbox[n-1].Seq})
+}
+
+// Close compacts and closes the journal.
+func (s *Store) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.journal == nil {
+        return nil
+    }
+    err := s.compact()
+    s.journal.Close()
+    s.journal = nil
+    return err
+}
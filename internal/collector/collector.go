@@ -0,0 +1,204 @@
+// Package collector reads host metrics from /proc for the agent heartbeat.
+//
+// The heartbeat carries them as "metrics" with an explicit schema version;
+// fields are only ever added within a version. Rates and percentages are
+// computed against the previous successful read of the same source, so the
+// first sample (and the first after a failed read) reports counters only.
+package collector
+
+import (
+    "fmt"
+    "path/filepath"
+    "time"
+)
+
+// SchemaVersion is the version of the Metrics payload.
+const SchemaVersion = 1
+
+// Metrics is one sample.
+type Metrics struct {
+    Schema   int                 `json:"schema"`
+    TS       time.Time           `json:"ts"`
+    CPU      CPU                 `json:"cpu"`
+    Memory   Memory              `json:"memory"`
+    Load     Load                `json:"load"`
+    Pressure map[string]Pressure `json:"pressure,omitempty"` // cpu|io|memory; absent without PSI
+    Disks    []Disk              `json:"disks,omitempty"`
+    Net      Net                 `json:"net"`
+    TCP      TCP                 `json:"tcp"`
+    Errors   []string            `json:"errors,omitempty"` // sources that could not be read
+}
+
+type CPU struct {
+    UsagePercent  float64 `json:"usage_percent"` // all cores, since previous sample
+    IOWaitPercent float64 `json:"iowait_percent"`
+    Cores         int     `json:"cores"`
+}
+
+type Memory struct {
+    TotalBytes     uint64  `json:"total_bytes"`
+    AvailableBytes uint64  `json:"available_bytes"`
+    UsedPercent    float64 `json:"used_percent"`
+    SwapTotalBytes uint64  `json:"swap_total_bytes"`
+    SwapFreeBytes  uint64  `json:"swap_free_bytes"`
+}
+
+type Load struct {
+    Load1   float64 `json:"load1"`
+    Load5   float64 `json:"load5"`
+    Load15  float64 `json:"load15"`
+    Running int     `json:"running"`
+    Total   int     `json:"total"`
+}
+
+// PSI is one line of /proc/pressure/*.
+type PSI struct {
+    Avg10  float64 `json:"avg10"`
+    Avg60  float64 `json:"avg60"`
+    Avg300 float64 `json:"avg300"`
+    Total  uint64  `json:"total"` // microseconds stalled
+}
+
+type Pressure struct {
+    Some PSI  `json:"some"`
+    Full *PSI `json:"full,omitempty"` // not reported for cpu on older kernels
+}
+
+type Disk struct {
+    Path        string  `json:"path"`
+    TotalBytes  uint64  `json:"total_bytes"`
+    FreeBytes   uint64  `json:"free_bytes"`
+    UsedPercent float64 `json:"used_percent"`
+}
+
+// Net sums all interfaces except loopback.
+type Net struct {
+    RxBytes       uint64  `json:"rx_bytes"`
+    TxBytes       uint64  `json:"tx_bytes"`
+    RxPackets     uint64  `json:"rx_packets"`
+    TxPackets     uint64  `json:"tx_packets"`
+    RxErrors      uint64  `json:"rx_errors"`
+    TxErrors      uint64  `json:"tx_errors"`
+    RxBytesPerSec float64 `json:"rx_bytes_per_sec"`
+    TxBytesPerSec float64 `json:"tx_bytes_per_sec"`
+}
+
+// TCP comes from the Tcp: lines of /proc/net/snmp.
+type TCP struct {
+    CurrEstab      uint64  `json:"curr_estab"`
+    InSegs         uint64  `json:"in_segs"`
+    OutSegs        uint64  `json:"out_segs"`
+    RetransSegs    uint64  `json:"retrans_segs"`
+    RetransDelta   uint64  `json:"retrans_delta"`   // since previous sample
+    RetransPercent float64 `json:"retrans_percent"` // retransmitted share of segments sent since previous sample
+}
+
+// Options configure a Collector.
+type Options struct {
+    ProcRoot  string   // default /proc
+    DiskPaths []string // mount points to report; default /
+}
+
+// Collector keeps the previous counters for deltas, per source and only from
+// reads that succeeded. Not safe for concurrent use.
+type Collector struct {
+    opt       Options
+    prevCPU   cpuTimes
+    haveCPU   bool
+    prevNet   Net
+    prevNetAt time.Time // zero: no previous net/dev read
+    prevTCP   TCP
+    haveTCP   bool
+}
+
+// New returns a collector.
+func New(opt Options) *Collector {
+    if opt.ProcRoot == "" {
+        opt.ProcRoot = "/proc"
+    }
+    if len(opt.DiskPaths) == 0 {
+        opt.DiskPaths = []string{"/"}
+    }
+    return &Collector{opt: opt}
+}
+
+func (c *Collector) path(p ...string) string {
+    return filepath.Join(append([]string{c.opt.ProcRoot}, p...)...)
+}
+
+// Collect takes a sample. Sources that fail are listed in Metrics.Errors; the
+// rest of the sample is still filled in.
+func (c *Collector) Collect() Metrics {
+    now := time.Now().UTC()
+    m := Metrics{Schema: SchemaVersion, TS: now}
+    fail := func(src string, err error) {
+        m.Errors = append(m.Errors, fmt.Sprintf("%s: %v", src, err))
+    }
+
+    if t, cores, err := readStat(c.path("stat")); err != nil {
+        fail("stat", err)
+    } else {
+        m.CPU.Cores = cores
+        if c.haveCPU {
+            m.CPU.UsagePercent, m.CPU.IOWaitPercent = t.usageSince(c.prevCPU)
+        }
+        c.prevCPU, c.haveCPU = t, true
+    }
+    if mem, err := readMeminfo(c.path("meminfo")); err != nil {
+        fail("meminfo", err)
+    } else {
+        m.Memory = mem
+    }
+    if l, err := readLoadavg(c.path("loadavg")); err != nil {
+        fail("loadavg", err)
+    } else {
+        m.Load = l
+    }
+    for _, res := range []string{"cpu", "io", "memory"} {
+        p, err := readPressure(c.path("pressure", res))
+        if err != nil {
+            continue // PSI is optional (CONFIG_PSI / psi=1)
+        }
+        if m.Pressure == nil {
+            m.Pressure = map[string]Pressure{}
+        }
+        m.Pressure[res] = p
+    }
+    for _, dp := range c.opt.DiskPaths {
+        d, err := diskUsage(dp)
+        if err != nil {
+            fail("disk "+dp, err)
+            continue
+        }
+        m.Disks = append(m.Disks, d)
+    }
+    if n, err := readNetDev(c.path("net", "dev")); err != nil {
+        fail("net/dev", err)
+    } else {
+        if secs := now.Sub(c.prevNetAt).Seconds(); !c.prevNetAt.IsZero() && secs > 0 {
+            n.RxBytesPerSec = float64(delta(n.RxBytes, c.prevNet.RxBytes)) / secs
+            n.TxBytesPerSec = float64(delta(n.TxBytes, c.prevNet.TxBytes)) / secs
+        }
+        m.Net, c.prevNet, c.prevNetAt = n, n, now
+    }
+    if t, err := readSNMP(c.path("net", "snmp")); err != nil {
+        fail("net/snmp", err)
+    } else {
+        if c.haveTCP {
+            t.RetransDelta = delta(t.RetransSegs, c.prevTCP.RetransSegs)
+            if out := delta(t.OutSegs, c.prevTCP.OutSegs); out > 0 {
+                t.RetransPercent = 100 * float64(t.RetransDelta) / float64(out)
+            }
+        }
+        m.TCP, c.prevTCP, c.haveTCP = t, t, true
+    }
+    return m
+}
+
+// delta tolerates counter resets (e.g. an interface going away).
+func delta(cur, prev uint64) uint64 {
+    if cur < prev {
+        return 0
+    }
+    return cur - prev
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package collector
+
+import "errors"
+
+func diskUsage(path string) (Disk, error) {
+    return Disk{}, errors.New("disk usage not supported on this platform")
+}
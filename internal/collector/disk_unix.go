@@ -0,0 +1,23 @@
+//go:build unix
+
+package collector
+
+import "syscall"
+
+func diskUsage(path string) (Disk, error) {
+    var st syscall.Statfs_t
+    if err := syscall.Statfs(path, &st); err != nil {
+        return Disk{}, err
+    }
+    d := Disk{
+        Path:       path,
+        TotalBytes: uint64(st.Blocks) * uint64(st.Bsize),
+        FreeBytes:  uint64(st.Bavail) * uint64(st.Bsize),
+    }
+    // used vs. what unprivileged users can still write, as df shows it
+    used := (uint64(st.Blocks) - uint64(st.Bfree)) * uint64(st.Bsize)
+    if used+d.FreeBytes > 0 {
+        d.UsedPercent = 100 * float64(used) / float64(used+d.FreeBytes)
+    }
+    return d, nil
+}
@@ -0,0 +1,259 @@
+package collector
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// cpuTimes is the aggregate "cpu" line of /proc/stat, in ticks.
+type cpuTimes struct {
+    total, idle, iowait uint64
+}
+
+func (t cpuTimes) usageSince(prev cpuTimes) (usage, iowait float64) {
+    total := delta(t.total, prev.total)
+    if total == 0 {
+        return 0, 0
+    }
+    idle := delta(t.idle, prev.idle) + delta(t.iowait, prev.iowait)
+    return 100 * float64(total-min(idle, total)) / float64(total),
+        100 * float64(delta(t.iowait, prev.iowait)) / float64(total)
+}
+
+func readStat(path string) (cpuTimes, int, error) {
+    var t cpuTimes
+    f, err := os.Open(path)
+    if err != nil {
+        return t, 0, err
+    }
+    defer f.Close()
+    cores := 0
+    found := false
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        fields := strings.Fields(sc.Text())
+        if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+            continue
+        }
+        if fields[0] != "cpu" {
+            cores++
+            continue
+        }
+        // user nice system idle iowait irq softirq steal [guest guest_nice]
+        // guest time is already part of user/nice, so it is not added again
+        for i, v := range fields[1:] {
+            if i >= 8 {
+                break
+            }
+            n, err := strconv.ParseUint(v, 10, 64)
+            if err != nil {
+                return t, 0, fmt.Errorf("bad cpu field %q", v)
+            }
+            t.total += n
+            switch i {
+            case 3:
+                t.idle = n
+            case 4:
+                t.iowait = n
+            }
+        }
+        found = true
+    }
+    if err := sc.Err(); err != nil {
+        return t, 0, err
+    }
+    if !found {
+        return t, 0, errors.New("no cpu line")
+    }
+    return t, cores, nil
+}
+
+func readMeminfo(path string) (Memory, error) {
+    var m Memory
+    f, err := os.Open(path)
+    if err != nil {
+        return m, err
+    }
+    defer f.Close()
+    kb := map[string]uint64{}
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        // "MemTotal:       16318228 kB"
+        k, v, ok := strings.Cut(sc.Text(), ":")
+        if !ok {
+            continue
+        }
+        fields := strings.Fields(v)
+        if len(fields) == 0 {
+            continue
+        }
+        if n, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+            kb[k] = n
+        }
+    }
+    if err := sc.Err(); err != nil {
+        return m, err
+    }
+    if kb["MemTotal"] == 0 {
+        return m, errors.New("no MemTotal")
+    }
+    avail, ok := kb["MemAvailable"]
+    if !ok { // kernels before 3.14
+        avail = kb["MemFree"] + kb["Buffers"] + kb["Cached"]
+    }
+    m.TotalBytes = kb["MemTotal"] * 1024
+    m.AvailableBytes = min(avail*1024, m.TotalBytes)
+    m.UsedPercent = 100 * float64(m.TotalBytes-m.AvailableBytes) / float64(m.TotalBytes)
+    m.SwapTotalBytes = kb["SwapTotal"] * 1024
+    m.SwapFreeBytes = kb["SwapFree"] * 1024
+    return m, nil
+}
+
+func readLoadavg(path string) (Load, error) {
+    var l Load
+    b, err := os.ReadFile(path)
+    if err != nil {
+        return l, err
+    }
+    // "0.52 0.58 0.59 2/1179 12345"
+    fields := strings.Fields(string(b))
+    if len(fields) < 4 {
+        return l, fmt.Errorf("short loadavg %q", string(b))
+    }
+    if l.Load1, err = strconv.ParseFloat(fields[0], 64); err != nil {
+        return l, err
+    }
+    if l.Load5, err = strconv.ParseFloat(fields[1], 64); err != nil {
+        return l, err
+    }
+    if l.Load15, err = strconv.ParseFloat(fields[2], 64); err != nil {
+        return l, err
+    }
+    if r, t, ok := strings.Cut(fields[3], "/"); ok {
+        l.Running, _ = strconv.Atoi(r)
+        l.Total, _ = strconv.Atoi(t)
+    }
+    return l, nil
+}
+
+func readPressure(path string) (Pressure, error) {
+    var p Pressure
+    f, err := os.Open(path)
+    if err != nil {
+        return p, err
+    }
+    defer f.Close()
+    sc := bufio.NewScanner(f)
+    found := false
+    for sc.Scan() {
+        // "some avg10=0.00 avg60=0.00 avg300=0.00 total=0"
+        fields := strings.Fields(sc.Text())
+        if len(fields) == 0 {
+            continue
+        }
+        var psi PSI
+        for _, kv := range fields[1:] {
+            k, v, _ := strings.Cut(kv, "=")
+            switch k {
+            case "avg10":
+                psi.Avg10, _ = strconv.ParseFloat(v, 64)
+            case "avg60":
+                psi.Avg60, _ = strconv.ParseFloat(v, 64)
+            case "avg300":
+                psi.Avg300, _ = strconv.ParseFloat(v, 64)
+            case "total":
+                psi.Total, _ = strconv.ParseUint(v, 10, 64)
+            }
+        }
+        switch fields[0] {
+        case "some":
+            p.Some, found = psi, true
+        case "full":
+            full := psi
+            p.Full = &full
+        }
+    }
+    if err := sc.Err(); err != nil {
+        return p, err
+    }
+    if !found {
+        return p, errors.New("no some line")
+    }
+    return p, nil
+}
+
+func readNetDev(path string) (Net, error) {
+    var n Net
+    f, err := os.Open(path)
+    if err != nil {
+        return n, err
+    }
+    defer f.Close()
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        // "  eth0: rxbytes rxpackets rxerrs rxdrop fifo frame compressed multicast txbytes txpackets txerrs ..."
+        iface, rest, ok := strings.Cut(sc.Text(), ":")
+        if !ok || strings.TrimSpace(iface) == "lo" {
+            continue
+        }
+        fields := strings.Fields(rest)
+        if len(fields) < 11 {
+            continue
+        }
+        v := make([]uint64, 11)
+        for i := range v {
+            v[i], _ = strconv.ParseUint(fields[i], 10, 64)
+        }
+        n.RxBytes += v[0]
+        n.RxPackets += v[1]
+        n.RxErrors += v[2]
+        n.TxBytes += v[8]
+        n.TxPackets += v[9]
+        n.TxErrors += v[10]
+    }
+    return n, sc.Err()
+}
+
+func readSNMP(path string) (TCP, error) {
+    var t TCP
+    f, err := os.Open(path)
+    if err != nil {
+        return t, err
+    }
+    defer f.Close()
+    // header line "Tcp: RtoAlgorithm ... RetransSegs ..." followed by a values line
+    var header []string
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        fields := strings.Fields(sc.Text())
+        if len(fields) == 0 || fields[0] != "Tcp:" {
+            continue
+        }
+        if header == nil {
+            header = fields
+            continue
+        }
+        for i := 1; i < len(fields) && i < len(header); i++ {
+            n, _ := strconv.ParseUint(fields[i], 10, 64)
+            switch header[i] {
+            case "CurrEstab":
+                t.CurrEstab = n
+            case "InSegs":
+                t.InSegs = n
+            case "OutSegs":
+                t.OutSegs = n
+            case "RetransSegs":
+                t.RetransSegs = n
+            }
+        }
+        return t, nil
+    }
+    if err := sc.Err(); err != nil {
+        return t, err
+    }
+    return t, errors.New("no Tcp lines")
+}
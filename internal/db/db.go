@@ -7,6 +7,7 @@ import (
     "fmt"
     "time"
 
+    "github.com/jackc/pgx/v5"
     "github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -16,11 +17,49 @@ type Device struct {
     Tenant   string            `json:"tenant"`
     Labels   map[string]string `json:"labels"`
     Location string            `json:"location"`
-    Version  string            `json:"version"`
-    Channel  string            `json:"channel"`
+    Version  string            `json:"version"` // desired; set by rollouts
+    Channel  string            `json:"channel"` // desired
     Status   string            `json:"status"`   // aka health
+    ReportedVersion string     `json:"reported_version,omitempty"` // version the agent says it runs
+    ReportedChannel string     `json:"reported_channel,omitempty"` // channel the agent says it follows
+    AgentVersion    string     `json:"agent_version,omitempty"` // desired agent binary; set by agent rollouts
+    ReportedAgentVersion string `json:"reported_agent_version,omitempty"` // agent binary the device runs
+    Probes   json.RawMessage   `json:"probes,omitempty"` // failing agent probes from the last heartbeat
     LastSeen time.Time         `json:"last_seen"`
     CreatedAt time.Time        `json:"created_at"`
+    Cordon   *Cordon           `json:"cordon,omitempty"` // set while rollouts must skip the device
+    Connectivity      string     `json:"connectivity,omitempty"`       // online|stale|offline, see SweepConnectivity
+    ConnectivitySince *time.Time `json:"connectivity_since,omitempty"` // when it last changed
+}
+
+// deviceCols is the column list read by scanDevice.
+const deviceCols = `id, tenant, labels, COALESCE(location, ''), COALESCE(version, ''), COALESCE(channel, ''),
+        COALESCE(status, ''), COALESCE(reported_version, ''), COALESCE(reported_channel, ''),
+        COALESCE(agent_version, ''), COALESCE(reported_agent_version, ''), probes, COALESCE(last_seen, 'epoch'::timestamptz), created_at,
+        cordoned_at, COALESCE(cordoned_by, ''), COALESCE(cordon_reason, ''), COALESCE(drain, false),
+        COALESCE(connectivity, ''), connectivity_since`
+
+func scanDevice(row rowScanner) (Device, error) {
+    var d Device
+    var lb []byte
+    var c Cordon
+    var cordonedAt *time.Time
+    if err := row.Scan(&d.ID, &d.Tenant, &lb, &d.Location, &d.Version, &d.Channel, &d.Status,
+        &d.ReportedVersion, &d.ReportedChannel, &d.AgentVersion, &d.ReportedAgentVersion, &d.Probes, &d.LastSeen, &d.CreatedAt,
+        &cordonedAt, &c.By, &c.Reason, &c.Drain, &d.Connectivity, &d.ConnectivitySince); err != nil {
+        return Device{}, fmt.Errorf("scan: %w", err)
+    }
+    if cordonedAt != nil {
+        c.At = *cordonedAt
+        d.Cordon = &c
+    }
+    if lb != nil {
+        _ = json.Unmarshal(lb, &d.Labels)
+    }
+    if d.LastSeen.Unix() == 0 {
+        d.LastSeen = time.Time{}
+    }
+    return d, nil
 }
 
 type Store struct {
@@ -81,6 +120,18 @@ func (s *Store) Migrate(ctx context.Context) error {
     );
     CREATE INDEX IF NOT EXISTS idx_devices_tenant ON devices(tenant);
     CREATE INDEX IF NOT EXISTS idx_devices_last_seen ON devices(last_seen DESC);
+    ALTER TABLE devices ADD COLUMN IF NOT EXISTS reported_version TEXT;
+    ALTER TABLE devices ADD COLUMN IF NOT EXISTS reported_channel TEXT;
+    ALTER TABLE devices ADD COLUMN IF NOT EXISTS metrics JSONB;
+    ALTER TABLE devices ADD COLUMN IF NOT EXISTS probes JSONB;
+    ALTER TABLE devices ADD COLUMN IF NOT EXISTS agent_version TEXT;
+    ALTER TABLE devices ADD COLUMN IF NOT EXISTS reported_agent_version TEXT;
+    ALTER TABLE devices ADD COLUMN IF NOT EXISTS cordoned_at TIMESTAMPTZ;
+    ALTER TABLE devices ADD COLUMN IF NOT EXISTS cordoned_by TEXT;
+    ALTER TABLE devices ADD COLUMN IF NOT EXISTS cordon_reason TEXT;
+    ALTER TABLE devices ADD COLUMN IF NOT EXISTS drain BOOLEAN;
+    ALTER TABLE devices ADD COLUMN IF NOT EXISTS connectivity TEXT;
+    ALTER TABLE devices ADD COLUMN IF NOT EXISTS connectivity_since TIMESTAMPTZ;
     `
     ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
     defer cancel()
@@ -117,20 +168,102 @@ func (s *Store) UpsertDevice(ctx context.Context, d Device) error {
     return nil
 }
 
-// UpdateHeartbeat updates status and last_seen for a device.
-func (s *Store) UpdateHeartbeat(ctx context.Context, id string, status string, ts time.Time) error {
+// Heartbeat is what a device reports about itself.
+type Heartbeat struct {
+    Status          string
+    CPU, Mem        float64         // usage percent; kept in the heartbeat history only
+    ReportedVersion string          // "" = unchanged
+    ReportedChannel string          // "" = unchanged
+    ReportedAgentVersion string     // "" = unchanged
+    Metrics         json.RawMessage // latest sample (collector schema); nil = unchanged
+    Probes          json.RawMessage // failing probes; replaces the previous list
+    Labels          map[string]*string // label changes from the agent config, merged like DevicePatch; nil = unchanged
+    Location        *string           // agent-configured location; nil = unchanged
+    TS              time.Time
+}
+
+// UpdateHeartbeat updates status, last_seen and (if set) the reported version/channel and metrics for a device.
+// Heartbeats replayed late by an agent that was offline carry their original
+// timestamp: last_seen never moves backwards and an older heartbeat does not
+// overwrite newer state. It reports whether hb was the newest seen.
+func (s *Store) UpdateHeartbeat(ctx context.Context, id string, hb Heartbeat) (bool, error) {
     if s == nil || !s.Enabled {
-        return errors.New("store disabled")
+        return false, errors.New("store disabled")
+    }
+    var metrics, probes, labels []byte
+    remove := []string{}
+    if len(hb.Metrics) > 0 {
+        metrics = hb.Metrics
+    }
+    if len(hb.Probes) > 0 && string(hb.Probes) != "null" && string(hb.Probes) != "[]" {
+        probes = hb.Probes
+    }
+    if hb.Labels != nil {
+        set := map[string]string{}
+        for k, v := range hb.Labels {
+            if v == nil {
+                remove = append(remove, k)
+            } else {
+                set[k] = *v
+            }
+        }
+        labels, _ = json.Marshal(set)
     }
     ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
     defer cancel()
-    _, err := s.pool.Exec(ctx, `
-        UPDATE devices SET status=$1, last_seen=$2 WHERE id=$3;
-    `, status, ts, id)
+    var newest bool
+    err := s.pool.QueryRow(ctx, `
+        WITH cur AS (
+            SELECT id, last_seen IS NULL OR $2 >= last_seen AS newest
+            FROM devices WHERE id = $3 FOR UPDATE
+        )
+        UPDATE devices d SET
+            last_seen=GREATEST(d.last_seen, $2),
+            status=CASE WHEN cur.newest THEN $1 ELSE d.status END,
+            reported_version=CASE WHEN cur.newest THEN COALESCE(NULLIF($4, ''), d.reported_version) ELSE d.reported_version END,
+            reported_channel=CASE WHEN cur.newest THEN COALESCE(NULLIF($5, ''), d.reported_channel) ELSE d.reported_channel END,
+            metrics=CASE WHEN cur.newest THEN COALESCE($6, d.metrics) ELSE d.metrics END,
+            probes=CASE WHEN cur.newest THEN $7 ELSE d.probes END,
+            labels=CASE WHEN cur.newest AND $8::jsonb IS NOT NULL
+                THEN (COALESCE(d.labels, '{}'::jsonb) - $11::text[]) || $8::jsonb ELSE d.labels END,
+            location=CASE WHEN cur.newest THEN COALESCE($9, d.location) ELSE d.location END,
+            reported_agent_version=CASE WHEN cur.newest THEN COALESCE(NULLIF($10, ''), d.reported_agent_version) ELSE d.reported_agent_version END
+        FROM cur WHERE d.id = cur.id
+        RETURNING cur.newest;
+    `, hb.Status, hb.TS, id, hb.ReportedVersion, hb.ReportedChannel, metrics, probes, labels, hb.Location,
+        hb.ReportedAgentVersion, remove).Scan(&newest)
+    if errors.Is(err, pgx.ErrNoRows) {
+        return false, nil
+    }
     if err != nil {
-        return fmt.Errorf("update heartbeat: %w", err)
+        return false, fmt.Errorf("update heartbeat: %w", err)
     }
-    return nil
+    return newest, nil
+}
+
+// GetDevice returns one device by ID.
+func (s *Store) GetDevice(ctx context.Context, id string) (Device, error) {
+    if s == nil || !s.Enabled {
+        return Device{}, errors.New("store disabled")
+    }
+    ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+    defer cancel()
+    return scanDevice(s.pool.QueryRow(ctx, `
+        SELECT `+deviceCols+`
+        FROM devices WHERE id = $1;
+    `, id))
+}
+
+// GetDeviceMetrics returns the latest metrics sample a device sent (nil if none).
+func (s *Store) GetDeviceMetrics(ctx context.Context, id string) (json.RawMessage, error) {
+    if s == nil || !s.Enabled {
+        return nil, errors.New("store disabled")
+    }
+    ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+    defer cancel()
+    var b []byte
+    err := s.pool.QueryRow(ctx, `SELECT metrics FROM devices WHERE id = $1;`, id).Scan(&b)
+    return b, err
 }
 
 // ListDevices returns devices ordered by last_seen desc.
@@ -141,7 +274,7 @@ func (s *Store) ListDevices(ctx context.Context) ([]Device, error) {
     ctx, cancel := context.WithTimeout(ctx, 8*time.Second)
     defer cancel()
     rows, err := s.pool.Query(ctx, `
-        SELECT id, tenant, labels, location, version, channel, status, last_seen, created_at
+        SELECT `+deviceCols+`
         FROM devices ORDER BY last_seen DESC NULLS LAST, id ASC;
     `)
     if err != nil {
@@ -151,13 +284,36 @@ func (s *Store) ListDevices(ctx context.Context) ([]Device, error) {
 
     out := []Device{}
     for rows.Next() {
-        var d Device
-        var lb []byte
-        if err := rows.Scan(&d.ID, &d.Tenant, &lb, &d.Location, &d.Version, &d.Channel, &d.Status, &d.LastSeen, &d.CreatedAt); err != nil {
-            return nil, fmt.Errorf("scan: %w", err)
+        d, err := scanDevice(rows)
+        if err != nil {
+            return nil, err
         }
-        if lb != nil {
-            _ = json.Unmarshal(lb, &d.Labels)
+        out = append(out, d)
+    }
+    return out, rows.Err()
+}
+
+// GetDevicesByIDs returns the given devices (missing IDs are ignored).
+func (s *Store) GetDevicesByIDs(ctx context.Context, ids []string) ([]Device, error) {
+    if s == nil || !s.Enabled {
+        return nil, errors.New("store disabled")
+    }
+    ctx, cancel := context.WithTimeout(ctx, 8*time.Second)
+    defer cancel()
+    rows, err := s.pool.Query(ctx, `
+        SELECT `+deviceCols+`
+        FROM devices WHERE id = ANY($1) ORDER BY id ASC;
+    `, ids)
+    if err != nil {
+        return nil, fmt.Errorf("get devices: %w", err)
+    }
+    defer rows.Close()
+
+    out := []Device{}
+    for rows.Next() {
+        d, err := scanDevice(rows)
+        if err != nil {
+            return nil, err
         }
         out = append(out, d)
     }
@@ -0,0 +1,224 @@
+package db
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// ErrDecommissioned is returned for devices that were decommissioned; their
+// row lives on in devices_archive.
+var ErrDecommissioned = errors.New("device decommissioned")
+
+// NewDeviceToken returns a random device credential. Only its hash is stored.
+func NewDeviceToken() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+// HashDeviceToken is what is stored for a device token.
+func HashDeviceToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// TokenMatches compares a presented token with a stored hash in constant time.
+func TokenMatches(token, hash string) bool {
+    return subtle.ConstantTimeCompare([]byte(HashDeviceToken(token)), []byte(hash)) == 1
+}
+
+// SetDeviceToken stores the hash of the device's credential.
+func (s *Store) SetDeviceToken(ctx context.Context, id, hash string) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `UPDATE devices SET token_hash = NULLIF($2, '') WHERE id = $1`, id, hash)
+    return err
+}
+
+// DeviceTokenHash returns the stored token hash ("" for devices claimed before
+// tokens were issued). Decommissioned devices give ErrDecommissioned, unknown
+// ones pgx.ErrNoRows.
+func (s *Store) DeviceTokenHash(ctx context.Context, id string) (string, error) {
+    if s == nil || !s.Enabled {
+        return "", errors.New("store disabled")
+    }
+    var hash string
+    err := s.pool.QueryRow(ctx, `SELECT COALESCE(token_hash, '') FROM devices WHERE id = $1`, id).Scan(&hash)
+    if errors.Is(err, pgx.ErrNoRows) {
+        if _, aerr := s.GetArchivedDevice(ctx, id); aerr == nil {
+            return "", ErrDecommissioned
+        }
+    }
+    return hash, err
+}
+
+// DevicePatch changes what an operator may change on a device. Nil fields are
+// left alone; a nil label value removes the label.
+type DevicePatch struct {
+    Labels   map[string]*string `json:"labels"`
+    Location *string            `json:"location"`
+    Channel  *string            `json:"channel"` // desired channel
+}
+
+// Validate checks the patch.
+func (p DevicePatch) Validate() error {
+    if p.Labels == nil && p.Location == nil && p.Channel == nil {
+        return errors.New("nothing to change (labels, location, channel)")
+    }
+    for k := range p.Labels {
+        if strings.TrimSpace(k) == "" {
+            return errors.New("empty label key")
+        }
+    }
+    return nil
+}
+
+// Apply applies the patch to a device in memory.
+func (p DevicePatch) Apply(d *Device) {
+    if p.Labels != nil {
+        if d.Labels == nil {
+            d.Labels = map[string]string{}
+        }
+        for k, v := range p.Labels {
+            if v == nil {
+                delete(d.Labels, k)
+            } else {
+                d.Labels[k] = *v
+            }
+        }
+    }
+    if p.Location != nil {
+        d.Location = *p.Location
+    }
+    if p.Channel != nil {
+        d.Channel = *p.Channel
+    }
+}
+
+// UpdateDevice applies the patch and returns the device (pgx.ErrNoRows if missing).
+func (s *Store) UpdateDevice(ctx context.Context, id string, p DevicePatch) (Device, error) {
+    if s == nil || !s.Enabled {
+        return Device{}, errors.New("store disabled")
+    }
+    set := map[string]string{}
+    remove := []string{}
+    for k, v := range p.Labels {
+        if v == nil {
+            remove = append(remove, k)
+        } else {
+            set[k] = *v
+        }
+    }
+    setJSON, _ := json.Marshal(set)
+    ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+    defer cancel()
+    return scanDevice(s.pool.QueryRow(ctx, `
+        UPDATE devices SET
+            labels = (COALESCE(labels, '{}'::jsonb) - $2::text[]) || $3::jsonb,
+            location = COALESCE($4, location),
+            channel = COALESCE($5, channel)
+        WHERE id = $1
+        RETURNING `+deviceCols, id, remove, setJSON, p.Location, p.Channel))
+}
+
+// ArchivedDevice is a decommissioned device: its last row and who removed it.
+type ArchivedDevice struct {
+    Device           Device    `json:"device"`
+    DecommissionedAt time.Time `json:"decommissioned_at"`
+    DecommissionedBy string    `json:"decommissioned_by"`
+    Reason           string    `json:"reason,omitempty"`
+}
+
+// MigrateDeviceArchive adds the device token column and the devices_archive table.
+func (s *Store) MigrateDeviceArchive(ctx context.Context) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+    ALTER TABLE devices ADD COLUMN IF NOT EXISTS token_hash TEXT;
+    CREATE TABLE IF NOT EXISTS devices_archive (
+        id TEXT PRIMARY KEY,
+        tenant TEXT NOT NULL,
+        device JSONB NOT NULL,
+        decommissioned_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        decommissioned_by TEXT NOT NULL,
+        reason TEXT
+    );
+    CREATE INDEX IF NOT EXISTS idx_devices_archive_tenant ON devices_archive(tenant);
+    `)
+    return err
+}
+
+// DecommissionDevice moves the device to devices_archive, which drops its
+// token, and expires executions still waiting for it. Heartbeats, events and
+// rollout history stay. pgx.ErrNoRows if the device is not active.
+func (s *Store) DecommissionDevice(ctx context.Context, id, operator, reason string) (ArchivedDevice, error) {
+    if s == nil || !s.Enabled {
+        return ArchivedDevice{}, errors.New("store disabled")
+    }
+    tx, err := s.pool.Begin(ctx)
+    if err != nil {
+        return ArchivedDevice{}, err
+    }
+    defer tx.Rollback(ctx)
+
+    d, err := scanDevice(tx.QueryRow(ctx, `DELETE FROM devices WHERE id = $1 RETURNING `+deviceCols, id))
+    if err != nil {
+        return ArchivedDevice{}, err
+    }
+    a := ArchivedDevice{Device: d, DecommissionedAt: time.Now().UTC(), DecommissionedBy: operator, Reason: reason}
+    snap, _ := json.Marshal(d)
+    if _, err := tx.Exec(ctx, `
+        INSERT INTO devices_archive (id, tenant, device, decommissioned_at, decommissioned_by, reason)
+        VALUES ($1,$2,$3,$4,$5,NULLIF($6,''))`,
+        d.ID, d.Tenant, snap, a.DecommissionedAt, operator, reason); err != nil {
+        return ArchivedDevice{}, fmt.Errorf("archive device: %w", err)
+    }
+    if _, err := tx.Exec(ctx, `
+        UPDATE device_execs SET state = $2, error = 'device decommissioned', finished_at = now()
+        WHERE device_id = $1 AND state = $3`, id, ExecExpired, ExecPending); err != nil {
+        return ArchivedDevice{}, err
+    }
+    detail := "by " + operator
+    if reason != "" {
+        detail += ": " + reason
+    }
+    if _, err := tx.Exec(ctx, `
+        INSERT INTO device_events (device_id, ts, type, detail) VALUES ($1, $2, 'decommissioned', $3)`,
+        id, a.DecommissionedAt, detail); err != nil {
+        return ArchivedDevice{}, err
+    }
+    return a, tx.Commit(ctx)
+}
+
+// GetArchivedDevice returns a decommissioned device (pgx.ErrNoRows if none).
+func (s *Store) GetArchivedDevice(ctx context.Context, id string) (ArchivedDevice, error) {
+    if s == nil || !s.Enabled {
+        return ArchivedDevice{}, errors.New("store disabled")
+    }
+    var a ArchivedDevice
+    var snap []byte
+    err := s.pool.QueryRow(ctx, `
+        SELECT device, decommissioned_at, decommissioned_by, COALESCE(reason, '')
+        FROM devices_archive WHERE id = $1`, id).Scan(&snap, &a.DecommissionedAt, &a.DecommissionedBy, &a.Reason)
+    if err != nil {
+        return a, err
+    }
+    if err := json.Unmarshal(snap, &a.Device); err != nil {
+        return a, fmt.Errorf("archived device %s: %w", id, err)
+    }
+    return a, nil
+}
@@ -3,8 +3,19 @@ package db
 import (
     "context"
     "errors"
+    "strings"
 )
 
+// AgentArtifactPrefix marks a rollout artifact as the agent binary itself,
+// e.g. "xdp47-agent:1.4.0". Such rollouts change the device's agent_version
+// instead of version/channel; the agent updates itself to it.
+const AgentArtifactPrefix = "xdp47-agent:"
+
+// AgentArtifact returns the agent version of an agent artifact.
+func AgentArtifact(artifact string) (string, bool) {
+    return strings.CutPrefix(artifact, AgentArtifactPrefix)
+}
+
 // ApplyVersionChannel sets version and channel for a device.
 func (s *Store) ApplyVersionChannel(ctx context.Context, deviceID, version, channel string) error {
     if s == nil || !s.Enabled {
@@ -16,4 +27,47 @@ func (s *Store) ApplyVersionChannel(ctx context.Context, deviceID, version, chan
         WHERE id = $3;
     `, version, channel, deviceID)
     return err
-}
\ No newline at end of file
+}
+
+// ApplyAgentVersion sets the agent binary version a device should run.
+func (s *Store) ApplyAgentVersion(ctx context.Context, deviceID, version string) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+        UPDATE devices
+        SET agent_version = NULLIF($1, '')
+        WHERE id = $2;
+    `, version, deviceID)
+    return err
+}
+
+// DesiredState is what the control plane wants a device to run, next to what
+// the device last reported. Version/Channel are changed by rollouts; the agent
+// reconciles to them and reports back in its heartbeat.
+type DesiredState struct {
+    DeviceID        string `json:"device_id"`
+    Version         string `json:"version"`
+    Channel         string `json:"channel"`
+    ReportedVersion string `json:"reported_version"`
+    ReportedChannel string `json:"reported_channel"`
+    AgentVersion         string `json:"agent_version,omitempty"`
+    ReportedAgentVersion string `json:"reported_agent_version,omitempty"`
+    InSync          bool   `json:"in_sync"`
+}
+
+// Desired returns the device's desired vs reported state.
+func (d Device) Desired() DesiredState {
+    return DesiredState{
+        DeviceID:        d.ID,
+        Version:         d.Version,
+        Channel:         d.Channel,
+        ReportedVersion: d.ReportedVersion,
+        ReportedChannel: d.ReportedChannel,
+        AgentVersion:         d.AgentVersion,
+        ReportedAgentVersion: d.ReportedAgentVersion,
+        InSync: (d.Version == "" || d.Version == d.ReportedVersion) &&
+            (d.Channel == "" || d.Channel == d.ReportedChannel) &&
+            (d.AgentVersion == "" || d.AgentVersion == d.ReportedAgentVersion),
+    }
+}
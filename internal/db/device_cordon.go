@@ -0,0 +1,89 @@
+package db
+
+import (
+    "context"
+    "errors"
+    "time"
+)
+
+// Cordon marks a device that rollouts must leave alone. A drain is a cordon
+// that also waits for the device's in-flight operations to finish.
+type Cordon struct {
+    At     time.Time `json:"at"`
+    By     string    `json:"by"`
+    Reason string    `json:"reason,omitempty"`
+    Drain  bool      `json:"drain,omitempty"`
+}
+
+// InFlight is what is still running on a device: executions handed to it or
+// waiting for it, and updates it has been given but not yet reported.
+type InFlight struct {
+    Execs   []string `json:"execs,omitempty"`   // pending or running execution ids
+    Updates []string `json:"updates,omitempty"` // e.g. "version 1.2.0 → 1.3.0"
+}
+
+// Idle reports whether nothing is in flight.
+func (f InFlight) Idle() bool { return len(f.Execs) == 0 && len(f.Updates) == 0 }
+
+// PendingUpdates lists the desired versions/channel the device has not
+// reported yet. Agents that do not report a field are not waited for.
+func (d Device) PendingUpdates() []string {
+    var out []string
+    pending := func(what, desired, reported string) {
+        if desired != "" && reported != "" && desired != reported {
+            out = append(out, what+" "+reported+" → "+desired)
+        }
+    }
+    pending("version", d.Version, d.ReportedVersion)
+    pending("channel", d.Channel, d.ReportedChannel)
+    pending("agent", d.AgentVersion, d.ReportedAgentVersion)
+    return out
+}
+
+// SetCordon cordons the device (c != nil) or uncordons it (c == nil) and
+// returns it; pgx.ErrNoRows if it does not exist.
+func (s *Store) SetCordon(ctx context.Context, id string, c *Cordon) (Device, error) {
+    if s == nil || !s.Enabled {
+        return Device{}, errors.New("store disabled")
+    }
+    var at *time.Time
+    var drain *bool
+    var by, reason string
+    if c != nil {
+        at, by, reason, drain = &c.At, c.By, c.Reason, &c.Drain
+    }
+    ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+    defer cancel()
+    return scanDevice(s.pool.QueryRow(ctx, `
+        UPDATE devices SET cordoned_at = $2, cordoned_by = NULLIF($3, ''), cordon_reason = NULLIF($4, ''),
+            drain = $5
+        WHERE id = $1
+        RETURNING `+deviceCols, id, at, by, reason, drain))
+}
+
+// DeviceInFlight returns what is still in flight on d.
+func (s *Store) DeviceInFlight(ctx context.Context, d Device) (InFlight, error) {
+    if s == nil || !s.Enabled {
+        return InFlight{}, errors.New("store disabled")
+    }
+    f := InFlight{Updates: d.PendingUpdates()}
+    // executions nobody will finish any more do not hold a drain up
+    if err := s.expireExecs(ctx); err != nil {
+        return f, err
+    }
+    rows, err := s.pool.Query(ctx, `
+        SELECT id FROM device_execs WHERE device_id = $1 AND state IN ($2, $3)
+        ORDER BY created_at`, d.ID, ExecPending, ExecRunning)
+    if err != nil {
+        return f, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil {
+            return f, err
+        }
+        f.Execs = append(f.Execs, id)
+    }
+    return f, rows.Err()
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+)
+
+// DeviceEvent is something that happened on or to a device, e.g. an agent
+// applying a version. TS is when it happened (agents may report late).
+type DeviceEvent struct {
+    ID        int64     `json:"id"`
+    DeviceID  string    `json:"device_id"`
+    TS        time.Time `json:"ts"`
+    Type      string    `json:"type"`
+    Detail    string    `json:"detail,omitempty"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// MigrateDeviceEvents ensures the device_events table exists.
+func (s *Store) MigrateDeviceEvents(ctx context.Context) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+    CREATE TABLE IF NOT EXISTS device_events (
+        id BIGSERIAL PRIMARY KEY,
+        device_id TEXT NOT NULL,
+        ts TIMESTAMPTZ NOT NULL,
+        type TEXT NOT NULL,
+        detail TEXT,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    );
+    CREATE INDEX IF NOT EXISTS idx_device_events_device_ts ON device_events(device_id, ts DESC);
+    `)
+    return err
+}
+
+// InsertDeviceEvents stores events for one device.
+func (s *Store) InsertDeviceEvents(ctx context.Context, deviceID string, events []DeviceEvent) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    if len(events) == 0 {
+        return nil
+    }
+    ts := make([]time.Time, len(events))
+    types := make([]string, len(events))
+    details := make([]string, len(events))
+    for i, e := range events {
+        ts[i], types[i], details[i] = e.TS, e.Type, e.Detail
+    }
+    _, err := s.pool.Exec(ctx, `
+        INSERT INTO device_events (device_id, ts, type, detail)
+        SELECT $1, t.ts, t.type, NULLIF(t.detail, '')
+        FROM unnest($2::timestamptz[], $3::text[], $4::text[]) AS t(ts, type, detail);
+    `, deviceID, ts, types, details)
+    if err != nil {
+        return fmt.Errorf("insert device events: %w", err)
+    }
+    return nil
+}
+
+// ListDeviceEvents returns a device's newest events first.
+func (s *Store) ListDeviceEvents(ctx context.Context, deviceID string, limit int) ([]DeviceEvent, error) {
+    if s == nil || !s.Enabled {
+        return nil, errors.New("store disabled")
+    }
+    if limit <= 0 {
+        limit = 100
+    }
+    rows, err := s.pool.Query(ctx, `
+        SELECT id, device_id, ts, type, COALESCE(detail, ''), created_at
+        FROM device_events WHERE device_id = $1
+        ORDER BY ts DESC, id DESC LIMIT $2;
+    `, deviceID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    out := []DeviceEvent{}
+    for rows.Next() {
+        var e DeviceEvent
+        if err := rows.Scan(&e.ID, &e.DeviceID, &e.TS, &e.Type, &e.Detail, &e.CreatedAt); err != nil {
+            return nil, err
+        }
+        out = append(out, e)
+    }
+    return out, rows.Err()
+}
+
@@ -0,0 +1,106 @@
+package db
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "time"
+)
+
+// heartbeatHistory is how many heartbeats are kept per device.
+const heartbeatHistory = 200
+
+// HeartbeatRecord is one heartbeat as it arrived, for the device detail view.
+type HeartbeatRecord struct {
+    TS                   time.Time       `json:"ts"`
+    Status               string          `json:"status"`
+    CPU                  float64         `json:"cpu"`
+    Mem                  float64         `json:"mem"`
+    ReportedVersion      string          `json:"reported_version,omitempty"`
+    ReportedChannel      string          `json:"reported_channel,omitempty"`
+    ReportedAgentVersion string          `json:"reported_agent_version,omitempty"`
+    Probes               json.RawMessage `json:"probes,omitempty"`
+    Stale                bool            `json:"stale,omitempty"` // replayed, older than the newest
+    ReceivedAt           time.Time       `json:"received_at"`
+}
+
+// MigrateHeartbeats ensures the device_heartbeats table exists.
+func (s *Store) MigrateHeartbeats(ctx context.Context) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+    CREATE TABLE IF NOT EXISTS device_heartbeats (
+        id BIGSERIAL PRIMARY KEY,
+        device_id TEXT NOT NULL,
+        ts TIMESTAMPTZ NOT NULL,
+        status TEXT,
+        cpu DOUBLE PRECISION,
+        mem DOUBLE PRECISION,
+        reported_version TEXT,
+        reported_channel TEXT,
+        reported_agent_version TEXT,
+        probes JSONB,
+        stale BOOLEAN NOT NULL DEFAULT false,
+        received_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    );
+    CREATE INDEX IF NOT EXISTS idx_device_heartbeats_device_ts ON device_heartbeats(device_id, ts DESC);
+    `)
+    return err
+}
+
+// RecordHeartbeat appends hb to the device's history and drops what is
+// beyond the newest heartbeatHistory.
+func (s *Store) RecordHeartbeat(ctx context.Context, id string, hb Heartbeat, stale bool) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    var probes []byte
+    if len(hb.Probes) > 0 && string(hb.Probes) != "null" {
+        probes = hb.Probes
+    }
+    ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+    defer cancel()
+    if _, err := s.pool.Exec(ctx, `
+        INSERT INTO device_heartbeats (device_id, ts, status, cpu, mem, reported_version, reported_channel,
+            reported_agent_version, probes, stale)
+        VALUES ($1,$2,$3,$4,$5,NULLIF($6,''),NULLIF($7,''),NULLIF($8,''),$9,$10)`,
+        id, hb.TS, hb.Status, hb.CPU, hb.Mem, hb.ReportedVersion, hb.ReportedChannel,
+        hb.ReportedAgentVersion, probes, stale); err != nil {
+        return err
+    }
+    _, err := s.pool.Exec(ctx, `
+        DELETE FROM device_heartbeats WHERE device_id = $1 AND id < (
+            SELECT id FROM device_heartbeats WHERE device_id = $1
+            ORDER BY id DESC OFFSET $2 LIMIT 1)`, id, heartbeatHistory-1)
+    return err
+}
+
+// ListHeartbeats returns the device's recent heartbeats, newest first.
+func (s *Store) ListHeartbeats(ctx context.Context, id string, limit int) ([]HeartbeatRecord, error) {
+    if s == nil || !s.Enabled {
+        return nil, errors.New("store disabled")
+    }
+    if limit <= 0 || limit > heartbeatHistory {
+        limit = 20
+    }
+    rows, err := s.pool.Query(ctx, `
+        SELECT ts, COALESCE(status, ''), COALESCE(cpu, 0), COALESCE(mem, 0), COALESCE(reported_version, ''),
+               COALESCE(reported_channel, ''), COALESCE(reported_agent_version, ''), probes, stale, received_at
+        FROM device_heartbeats WHERE device_id = $1
+        ORDER BY ts DESC, id DESC LIMIT $2`, id, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    out := []HeartbeatRecord{}
+    for rows.Next() {
+        var h HeartbeatRecord
+        if err := rows.Scan(&h.TS, &h.Status, &h.CPU, &h.Mem, &h.ReportedVersion, &h.ReportedChannel,
+            &h.ReportedAgentVersion, &h.Probes, &h.Stale, &h.ReceivedAt); err != nil {
+            return nil, err
+        }
+        out = append(out, h)
+    }
+    return out, rows.Err()
+}
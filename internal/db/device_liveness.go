@@ -0,0 +1,87 @@
+package db
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+)
+
+// Connectivity states, derived from last_seen by the liveness sweeper. They
+// are kept apart from the health (status) the agent reports.
+const (
+    ConnOnline  = "online"  // heartbeat within the stale threshold
+    ConnStale   = "stale"   // late, but not yet offline
+    ConnOffline = "offline" // no heartbeat within the offline threshold, or never seen
+)
+
+// Connectivity classifies a device's last heartbeat against the thresholds.
+func Connectivity(lastSeen, now time.Time, stale, offline time.Duration) string {
+    switch {
+    case lastSeen.IsZero() || now.Sub(lastSeen) > offline:
+        return ConnOffline
+    case now.Sub(lastSeen) > stale:
+        return ConnStale
+    }
+    return ConnOnline
+}
+
+// ConnectivityChange is one transition made by SweepConnectivity.
+type ConnectivityChange struct {
+    DeviceID string
+    From     string // "" when the device had no state yet
+    To       string
+    LastSeen time.Time
+}
+
+// connectivityExpr is Connectivity in SQL ($1 now, $2 stale and $3 offline
+// seconds). It reads d.last_seen so a heartbeat racing the sweep is seen.
+const connectivityExpr = `CASE
+        WHEN d.last_seen IS NULL OR d.last_seen <= 'epoch'::timestamptz
+          OR d.last_seen < $1::timestamptz - make_interval(secs => $3) THEN 'offline'
+        WHEN d.last_seen < $1::timestamptz - make_interval(secs => $2) THEN 'stale'
+        ELSE 'online' END`
+
+// SweepConnectivity reclassifies devices (all of them, or only id) and stores
+// the changed states together with a connectivity_<state> device event each.
+func (s *Store) SweepConnectivity(ctx context.Context, now time.Time, stale, offline time.Duration, id string) ([]ConnectivityChange, error) {
+    if s == nil || !s.Enabled {
+        return nil, errors.New("store disabled")
+    }
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+    rows, err := s.pool.Query(ctx, `
+        WITH prev AS (
+            SELECT id, COALESCE(connectivity, '') AS conn FROM devices WHERE ($4::text = '' OR id = $4)
+        ), changed AS (
+            UPDATE devices d SET connectivity = `+connectivityExpr+`, connectivity_since = $1
+            FROM prev p
+            WHERE d.id = p.id AND d.connectivity IS DISTINCT FROM `+connectivityExpr+`
+            RETURNING d.id, p.conn AS from_conn, d.connectivity AS to_conn, d.last_seen
+        ), ev AS (
+            INSERT INTO device_events (device_id, ts, type, detail)
+            SELECT id, $1, 'connectivity_' || to_conn,
+                COALESCE(NULLIF(from_conn, ''), 'unknown') || ' → ' || to_conn ||
+                COALESCE(', last seen ' || to_char(last_seen AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'), ', never seen')
+            FROM changed
+        )
+        SELECT id, from_conn, to_conn, last_seen FROM changed`,
+        now, stale.Seconds(), offline.Seconds(), id)
+    if err != nil {
+        return nil, fmt.Errorf("sweep connectivity: %w", err)
+    }
+    defer rows.Close()
+    var out []ConnectivityChange
+    for rows.Next() {
+        var c ConnectivityChange
+        var seen *time.Time
+        if err := rows.Scan(&c.DeviceID, &c.From, &c.To, &seen); err != nil {
+            return nil, err
+        }
+        if seen != nil {
+            c.LastSeen = *seen
+        }
+        out = append(out, c)
+    }
+    return out, rows.Err()
+}
@@ -0,0 +1,365 @@
+package db
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash/fnv"
+    "slices"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/example/xdp47/internal/selector"
+)
+
+// Device list limits.
+const (
+    DeviceListDefaultLimit = 100
+    DeviceListMaxLimit     = 1000
+)
+
+// DeviceQuery filters, sorts and pages the device list. Empty fields match
+// everything.
+type DeviceQuery struct {
+    Tenant         string
+    Selector       selector.Selector
+    Health         []string          // any of ok|warn|crit|unknown
+    Connectivity   []string          // any of online|stale|offline
+    Version        string            // reported (running) version
+    DesiredVersion string
+    Channel        string // desired channel
+    Location       string
+    Cordoned       *bool         // only cordoned (true) or schedulable (false) devices
+    StaleFor       time.Duration // only devices without a heartbeat for longer than this
+    Sort           string        // sort key, "-" prefix for descending; default "-last_seen"
+    Limit          int           // default DeviceListDefaultLimit
+    Cursor         string        // from the previous page
+}
+
+// deviceSortKeys maps sort keys to the SQL expression ordered by. Every one is
+// backed by an index (see MigrateDeviceQuery); id breaks ties.
+var deviceSortKeys = map[string]string{
+    "last_seen":  `COALESCE(last_seen, 'epoch'::timestamptz)`,
+    "created_at": `COALESCE(created_at, 'epoch'::timestamptz)`,
+    "id":         `id`,
+    "tenant":     `tenant`,
+    "health":     `COALESCE(status, '')`,
+    "version":    `COALESCE(reported_version, '')`,
+    "location":   `COALESCE(location, '')`,
+    "channel":    `COALESCE(channel, '')`,
+}
+
+// sortTimeLayout is fixed-width so formatted times compare as strings.
+const sortTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// Validate checks the query and fills defaults.
+func (q *DeviceQuery) Validate() error {
+    if q.Sort == "" {
+        q.Sort = "-last_seen"
+    }
+    if _, ok := deviceSortKeys[strings.TrimPrefix(q.Sort, "-")]; !ok {
+        keys := make([]string, 0, len(deviceSortKeys))
+        for k := range deviceSortKeys {
+            keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        return fmt.Errorf("sort must be one of %s (prefix - for descending)", strings.Join(keys, ", "))
+    }
+    for _, h := range q.Health {
+        switch h {
+        case "ok", "warn", "crit", "unknown":
+        default:
+            return fmt.Errorf("health must be ok|warn|crit|unknown, got %q", h)
+        }
+    }
+    for _, c := range q.Connectivity {
+        switch c {
+        case ConnOnline, ConnStale, ConnOffline:
+        default:
+            return fmt.Errorf("connectivity must be online|stale|offline, got %q", c)
+        }
+    }
+    if q.StaleFor < 0 {
+        return errors.New("stale must be a positive duration")
+    }
+    if q.Limit == 0 {
+        q.Limit = DeviceListDefaultLimit
+    }
+    if q.Limit < 1 || q.Limit > DeviceListMaxLimit {
+        return fmt.Errorf("limit must be 1..%d", DeviceListMaxLimit)
+    }
+    if q.Cursor != "" {
+        if _, err := q.decodeCursor(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// deviceCursor is the position after the last device of a page.
+type deviceCursor struct {
+    Sort   string `json:"s"`
+    Filter string `json:"f"` // filter hash; a cursor is only valid for the same filters
+    Value  string `json:"v"`
+    ID     string `json:"id"`
+}
+
+// filterHash identifies the filters (not the sort or page) of the query.
+func (q DeviceQuery) filterHash() string {
+    h := fnv.New64a()
+    health := slices.Clone(q.Health)
+    sort.Strings(health)
+    conn := slices.Clone(q.Connectivity)
+    sort.Strings(conn)
+    cordoned := ""
+    if q.Cordoned != nil {
+        cordoned = strconv.FormatBool(*q.Cordoned)
+    }
+    fmt.Fprintf(h, "%s\x00%s\x00%v\x00%v\x00%s\x00%s\x00%s\x00%s\x00%s\x00%d",
+        q.Tenant, q.Selector.String(), health, conn, q.Version, q.DesiredVersion, q.Channel, q.Location, cordoned, q.StaleFor)
+    return strconv.FormatUint(h.Sum64(), 36)
+}
+
+func (q DeviceQuery) encodeCursor(d Device) string {
+    c := deviceCursor{Sort: q.Sort, Filter: q.filterHash(), Value: sortValue(d, strings.TrimPrefix(q.Sort, "-")), ID: d.ID}
+    b, _ := json.Marshal(c)
+    return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (q DeviceQuery) decodeCursor() (deviceCursor, error) {
+    var c deviceCursor
+    b, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+    if err != nil || json.Unmarshal(b, &c) != nil {
+        return c, errors.New("bad cursor")
+    }
+    if c.Sort != q.Sort || c.Filter != q.filterHash() {
+        return c, errors.New("cursor is for a different sort or filter; start again without it")
+    }
+    return c, nil
+}
+
+// sortValue is d's value for a sort key, as compared by Page and stored in cursors.
+func sortValue(d Device, key string) string {
+    switch key {
+    case "last_seen":
+        return sortTime(d.LastSeen)
+    case "created_at":
+        return sortTime(d.CreatedAt)
+    case "tenant":
+        return d.Tenant
+    case "health":
+        return d.Status
+    case "version":
+        return d.ReportedVersion
+    case "location":
+        return d.Location
+    case "channel":
+        return d.Channel
+    }
+    return d.ID
+}
+
+// sortTime formats t for sorting; never-seen devices sort at the epoch, as
+// the COALESCE in the SQL sort expression does.
+func sortTime(t time.Time) string {
+    if t.IsZero() {
+        t = time.Unix(0, 0)
+    }
+    return t.UTC().Format(sortTimeLayout)
+}
+
+// Match reports whether d passes the query's filters.
+func (q DeviceQuery) Match(d Device, now time.Time) bool {
+    if q.Tenant != "" && d.Tenant != q.Tenant {
+        return false
+    }
+    if !q.Selector.Matches(d.Labels) {
+        return false
+    }
+    if len(q.Health) > 0 && !slices.Contains(q.Health, d.Status) {
+        return false
+    }
+    if len(q.Connectivity) > 0 && !slices.Contains(q.Connectivity, d.Connectivity) {
+        return false
+    }
+    if q.Version != "" && d.ReportedVersion != q.Version {
+        return false
+    }
+    if q.DesiredVersion != "" && d.Version != q.DesiredVersion {
+        return false
+    }
+    if q.Channel != "" && d.Channel != q.Channel {
+        return false
+    }
+    if q.Location != "" && d.Location != q.Location {
+        return false
+    }
+    if q.Cordoned != nil && (d.Cordon != nil) != *q.Cordoned {
+        return false
+    }
+    if q.StaleFor > 0 && !d.LastSeen.Before(now.Add(-q.StaleFor)) {
+        return false
+    }
+    return true
+}
+
+// Page filters, sorts and pages devices in memory, the same way QueryDevices
+// does in Postgres. It returns the page and the cursor of the next one ("" on
+// the last page). q must be validated.
+func (q DeviceQuery) Page(devs []Device, now time.Time) ([]Device, string) {
+    key, desc := strings.TrimPrefix(q.Sort, "-"), strings.HasPrefix(q.Sort, "-")
+    less := func(a, b Device) bool {
+        va, vb := sortValue(a, key), sortValue(b, key)
+        if va != vb {
+            return va < vb != desc
+        }
+        return a.ID < b.ID != desc
+    }
+    var out []Device
+    for _, d := range devs {
+        if q.Match(d, now) {
+            out = append(out, d)
+        }
+    }
+    sort.Slice(out, func(i, j int) bool { return less(out[i], out[j]) })
+    if q.Cursor != "" {
+        c, _ := q.decodeCursor()
+        i := sort.Search(len(out), func(i int) bool {
+            v := sortValue(out[i], key)
+            if v != c.Value {
+                return v > c.Value != desc
+            }
+            return out[i].ID > c.ID != desc
+        })
+        out = out[i:]
+    }
+    if len(out) > q.Limit {
+        return out[:q.Limit], q.encodeCursor(out[q.Limit-1])
+    }
+    return out, ""
+}
+
+// MigrateDeviceQuery adds the indexes behind QueryDevices' filters and sort keys.
+func (s *Store) MigrateDeviceQuery(ctx context.Context) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+    CREATE INDEX IF NOT EXISTS idx_devices_labels ON devices USING GIN (labels jsonb_path_ops);
+    CREATE INDEX IF NOT EXISTS idx_devices_seen_id ON devices ((COALESCE(last_seen, 'epoch'::timestamptz)), id);
+    CREATE INDEX IF NOT EXISTS idx_devices_tenant_seen_id ON devices (tenant, (COALESCE(last_seen, 'epoch'::timestamptz)), id);
+    CREATE INDEX IF NOT EXISTS idx_devices_tenant_created_id ON devices (tenant, (COALESCE(created_at, 'epoch'::timestamptz)), id);
+    CREATE INDEX IF NOT EXISTS idx_devices_tenant_id ON devices (tenant, id);
+    CREATE INDEX IF NOT EXISTS idx_devices_tenant_status_id ON devices (tenant, (COALESCE(status, '')), id);
+    CREATE INDEX IF NOT EXISTS idx_devices_tenant_version_id ON devices (tenant, (COALESCE(reported_version, '')), id);
+    CREATE INDEX IF NOT EXISTS idx_devices_tenant_location_id ON devices (tenant, (COALESCE(location, '')), id);
+    CREATE INDEX IF NOT EXISTS idx_devices_tenant_channel_id ON devices (tenant, (COALESCE(channel, '')), id);
+    CREATE INDEX IF NOT EXISTS idx_devices_tenant_connectivity_id ON devices (tenant, (COALESCE(connectivity, '')), id);
+    `)
+    return err
+}
+
+// QueryDevices returns one page of devices and the cursor of the next page
+// ("" on the last one). q must be validated. Paging is keyset-based on the
+// sort expression and id, so deep pages cost the same as the first.
+func (s *Store) QueryDevices(ctx context.Context, q DeviceQuery) ([]Device, string, error) {
+    if s == nil || !s.Enabled {
+        return nil, "", errors.New("store disabled")
+    }
+    key, desc := strings.TrimPrefix(q.Sort, "-"), strings.HasPrefix(q.Sort, "-")
+    expr := deviceSortKeys[key]
+
+    var where []string
+    var args []any
+    arg := func(v any) string {
+        args = append(args, v)
+        return "$" + strconv.Itoa(len(args))
+    }
+    if q.Tenant != "" {
+        where = append(where, "tenant = "+arg(q.Tenant))
+    }
+    if !q.Selector.Empty() {
+        where = append(where, q.Selector.SQL("labels", arg))
+    }
+    if len(q.Health) > 0 {
+        where = append(where, "COALESCE(status, '') = ANY("+arg(q.Health)+"::text[])")
+    }
+    if len(q.Connectivity) > 0 {
+        where = append(where, "COALESCE(connectivity, '') = ANY("+arg(q.Connectivity)+"::text[])")
+    }
+    if q.Version != "" {
+        where = append(where, "reported_version = "+arg(q.Version))
+    }
+    if q.DesiredVersion != "" {
+        where = append(where, "version = "+arg(q.DesiredVersion))
+    }
+    if q.Channel != "" {
+        where = append(where, "channel = "+arg(q.Channel))
+    }
+    if q.Location != "" {
+        where = append(where, "location = "+arg(q.Location))
+    }
+    if q.Cordoned != nil {
+        where = append(where, "(cordoned_at IS NOT NULL) = "+arg(*q.Cordoned))
+    }
+    if q.StaleFor > 0 {
+        where = append(where, "COALESCE(last_seen, 'epoch'::timestamptz) < now() - make_interval(secs => "+arg(q.StaleFor.Seconds())+")")
+    }
+    if q.Cursor != "" {
+        c, err := q.decodeCursor()
+        if err != nil {
+            return nil, "", err
+        }
+        var v any = c.Value
+        if key == "last_seen" || key == "created_at" {
+            t, err := time.Parse(sortTimeLayout, c.Value)
+            if err != nil {
+                return nil, "", errors.New("bad cursor")
+            }
+            v = t
+        }
+        op := ">"
+        if desc {
+            op = "<"
+        }
+        where = append(where, "("+expr+", id) "+op+" ("+arg(v)+", "+arg(c.ID)+")")
+    }
+
+    dir := "ASC"
+    if desc {
+        dir = "DESC"
+    }
+    sql := `SELECT ` + deviceCols + ` FROM devices`
+    if len(where) > 0 {
+        sql += "\nWHERE " + strings.Join(where, "\n  AND ")
+    }
+    // one extra row tells whether there is a next page
+    sql += "\nORDER BY " + expr + " " + dir + ", id " + dir + "\nLIMIT " + arg(q.Limit+1)
+
+    ctx, cancel := context.WithTimeout(ctx, 8*time.Second)
+    defer cancel()
+    rows, err := s.pool.Query(ctx, sql, args...)
+    if err != nil {
+        return nil, "", fmt.Errorf("query devices: %w", err)
+    }
+    defer rows.Close()
+    out := []Device{}
+    for rows.Next() {
+        d, err := scanDevice(rows)
+        if err != nil {
+            return nil, "", err
+        }
+        out = append(out, d)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, "", err
+    }
+    if len(out) > q.Limit {
+        return out[:q.Limit], q.encodeCursor(out[q.Limit-1]), nil
+    }
+    return out, "", nil
+}
@@ -0,0 +1,529 @@
+package db
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// ExecTemplate is a command a tenant's operators may run on its devices.
+// Remote exec only ever runs rendered templates, never free-form commands.
+type ExecTemplate struct {
+    Tenant         string            `json:"tenant"`
+    Name           string            `json:"name"`
+    Command        string            `json:"command"`          // sh command with {param} placeholders as bare words
+    Params         map[string]string `json:"params,omitempty"` // param -> regexp its values must match ("" = ExecParamPattern)
+    TimeoutSeconds int               `json:"timeout_seconds"`
+    MaxOutputBytes int               `json:"max_output_bytes"` // per stream
+    UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+// Limits for templates; zero values get the defaults.
+const (
+    ExecDefaultTimeout = 30
+    ExecMaxTimeout     = 600
+    ExecDefaultOutput  = 64 << 10
+    ExecMaxOutput      = 1 << 20
+)
+
+// ExecParamPattern is what parameter values must match unless the template
+// says otherwise: no spaces, quotes or shell metacharacters.
+const ExecParamPattern = `^[A-Za-z0-9._:@/=+-]{1,128}$`
+
+var (
+    execNameRe        = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+    execPlaceholderRe = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// Validate checks the template and fills in default limits.
+func (t *ExecTemplate) Validate() error {
+    if t.Tenant == "" {
+        return errors.New("tenant required")
+    }
+    if !execNameRe.MatchString(t.Name) {
+        return fmt.Errorf("bad template name %q (want [a-z0-9._-], max 64)", t.Name)
+    }
+    if strings.TrimSpace(t.Command) == "" {
+        return errors.New("command required")
+    }
+    for _, m := range execPlaceholderRe.FindAllStringSubmatch(t.Command, -1) {
+        if _, ok := t.Params[m[1]]; !ok {
+            return fmt.Errorf("placeholder {%s} is not a declared param", m[1])
+        }
+    }
+    if err := t.barePlaceholders(); err != nil {
+        return err
+    }
+    for name, pat := range t.Params {
+        if pat == "" {
+            continue
+        }
+        if _, err := regexp.Compile(pat); err != nil {
+            return fmt.Errorf("param %s: %w", name, err)
+        }
+    }
+    if t.TimeoutSeconds == 0 {
+        t.TimeoutSeconds = ExecDefaultTimeout
+    }
+    if t.TimeoutSeconds < 1 || t.TimeoutSeconds > ExecMaxTimeout {
+        return fmt.Errorf("timeout_seconds must be 1..%d", ExecMaxTimeout)
+    }
+    if t.MaxOutputBytes == 0 {
+        t.MaxOutputBytes = ExecDefaultOutput
+    }
+    if t.MaxOutputBytes < 1 || t.MaxOutputBytes > ExecMaxOutput {
+        return fmt.Errorf("max_output_bytes must be 1..%d", ExecMaxOutput)
+    }
+    return nil
+}
+
+// barePlaceholders checks that no placeholder is quoted or escaped in the
+// command. Render quotes the value itself: inside '...' that quoting would end
+// the string instead, and inside "..." the quotes would be kept literally.
+func (t ExecTemplate) barePlaceholders() error {
+    quoted, err := shellQuoted(t.Command)
+    if err != nil {
+        return err
+    }
+    for _, m := range execPlaceholderRe.FindAllStringSubmatchIndex(t.Command, -1) {
+        if quoted[m[0]] {
+            return fmt.Errorf("placeholder %s is inside quotes; use it as a bare word (its value is quoted for you)", t.Command[m[0]:m[1]])
+        }
+    }
+    return nil
+}
+
+// Render fills the placeholders with args. Every declared param is required,
+// unknown args are refused, and values must match the param's pattern; they
+// are inserted shell-quoted, so placeholders must be bare words (see
+// barePlaceholders; templates stored before that check are refused here).
+func (t ExecTemplate) Render(args map[string]string) (string, error) {
+    if err := t.barePlaceholders(); err != nil {
+        return "", err
+    }
+    for name := range args {
+        if _, ok := t.Params[name]; !ok {
+            return "", fmt.Errorf("unknown arg %q", name)
+        }
+    }
+    names := make([]string, 0, len(t.Params))
+    for name := range t.Params {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        v, ok := args[name]
+        if !ok {
+            return "", fmt.Errorf("arg %q required", name)
+        }
+        pat := t.Params[name]
+        if pat == "" {
+            pat = ExecParamPattern
+        }
+        re, err := regexp.Compile(pat)
+        if err != nil {
+            return "", err
+        }
+        if !re.MatchString(v) {
+            return "", fmt.Errorf("arg %s: %q does not match %s", name, v, pat)
+        }
+    }
+    return execPlaceholderRe.ReplaceAllStringFunc(t.Command, func(ph string) string {
+        return shellQuote(args[ph[1:len(ph)-1]])
+    }), nil
+}
+
+func shellQuote(s string) string {
+    return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellQuoted reports for each byte of the sh command cmd whether it is
+// inside single or double quotes (or escaped by a backslash).
+func shellQuoted(cmd string) ([]bool, error) {
+    quoted := make([]bool, len(cmd))
+    var in byte // 0, '\'' or '"'
+    for i := 0; i < len(cmd); i++ {
+        c := cmd[i]
+        switch {
+        case in == '\'':
+            quoted[i] = true
+            if c == '\'' {
+                in = 0
+            }
+        case c == '\\' && i+1 < len(cmd):
+            quoted[i], quoted[i+1] = in != 0, true
+            i++
+        case in == '"':
+            quoted[i] = true
+            if c == '"' {
+                in = 0
+            }
+        case c == '\'' || c == '"':
+            quoted[i], in = true, c
+        }
+    }
+    if in != 0 {
+        return nil, fmt.Errorf("command has an unterminated %c quote", in)
+    }
+    return quoted, nil
+}
+
+// Execution states.
+const (
+    ExecPending = "pending" // waiting for the device's next heartbeat
+    ExecRunning = "running" // handed to the agent
+    ExecDone    = "done"    // finished; see exit_code
+    ExecFailed  = "failed"  // could not be run (e.g. exec disabled on the device)
+    ExecTimeout = "timeout" // killed after timeout_seconds
+    ExecExpired = "expired" // device did not pick it up within ExecPickupTTL
+    ExecLost    = "lost"    // no result long after the timeout (agent restarted?)
+)
+
+// ExecPickupTTL is how long a pending execution waits for its device.
+const ExecPickupTTL = 10 * time.Minute
+
+// execLostGrace is added to the timeout before a running execution is lost.
+const execLostGrace = 5 * time.Minute
+
+// DeviceExec is one execution of a template on one device.
+type DeviceExec struct {
+    ID             string            `json:"id"`
+    BatchID        string            `json:"batch_id,omitempty"` // set when requested for a selector
+    Tenant         string            `json:"tenant"`
+    DeviceID       string            `json:"device_id"`
+    Template       string            `json:"template"`
+    Args           map[string]string `json:"args,omitempty"`
+    Command        string            `json:"command"`
+    Operator       string            `json:"operator"`
+    State          string            `json:"state"`
+    TimeoutSeconds int               `json:"timeout_seconds"`
+    MaxOutputBytes int               `json:"max_output_bytes"`
+    ExitCode       *int              `json:"exit_code,omitempty"`
+    Stdout         string            `json:"stdout,omitempty"`
+    Stderr         string            `json:"stderr,omitempty"`
+    Truncated      bool              `json:"truncated,omitempty"`
+    Error          string            `json:"error,omitempty"`
+    CreatedAt      time.Time         `json:"created_at"`
+    StartedAt      *time.Time        `json:"started_at,omitempty"`
+    FinishedAt     *time.Time        `json:"finished_at,omitempty"`
+}
+
+// ExecResult is what the agent reports for an execution.
+type ExecResult struct {
+    ID         string    `json:"id"`
+    ExitCode   *int      `json:"exit_code"`
+    Stdout     string    `json:"stdout"`
+    Stderr     string    `json:"stderr"`
+    Truncated  bool      `json:"truncated"`
+    TimedOut   bool      `json:"timed_out"`
+    Error      string    `json:"error"`
+    StartedAt  time.Time `json:"started_at"`
+    FinishedAt time.Time `json:"finished_at"`
+}
+
+// MigrateExec ensures the exec_templates and device_execs tables exist.
+func (s *Store) MigrateExec(ctx context.Context) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+    CREATE TABLE IF NOT EXISTS exec_templates (
+        tenant TEXT NOT NULL,
+        name TEXT NOT NULL,
+        command TEXT NOT NULL,
+        params JSONB,
+        timeout_seconds INT NOT NULL,
+        max_output_bytes INT NOT NULL,
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        PRIMARY KEY (tenant, name)
+    );
+    CREATE TABLE IF NOT EXISTS device_execs (
+        id TEXT PRIMARY KEY,
+        batch_id TEXT,
+        tenant TEXT NOT NULL,
+        device_id TEXT NOT NULL,
+        template TEXT NOT NULL,
+        args JSONB,
+        command TEXT NOT NULL,
+        operator TEXT NOT NULL,
+        state TEXT NOT NULL,
+        timeout_seconds INT NOT NULL,
+        max_output_bytes INT NOT NULL,
+        exit_code INT,
+        stdout TEXT,
+        stderr TEXT,
+        truncated BOOLEAN NOT NULL DEFAULT false,
+        error TEXT,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        started_at TIMESTAMPTZ,
+        finished_at TIMESTAMPTZ
+    );
+    CREATE INDEX IF NOT EXISTS idx_device_execs_device_state ON device_execs(device_id, state);
+    CREATE INDEX IF NOT EXISTS idx_device_execs_batch ON device_execs(batch_id);
+    CREATE INDEX IF NOT EXISTS idx_device_execs_tenant_created ON device_execs(tenant, created_at DESC);
+    `)
+    return err
+}
+
+// PutExecTemplate inserts or replaces a template; t must be validated.
+func (s *Store) PutExecTemplate(ctx context.Context, t ExecTemplate) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    params, _ := json.Marshal(t.Params)
+    _, err := s.pool.Exec(ctx, `
+        INSERT INTO exec_templates (tenant, name, command, params, timeout_seconds, max_output_bytes, updated_at)
+        VALUES ($1,$2,$3,$4,$5,$6,now())
+        ON CONFLICT (tenant, name) DO UPDATE SET
+            command = EXCLUDED.command,
+            params = EXCLUDED.params,
+            timeout_seconds = EXCLUDED.timeout_seconds,
+            max_output_bytes = EXCLUDED.max_output_bytes,
+            updated_at = now()`,
+        t.Tenant, t.Name, t.Command, params, t.TimeoutSeconds, t.MaxOutputBytes)
+    return err
+}
+
+const execTemplateCols = `tenant, name, command, params, timeout_seconds, max_output_bytes, updated_at`
+
+func scanExecTemplate(row rowScanner) (ExecTemplate, error) {
+    var t ExecTemplate
+    var params []byte
+    if err := row.Scan(&t.Tenant, &t.Name, &t.Command, &params, &t.TimeoutSeconds, &t.MaxOutputBytes, &t.UpdatedAt); err != nil {
+        return t, err
+    }
+    if len(params) > 0 {
+        _ = json.Unmarshal(params, &t.Params)
+    }
+    return t, nil
+}
+
+// GetExecTemplate returns one template (pgx.ErrNoRows if missing).
+func (s *Store) GetExecTemplate(ctx context.Context, tenant, name string) (ExecTemplate, error) {
+    if s == nil || !s.Enabled {
+        return ExecTemplate{}, errors.New("store disabled")
+    }
+    return scanExecTemplate(s.pool.QueryRow(ctx, `
+        SELECT `+execTemplateCols+` FROM exec_templates WHERE tenant = $1 AND name = $2`, tenant, name))
+}
+
+// ListExecTemplates returns the tenant's allowlist.
+func (s *Store) ListExecTemplates(ctx context.Context, tenant string) ([]ExecTemplate, error) {
+    if s == nil || !s.Enabled {
+        return nil, errors.New("store disabled")
+    }
+    rows, err := s.pool.Query(ctx, `
+        SELECT `+execTemplateCols+` FROM exec_templates WHERE tenant = $1 ORDER BY name ASC`, tenant)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    out := []ExecTemplate{}
+    for rows.Next() {
+        t, err := scanExecTemplate(rows)
+        if err != nil {
+            return nil, err
+        }
+        out = append(out, t)
+    }
+    return out, rows.Err()
+}
+
+// DeleteExecTemplate removes a template; it reports whether it existed.
+func (s *Store) DeleteExecTemplate(ctx context.Context, tenant, name string) (bool, error) {
+    if s == nil || !s.Enabled {
+        return false, errors.New("store disabled")
+    }
+    tag, err := s.pool.Exec(ctx, `DELETE FROM exec_templates WHERE tenant = $1 AND name = $2`, tenant, name)
+    if err != nil {
+        return false, err
+    }
+    return tag.RowsAffected() == 1, nil
+}
+
+// CreateExecs stores pending executions.
+func (s *Store) CreateExecs(ctx context.Context, execs []DeviceExec) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    batch := &pgx.Batch{}
+    for _, e := range execs {
+        args, _ := json.Marshal(e.Args)
+        batch.Queue(`
+            INSERT INTO device_execs (id, batch_id, tenant, device_id, template, args, command, operator, state,
+                timeout_seconds, max_output_bytes, created_at)
+            VALUES ($1,NULLIF($2,''),$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)`,
+            e.ID, e.BatchID, e.Tenant, e.DeviceID, e.Template, args, e.Command, e.Operator, ExecPending,
+            e.TimeoutSeconds, e.MaxOutputBytes, e.CreatedAt)
+    }
+    return s.pool.SendBatch(ctx, batch).Close()
+}
+
+const deviceExecCols = `id, COALESCE(batch_id, ''), tenant, device_id, template, args, command, operator, state,
+        timeout_seconds, max_output_bytes, exit_code, COALESCE(stdout, ''), COALESCE(stderr, ''), truncated,
+        COALESCE(error, ''), created_at, started_at, finished_at`
+
+func scanDeviceExec(row rowScanner) (DeviceExec, error) {
+    var e DeviceExec
+    var args []byte
+    var exit sql.NullInt32
+    var started, finished sql.NullTime
+    if err := row.Scan(&e.ID, &e.BatchID, &e.Tenant, &e.DeviceID, &e.Template, &args, &e.Command, &e.Operator, &e.State,
+        &e.TimeoutSeconds, &e.MaxOutputBytes, &exit, &e.Stdout, &e.Stderr, &e.Truncated,
+        &e.Error, &e.CreatedAt, &started, &finished); err != nil {
+        return e, err
+    }
+    if len(args) > 0 {
+        _ = json.Unmarshal(args, &e.Args)
+    }
+    if exit.Valid {
+        c := int(exit.Int32)
+        e.ExitCode = &c
+    }
+    if started.Valid {
+        e.StartedAt = &started.Time
+    }
+    if finished.Valid {
+        e.FinishedAt = &finished.Time
+    }
+    return e, nil
+}
+
+// expireExecs marks pending executions nobody picked up as expired and
+// running ones without a result long after their timeout as lost.
+func (s *Store) expireExecs(ctx context.Context) error {
+    _, err := s.pool.Exec(ctx, `
+        UPDATE device_execs SET
+            state = CASE WHEN state = $1 THEN $3 ELSE $4 END,
+            finished_at = now()
+        WHERE (state = $1 AND created_at < now() - make_interval(secs => $5))
+           OR (state = $2 AND started_at < now() - make_interval(secs => timeout_seconds + $6::int))`,
+        ExecPending, ExecRunning, ExecExpired, ExecLost, ExecPickupTTL.Seconds(), int(execLostGrace.Seconds()))
+    return err
+}
+
+// ClaimExecs hands the device its pending executions, oldest first, and
+// marks them running.
+func (s *Store) ClaimExecs(ctx context.Context, deviceID string) ([]DeviceExec, error) {
+    if s == nil || !s.Enabled {
+        return nil, errors.New("store disabled")
+    }
+    if err := s.expireExecs(ctx); err != nil {
+        return nil, err
+    }
+    rows, err := s.pool.Query(ctx, `
+        UPDATE device_execs SET state = $2, started_at = now()
+        WHERE id IN (
+            SELECT id FROM device_execs WHERE device_id = $1 AND state = $3
+            ORDER BY created_at ASC FOR UPDATE SKIP LOCKED)
+        RETURNING `+deviceExecCols, deviceID, ExecRunning, ExecPending)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var out []DeviceExec
+    for rows.Next() {
+        e, err := scanDeviceExec(rows)
+        if err != nil {
+            return nil, err
+        }
+        out = append(out, e)
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+    return out, rows.Err()
+}
+
+// CompleteExec stores the agent's result. Only executions of that device
+// that are running (or were given up as lost) are updated; it reports
+// whether one was.
+func (s *Store) CompleteExec(ctx context.Context, deviceID string, r ExecResult) (bool, error) {
+    if s == nil || !s.Enabled {
+        return false, errors.New("store disabled")
+    }
+    state := ExecDone
+    switch {
+    case r.TimedOut:
+        state = ExecTimeout
+    case r.ExitCode == nil:
+        state = ExecFailed
+    }
+    // Postgres text cannot hold NUL
+    clean := func(s string) string { return strings.ReplaceAll(strings.ToValidUTF8(s, "�"), "\x00", "") }
+    tag, err := s.pool.Exec(ctx, `
+        UPDATE device_execs SET state = $3, exit_code = $4, stdout = $5, stderr = $6, truncated = $7,
+            error = NULLIF($8, ''), started_at = COALESCE($9, started_at), finished_at = COALESCE($10, now())
+        WHERE id = $1 AND device_id = $2 AND state IN ($11, $12)`,
+        r.ID, deviceID, state, r.ExitCode, clean(r.Stdout), clean(r.Stderr), r.Truncated,
+        clean(r.Error), nullTime(r.StartedAt), nullTime(r.FinishedAt), ExecRunning, ExecLost)
+    if err != nil {
+        return false, err
+    }
+    return tag.RowsAffected() == 1, nil
+}
+
+func nullTime(t time.Time) *time.Time {
+    if t.IsZero() {
+        return nil
+    }
+    return &t
+}
+
+// GetExec returns one execution (pgx.ErrNoRows if missing).
+func (s *Store) GetExec(ctx context.Context, id string) (DeviceExec, error) {
+    if s == nil || !s.Enabled {
+        return DeviceExec{}, errors.New("store disabled")
+    }
+    if err := s.expireExecs(ctx); err != nil {
+        return DeviceExec{}, err
+    }
+    return scanDeviceExec(s.pool.QueryRow(ctx, `SELECT `+deviceExecCols+` FROM device_execs WHERE id = $1`, id))
+}
+
+// ExecFilter narrows ListExecs; empty fields match everything.
+type ExecFilter struct {
+    Tenant   string
+    DeviceID string
+    BatchID  string
+    Operator string
+    Limit    int // default 100
+}
+
+// ListExecs returns executions, newest first.
+func (s *Store) ListExecs(ctx context.Context, f ExecFilter) ([]DeviceExec, error) {
+    if s == nil || !s.Enabled {
+        return nil, errors.New("store disabled")
+    }
+    if err := s.expireExecs(ctx); err != nil {
+        return nil, err
+    }
+    if f.Limit <= 0 {
+        f.Limit = 100
+    }
+    rows, err := s.pool.Query(ctx, `
+        SELECT `+deviceExecCols+` FROM device_execs
+        WHERE ($1 = '' OR tenant = $1) AND ($2 = '' OR device_id = $2)
+          AND ($3 = '' OR batch_id = $3) AND ($4 = '' OR operator = $4)
+        ORDER BY created_at DESC, id DESC LIMIT $5`,
+        f.Tenant, f.DeviceID, f.BatchID, f.Operator, f.Limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    out := []DeviceExec{}
+    for rows.Next() {
+        e, err := scanDeviceExec(rows)
+        if err != nil {
+            return nil, err
+        }
+        out = append(out, e)
+    }
+    return out, rows.Err()
+}
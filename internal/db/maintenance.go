@@ -0,0 +1,213 @@
+package db
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/example/xdp47/internal/selector"
+)
+
+// MaintenanceWindow is a recurring local-time slot in which matching devices
+// may be updated. A window matches a device of its tenant when its location
+// (if set) equals the device's and its selector (if set) matches the labels.
+type MaintenanceWindow struct {
+    ID        string            `json:"id"`
+    Tenant    string            `json:"tenant"`
+    Location  string            `json:"location,omitempty"` // "" = any location
+    Selector  selector.Selector `json:"selector,omitempty"` // empty = any labels
+    Timezone  string            `json:"timezone"`           // IANA, e.g. Europe/Sofia
+    Days      []string          `json:"days,omitempty"`     // mon..sun; empty = every day
+    Start     string            `json:"start"`              // "HH:MM" local time
+    End       string            `json:"end"`                // "HH:MM"; <= start wraps past midnight
+    CreatedAt time.Time         `json:"created_at"`
+}
+
+var weekdays = map[string]time.Weekday{
+    "sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+    "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseHM returns minutes since midnight. "24:00" is allowed as an end of day.
+func parseHM(s string) (int, error) {
+    if s == "24:00" {
+        return 24 * 60, nil
+    }
+    t, err := time.Parse("15:04", s)
+    if err != nil {
+        return 0, fmt.Errorf("bad time %q (want HH:MM)", s)
+    }
+    return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate checks time zone, days and times.
+func (w MaintenanceWindow) Validate() error {
+    if w.Tenant == "" {
+        return errors.New("tenant required")
+    }
+    if _, err := time.LoadLocation(w.Timezone); err != nil || w.Timezone == "" {
+        return fmt.Errorf("bad timezone %q", w.Timezone)
+    }
+    for _, d := range w.Days {
+        if _, ok := weekdays[strings.ToLower(d)]; !ok {
+            return fmt.Errorf("bad day %q (want mon..sun)", d)
+        }
+    }
+    if _, err := parseHM(w.Start); err != nil {
+        return err
+    }
+    if _, err := parseHM(w.End); err != nil {
+        return err
+    }
+    return nil
+}
+
+// Applies reports whether the window governs the device.
+func (w MaintenanceWindow) Applies(d Device) bool {
+    if w.Tenant != d.Tenant {
+        return false
+    }
+    if w.Location != "" && w.Location != d.Location {
+        return false
+    }
+    return w.Selector.Matches(d.Labels)
+}
+
+func (w MaintenanceWindow) onDay(wd time.Weekday) bool {
+    if len(w.Days) == 0 {
+        return true
+    }
+    for _, d := range w.Days {
+        if weekdays[strings.ToLower(d)] == wd {
+            return true
+        }
+    }
+    return false
+}
+
+// Contains reports whether t falls inside the window. For windows that wrap
+// past midnight the day refers to the day the window opens.
+func (w MaintenanceWindow) Contains(t time.Time) bool {
+    loc, err := time.LoadLocation(w.Timezone)
+    if err != nil {
+        loc = time.UTC
+    }
+    lt := t.In(loc)
+    start, err1 := parseHM(w.Start)
+    end, err2 := parseHM(w.End)
+    if err1 != nil || err2 != nil {
+        return false
+    }
+    now := lt.Hour()*60 + lt.Minute()
+    switch {
+    case start == end:
+        return w.onDay(lt.Weekday())
+    case start < end:
+        return w.onDay(lt.Weekday()) && now >= start && now < end
+    case now >= start:
+        return w.onDay(lt.Weekday())
+    case now < end:
+        return w.onDay(lt.AddDate(0, 0, -1).Weekday())
+    }
+    return false
+}
+
+// MaintenanceAllowed reports whether d may be updated at t: either no window
+// governs it, or at least one governing window is open.
+func MaintenanceAllowed(windows []MaintenanceWindow, d Device, t time.Time) bool {
+    governed := false
+    for _, w := range windows {
+        if !w.Applies(d) {
+            continue
+        }
+        if w.Contains(t) {
+            return true
+        }
+        governed = true
+    }
+    return !governed
+}
+
+// MigrateMaintenance ensures the maintenance_windows table exists.
+func (s *Store) MigrateMaintenance(ctx context.Context) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+    CREATE TABLE IF NOT EXISTS maintenance_windows (
+        id TEXT PRIMARY KEY,
+        tenant TEXT NOT NULL,
+        location TEXT,
+        selector JSONB,
+        timezone TEXT NOT NULL,
+        days JSONB,
+        start_hm TEXT NOT NULL,
+        end_hm TEXT NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    );
+    CREATE INDEX IF NOT EXISTS idx_maintenance_windows_tenant ON maintenance_windows(tenant);
+    `)
+    return err
+}
+
+// CreateMaintenanceWindow stores a new window.
+func (s *Store) CreateMaintenanceWindow(ctx context.Context, w MaintenanceWindow) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    sel, _ := json.Marshal(w.Selector)
+    days, _ := json.Marshal(w.Days)
+    _, err := s.pool.Exec(ctx, `
+        INSERT INTO maintenance_windows (id, tenant, location, selector, timezone, days, start_hm, end_hm, created_at)
+        VALUES ($1,$2,NULLIF($3,''),$4,$5,$6,$7,$8,$9)`,
+        w.ID, w.Tenant, w.Location, sel, w.Timezone, days, w.Start, w.End, w.CreatedAt)
+    return err
+}
+
+// ListMaintenanceWindows returns the tenant's windows ("" = all tenants).
+func (s *Store) ListMaintenanceWindows(ctx context.Context, tenant string) ([]MaintenanceWindow, error) {
+    if s == nil || !s.Enabled {
+        return nil, errors.New("store disabled")
+    }
+    rows, err := s.pool.Query(ctx, `
+        SELECT id, tenant, COALESCE(location, ''), selector, timezone, days, start_hm, end_hm, created_at
+        FROM maintenance_windows
+        WHERE ($1 = '' OR tenant = $1)
+        ORDER BY tenant ASC, created_at ASC, id ASC`, tenant)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    out := []MaintenanceWindow{}
+    for rows.Next() {
+        var w MaintenanceWindow
+        var sel, days []byte
+        if err := rows.Scan(&w.ID, &w.Tenant, &w.Location, &sel, &w.Timezone, &days, &w.Start, &w.End, &w.CreatedAt); err != nil {
+            return nil, err
+        }
+        if len(sel) > 0 {
+            _ = json.Unmarshal(sel, &w.Selector)
+        }
+        if len(days) > 0 {
+            _ = json.Unmarshal(days, &w.Days)
+        }
+        out = append(out, w)
+    }
+    return out, rows.Err()
+}
+
+// DeleteMaintenanceWindow removes a window; it reports whether it existed.
+func (s *Store) DeleteMaintenanceWindow(ctx context.Context, id string) (bool, error) {
+    if s == nil || !s.Enabled {
+        return false, errors.New("store disabled")
+    }
+    tag, err := s.pool.Exec(ctx, `DELETE FROM maintenance_windows WHERE id = $1`, id)
+    if err != nil {
+        return false, err
+    }
+    return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// activeRolloutStatuses are the states in which a rollout owns its devices.
+var activeRolloutStatuses = []string{"running", "paused", "rolling_back"}
+
+// ErrRolloutActive is returned when starting a rollout that is already running.
+var ErrRolloutActive = errors.New("rollout already running")
+
+// RolloutConflictError lists running rollouts that target some of the same devices.
+type RolloutConflictError struct {
+    IDs []string
+}
+
+func (e *RolloutConflictError) Error() string {
+    return "overlapping rollouts running: " + strings.Join(e.IDs, ", ")
+}
+
+// ClaimRolloutStart moves a rollout to "running" and records the device set it
+// targets. It runs in one transaction under a per-tenant advisory lock, so two
+// control-plane instances cannot start overlapping rollouts at the same time.
+//
+// If another active rollout of the tenant targets any of deviceIDs, the
+// rollout is set to "queued" when queue is true, otherwise a
+// *RolloutConflictError is returned. The resulting status is returned.
+func (s *Store) ClaimRolloutStart(ctx context.Context, id string, deviceIDs []string, queue bool) (string, error) {
+    if s == nil || !s.Enabled {
+        return "", errors.New("store disabled")
+    }
+    if deviceIDs == nil {
+        deviceIDs = []string{}
+    }
+    tx, err := s.pool.Begin(ctx)
+    if err != nil {
+        return "", err
+    }
+    defer tx.Rollback(ctx)
+
+    var tenant string
+    if err := tx.QueryRow(ctx, `SELECT tenant FROM rollouts WHERE id = $1`, id).Scan(&tenant); err != nil {
+        return "", err
+    }
+    // tenant lock first, then the row: same order everywhere
+    if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('xdp47:rollout-start:' || $1))`, tenant); err != nil {
+        return "", fmt.Errorf("rollout lock: %w", err)
+    }
+    var status string
+    if err := tx.QueryRow(ctx, `SELECT status FROM rollouts WHERE id = $1 FOR UPDATE`, id).Scan(&status); err != nil {
+        return "", err
+    }
+    for _, st := range activeRolloutStatuses {
+        if status == st {
+            return "", ErrRolloutActive
+        }
+    }
+
+    rows, err := tx.Query(ctx, `
+        SELECT id FROM rollouts
+        WHERE tenant = $1 AND id <> $2 AND status = ANY($3)
+          AND device_ids ?| $4::text[]
+        ORDER BY created_at ASC, id ASC`, tenant, id, activeRolloutStatuses, deviceIDs)
+    if err != nil {
+        return "", err
+    }
+    var conflicts []string
+    for rows.Next() {
+        var cid string
+        if err := rows.Scan(&cid); err != nil {
+            rows.Close()
+            return "", err
+        }
+        conflicts = append(conflicts, cid)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return "", err
+    }
+
+    next := "running"
+    if len(conflicts) > 0 {
+        if !queue {
+            return "", &RolloutConflictError{IDs: conflicts}
+        }
+        next = "queued"
+    }
+    if _, err := tx.Exec(ctx, `UPDATE rollouts SET status = $1, device_ids = to_jsonb($2::text[]) WHERE id = $3`,
+        next, deviceIDs, id); err != nil {
+        return "", err
+    }
+    if err := tx.Commit(ctx); err != nil {
+        return "", err
+    }
+    return next, nil
+}
+
+// AcquireRolloutLease makes owner the executor of the rollout for ttl. It
+// succeeds when nobody holds the lease, owner already holds it, or the
+// previous lease expired (e.g. its control-plane instance died).
+func (s *Store) AcquireRolloutLease(ctx context.Context, id, owner string, ttl time.Duration) (bool, error) {
+    if s == nil || !s.Enabled {
+        return false, errors.New("store disabled")
+    }
+    tag, err := s.pool.Exec(ctx, `
+        UPDATE rollouts SET lease_owner = $2, lease_until = now() + $3 * interval '1 millisecond'
+        WHERE id = $1 AND (lease_owner IS NULL OR lease_owner = $2 OR lease_until < now())`,
+        id, owner, ttl.Milliseconds())
+    if err != nil {
+        return false, err
+    }
+    return tag.RowsAffected() == 1, nil
+}
+
+// ReleaseRolloutLease drops owner's lease on the rollout.
+func (s *Store) ReleaseRolloutLease(ctx context.Context, id, owner string) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+        UPDATE rollouts SET lease_owner = NULL, lease_until = NULL
+        WHERE id = $1 AND lease_owner = $2`, id, owner)
+    return err
+}
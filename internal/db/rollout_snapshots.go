@@ -0,0 +1,75 @@
+package db
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "time"
+)
+
+// DeviceSnapshot is the version/channel a device had before a rollout applied to it.
+type DeviceSnapshot struct {
+    RolloutID   string     `json:"rollout_id"`
+    DeviceID    string     `json:"device_id"`
+    PrevVersion string     `json:"prev_version"`
+    PrevChannel string     `json:"prev_channel"`
+    TakenAt     time.Time  `json:"taken_at"`
+    RestoredAt  *time.Time `json:"restored_at,omitempty"`
+}
+
+// SnapshotDevice records the current version/channel of d for the rollout.
+// The first snapshot wins, so re-applying a wave after a restart keeps the
+// original values.
+func (s *Store) SnapshotDevice(ctx context.Context, rolloutID string, d Device) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+        INSERT INTO rollout_snapshots (rollout_id, device_id, prev_version, prev_channel, taken_at)
+        VALUES ($1,$2,$3,$4,now())
+        ON CONFLICT (rollout_id, device_id) DO NOTHING`,
+        rolloutID, d.ID, d.Version, d.Channel)
+    return err
+}
+
+// ListSnapshots returns the rollout's snapshots; with pendingOnly only those not restored yet.
+func (s *Store) ListSnapshots(ctx context.Context, rolloutID string, pendingOnly bool) ([]DeviceSnapshot, error) {
+    if s == nil || !s.Enabled {
+        return nil, errors.New("store disabled")
+    }
+    rows, err := s.pool.Query(ctx, `
+        SELECT rollout_id, device_id, COALESCE(prev_version, ''), COALESCE(prev_channel, ''), taken_at, restored_at
+        FROM rollout_snapshots
+        WHERE rollout_id = $1 AND (NOT $2 OR restored_at IS NULL)
+        ORDER BY taken_at ASC, device_id ASC`, rolloutID, pendingOnly)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var out []DeviceSnapshot
+    for rows.Next() {
+        var d DeviceSnapshot
+        var restored sql.NullTime
+        if err := rows.Scan(&d.RolloutID, &d.DeviceID, &d.PrevVersion, &d.PrevChannel, &d.TakenAt, &restored); err != nil {
+            return nil, err
+        }
+        if restored.Valid {
+            t := restored.Time
+            d.RestoredAt = &t
+        }
+        out = append(out, d)
+    }
+    return out, rows.Err()
+}
+
+// MarkSnapshotRestored flags the device as returned to its snapshot.
+func (s *Store) MarkSnapshotRestored(ctx context.Context, rolloutID, deviceID string, at time.Time) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+        UPDATE rollout_snapshots SET restored_at = $1
+        WHERE rollout_id = $2 AND device_id = $3`, at, rolloutID, deviceID)
+    return err
+}
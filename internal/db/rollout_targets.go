@@ -0,0 +1,150 @@
+package db
+
+import (
+    "context"
+    "errors"
+    "time"
+)
+
+// Per-device states in rollout_targets.
+const (
+    TargetPending        = "pending"
+    TargetApplied        = "applied"
+    TargetSkippedOffline = "skipped_offline"
+    TargetSkippedCordoned = "skipped_cordoned" // cordoned or draining; not a failure
+    TargetFailedStatus   = "failed_status"
+    TargetApplyError     = "apply_error"
+    TargetBakeFailed     = "bake_failed"
+    TargetRolledBack     = "rolled_back"
+    TargetDeferred       = "deferred"         // outside its maintenance window; retried later
+    TargetDeferredExpired = "deferred_expired" // rollout deadline passed before the window opened
+)
+
+// RolloutTarget is what happened to one device in one wave of a rollout.
+type RolloutTarget struct {
+    RolloutID   string    `json:"rollout_id"`
+    WaveIndex   int       `json:"wave_index"`
+    DeviceID    string    `json:"device_id"`
+    State       string    `json:"state"`
+    Reason      string    `json:"reason,omitempty"`
+    PrevVersion string    `json:"prev_version,omitempty"`
+    NewVersion  string    `json:"new_version,omitempty"`
+    CreatedAt   time.Time `json:"created_at"`
+    UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (s *Store) insertPendingTargets(ctx context.Context, rolloutID string, waveIndex int, deviceIDs []string) error {
+    if len(deviceIDs) == 0 {
+        return nil
+    }
+    _, err := s.pool.Exec(ctx, `
+        INSERT INTO rollout_targets (rollout_id, wave_index, device_id, state)
+        SELECT $1, $2, d, $4 FROM unnest($3::text[]) AS d
+        ON CONFLICT (rollout_id, wave_index, device_id) DO NOTHING`,
+        rolloutID, waveIndex, deviceIDs, TargetPending)
+    return err
+}
+
+// SetRolloutTarget upserts the device's state for the wave. An already
+// recorded prev_version is kept, so re-running a wave after a restart does not
+// replace it with the version the rollout itself applied.
+func (s *Store) SetRolloutTarget(ctx context.Context, t RolloutTarget) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+        INSERT INTO rollout_targets (rollout_id, wave_index, device_id, state, reason, prev_version, new_version)
+        VALUES ($1,$2,$3,$4,NULLIF($5,''),NULLIF($6,''),NULLIF($7,''))
+        ON CONFLICT (rollout_id, wave_index, device_id) DO UPDATE SET
+            state = EXCLUDED.state,
+            reason = EXCLUDED.reason,
+            prev_version = COALESCE(rollout_targets.prev_version, EXCLUDED.prev_version),
+            new_version = EXCLUDED.new_version,
+            updated_at = now()`,
+        t.RolloutID, t.WaveIndex, t.DeviceID, t.State, t.Reason, t.PrevVersion, t.NewVersion)
+    return err
+}
+
+// MarkTargetsRolledBack flips the device's applied rows in the rollout to rolled_back.
+func (s *Store) MarkTargetsRolledBack(ctx context.Context, rolloutID, deviceID, reason string) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+        UPDATE rollout_targets SET state = $1, reason = $2, updated_at = now()
+        WHERE rollout_id = $3 AND device_id = $4 AND state = $5`,
+        TargetRolledBack, reason, rolloutID, deviceID, TargetApplied)
+    return err
+}
+
+// ListRolloutTargets returns all per-device rows of a rollout, by wave then device.
+func (s *Store) ListRolloutTargets(ctx context.Context, rolloutID string) ([]RolloutTarget, error) {
+    return s.ListRolloutTargetsByState(ctx, rolloutID, "")
+}
+
+// ListRolloutTargetsByState is ListRolloutTargets limited to one state ("" = all).
+func (s *Store) ListRolloutTargetsByState(ctx context.Context, rolloutID, state string) ([]RolloutTarget, error) {
+    if s == nil || !s.Enabled {
+        return nil, errors.New("store disabled")
+    }
+    rows, err := s.pool.Query(ctx, `
+        SELECT rollout_id, wave_index, device_id, state, COALESCE(reason, ''),
+               COALESCE(prev_version, ''), COALESCE(new_version, ''), created_at, updated_at
+        FROM rollout_targets
+        WHERE rollout_id = $1 AND ($2 = '' OR state = $2)
+        ORDER BY wave_index ASC, device_id ASC`, rolloutID, state)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    out := []RolloutTarget{}
+    for rows.Next() {
+        var t RolloutTarget
+        if err := rows.Scan(&t.RolloutID, &t.WaveIndex, &t.DeviceID, &t.State, &t.Reason,
+            &t.PrevVersion, &t.NewVersion, &t.CreatedAt, &t.UpdatedAt); err != nil {
+            return nil, err
+        }
+        out = append(out, t)
+    }
+    return out, rows.Err()
+}
+
+// DeviceRolloutTarget is a rollout_targets row with the rollout it belongs to.
+type DeviceRolloutTarget struct {
+    RolloutTarget
+    Artifact      string `json:"artifact"`
+    RolloutStatus string `json:"rollout_status"`
+}
+
+// ListDeviceRolloutTargets returns the device's rollout history, most recent first.
+func (s *Store) ListDeviceRolloutTargets(ctx context.Context, deviceID string, limit int) ([]DeviceRolloutTarget, error) {
+    if s == nil || !s.Enabled {
+        return nil, errors.New("store disabled")
+    }
+    if limit <= 0 {
+        limit = 20
+    }
+    rows, err := s.pool.Query(ctx, `
+        SELECT t.rollout_id, t.wave_index, t.device_id, t.state, COALESCE(t.reason, ''),
+               COALESCE(t.prev_version, ''), COALESCE(t.new_version, ''), t.created_at, t.updated_at,
+               COALESCE(r.artifact, ''), COALESCE(r.status, '')
+        FROM rollout_targets t LEFT JOIN rollouts r ON r.id = t.rollout_id
+        WHERE t.device_id = $1
+        ORDER BY t.updated_at DESC, t.wave_index DESC LIMIT $2`, deviceID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    out := []DeviceRolloutTarget{}
+    for rows.Next() {
+        var t DeviceRolloutTarget
+        if err := rows.Scan(&t.RolloutID, &t.WaveIndex, &t.DeviceID, &t.State, &t.Reason,
+            &t.PrevVersion, &t.NewVersion, &t.CreatedAt, &t.UpdatedAt, &t.Artifact, &t.RolloutStatus); err != nil {
+            return nil, err
+        }
+        out = append(out, t)
+    }
+    return out, rows.Err()
+}
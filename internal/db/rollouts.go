@@ -5,6 +5,8 @@ import (
     "encoding/json"
     "fmt"
     "time"
+
+    "github.com/example/xdp47/internal/selector"
 )
 
 // Rollout represents a simple rollout plan persisted in DB.
@@ -13,9 +15,14 @@ type Rollout struct {
     Tenant    string                 `json:"tenant"`
     Artifact  string                 `json:"artifact"`
     Channel   string                 `json:"channel"`
-    Selector  map[string]string      `json:"selector"` // match labels
+    Selector  selector.Selector      `json:"selector"` // match labels
     Waves     int                    `json:"waves"`
-    Status    string                 `json:"status"`   // draft|running|paused|completed|failed
+    Plan      WavePlan               `json:"plan,omitempty"` // explicit wave sizes; overrides Waves
+    Rollback  string                 `json:"rollback,omitempty"` // off|on_failed|on_partial; "" = scheduler default
+    BakeSeconds     int              `json:"bake_seconds,omitempty"`      // health watch after each wave; 0 = none
+    MaxFailureRatio *float64         `json:"max_failure_ratio,omitempty"` // 0..1; nil = scheduler default
+    Deadline  *time.Time             `json:"deadline,omitempty"` // devices deferred by maintenance windows give up after this
+    Status    string                 `json:"status"`   // draft|queued|running|paused|completed|failed|cancelled|rolling_back|rolled_back
     CreatedAt time.Time              `json:"created_at"`
 }
 
@@ -34,25 +41,60 @@ func (s *Store) MigrateRollouts(ctx context.Context) error {
         created_at TIMESTAMPTZ DEFAULT now()
     );
     CREATE INDEX IF NOT EXISTS idx_rollouts_tenant ON rollouts(tenant);
+    ALTER TABLE rollouts ADD COLUMN IF NOT EXISTS rollback TEXT;
+    ALTER TABLE rollouts ADD COLUMN IF NOT EXISTS bake_seconds INT;
+    ALTER TABLE rollouts ADD COLUMN IF NOT EXISTS max_failure_ratio DOUBLE PRECISION;
+    ALTER TABLE rollouts ADD COLUMN IF NOT EXISTS plan JSONB;
+    -- claimed device set + executor lease (see rollout_locks.go)
+    ALTER TABLE rollouts ADD COLUMN IF NOT EXISTS device_ids JSONB;
+    ALTER TABLE rollouts ADD COLUMN IF NOT EXISTS lease_owner TEXT;
+    ALTER TABLE rollouts ADD COLUMN IF NOT EXISTS lease_until TIMESTAMPTZ;
+    CREATE INDEX IF NOT EXISTS idx_rollouts_tenant_status ON rollouts(tenant, status);
+    ALTER TABLE rollouts ADD COLUMN IF NOT EXISTS deadline TIMESTAMPTZ;
     `
     _, err := s.pool.Exec(ctx, sql)
     return err
 }
 
+// rolloutCols is the column list read by scanRollout.
+const rolloutCols = `id, tenant, artifact, channel, selector, waves, plan, COALESCE(rollback, ''),
+        COALESCE(bake_seconds, 0), max_failure_ratio, deadline, status, created_at`
+
+// rowScanner is satisfied by pgx.Row and pgx.Rows.
+type rowScanner interface {
+    Scan(dest ...any) error
+}
+
+func scanRollout(row rowScanner) (Rollout, error) {
+    var r Rollout
+    var sel, plan []byte
+    if err := row.Scan(&r.ID, &r.Tenant, &r.Artifact, &r.Channel, &sel, &r.Waves, &plan, &r.Rollback,
+        &r.BakeSeconds, &r.MaxFailureRatio, &r.Deadline, &r.Status, &r.CreatedAt); err != nil {
+        return Rollout{}, err
+    }
+    if len(sel) > 0 { _ = json.Unmarshal(sel, &r.Selector) }
+    if len(plan) > 0 { _ = json.Unmarshal(plan, &r.Plan) }
+    return r, nil
+}
+
 func (s *Store) CreateRollout(ctx context.Context, r Rollout) error {
     if s == nil || !s.Enabled { return fmt.Errorf("store disabled") }
     sel, _ := json.Marshal(r.Selector)
+    var plan []byte
+    if len(r.Plan) > 0 { plan, _ = json.Marshal(r.Plan) }
     _, err := s.pool.Exec(ctx, `
-        INSERT INTO rollouts (id, tenant, artifact, channel, selector, waves, status, created_at)
-        VALUES ($1,$2,$3,$4,$5,$6,$7,COALESCE($8, now()));
-    `, r.ID, r.Tenant, r.Artifact, r.Channel, sel, r.Waves, r.Status, r.CreatedAt)
+        INSERT INTO rollouts (id, tenant, artifact, channel, selector, waves, plan, rollback,
+            bake_seconds, max_failure_ratio, deadline, status, created_at)
+        VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,COALESCE($13, now()));
+    `, r.ID, r.Tenant, r.Artifact, r.Channel, sel, r.Waves, plan, r.Rollback,
+        r.BakeSeconds, r.MaxFailureRatio, r.Deadline, r.Status, r.CreatedAt)
     return err
 }
 
 func (s *Store) ListRollouts(ctx context.Context, tenant string) ([]Rollout, error) {
     if s == nil || !s.Enabled { return nil, fmt.Errorf("store disabled") }
     rows, err := s.pool.Query(ctx, `
-        SELECT id, tenant, artifact, channel, selector, waves, status, created_at
+        SELECT `+rolloutCols+`
         FROM rollouts
         WHERE ($1 = '' OR tenant = $1)
         ORDER BY created_at DESC, id ASC;
@@ -61,11 +103,41 @@ func (s *Store) ListRollouts(ctx context.Context, tenant string) ([]Rollout, err
     defer rows.Close()
     var out []Rollout
     for rows.Next() {
-        var r Rollout
-        var sel []byte
-        if err := rows.Scan(&r.ID, &r.Tenant, &r.Artifact, &r.Channel, &sel, &r.Waves, &r.Status, &r.CreatedAt); err != nil { return nil, err }
-        if sel != nil { _ = json.Unmarshal(sel, &r.Selector) }
+        r, err := scanRollout(rows)
+        if err != nil { return nil, err }
         out = append(out, r)
     }
     return out, rows.Err()
 }
+
+// ListRolloutsByStatus returns all rollouts (any tenant) in one of the given statuses, oldest first.
+func (s *Store) ListRolloutsByStatus(ctx context.Context, status ...string) ([]Rollout, error) {
+    if s == nil || !s.Enabled { return nil, fmt.Errorf("store disabled") }
+    rows, err := s.pool.Query(ctx, `
+        SELECT `+rolloutCols+`
+        FROM rollouts
+        WHERE status = ANY($1)
+        ORDER BY created_at ASC, id ASC;
+    `, status)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    var out []Rollout
+    for rows.Next() {
+        r, err := scanRollout(rows)
+        if err != nil { return nil, err }
+        out = append(out, r)
+    }
+    return out, rows.Err()
+}
+
+// EnsureRolloutDeadline sets the rollout's deadline to def unless one is
+// already stored, and returns the effective deadline.
+func (s *Store) EnsureRolloutDeadline(ctx context.Context, id string, def time.Time) (time.Time, error) {
+    if s == nil || !s.Enabled { return time.Time{}, fmt.Errorf("store disabled") }
+    var out time.Time
+    err := s.pool.QueryRow(ctx, `
+        UPDATE rollouts SET deadline = COALESCE(deadline, $2)
+        WHERE id = $1
+        RETURNING deadline`, id, def).Scan(&out)
+    return out, err
+}
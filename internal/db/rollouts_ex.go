@@ -3,8 +3,11 @@ package db
 import (
     "context"
     "database/sql"
+    "encoding/json"
     "errors"
     "time"
+
+    "github.com/example/xdp47/internal/selector"
 )
 
 // Минимален модел за детайли на вълните
@@ -14,6 +17,13 @@ type RolloutRun struct {
     Status     string     `json:"status"`
     StartedAt  time.Time  `json:"started_at"`
     FinishedAt *time.Time `json:"finished_at,omitempty"`
+    DeviceIDs  []string   `json:"device_ids,omitempty"`
+}
+
+// Done reports whether the wave finished in a state that must not be re-applied
+// when the rollout is resumed.
+func (r RolloutRun) Done() bool {
+    return r.FinishedAt != nil && (r.Status == "completed" || r.Status == "partial")
 }
 
 // ========== DETAILS (history) ==========
@@ -23,10 +33,10 @@ func (s *Store) ListRolloutRuns(ctx context.Context, rolloutID string) ([]Rollou
         return []RolloutRun{}, nil
     }
     rows, err := s.pool.Query(ctx, `
-        SELECT rollout_id, wave_index, status, started_at, finished_at
+        SELECT rollout_id, wave_index, status, started_at, finished_at, device_ids
         FROM rollout_runs
         WHERE rollout_id = $1
-        ORDER BY wave_index ASC`, rolloutID)
+        ORDER BY started_at ASC, wave_index ASC`, rolloutID)
     if err != nil {
         return nil, err
     }
@@ -36,9 +46,13 @@ func (s *Store) ListRolloutRuns(ctx context.Context, rolloutID string) ([]Rollou
     for rows.Next() {
         var r RolloutRun
         var finished sql.NullTime
-        if err := rows.Scan(&r.RolloutID, &r.WaveIndex, &r.Status, &r.StartedAt, &finished); err != nil {
+        var ids []byte
+        if err := rows.Scan(&r.RolloutID, &r.WaveIndex, &r.Status, &r.StartedAt, &finished, &ids); err != nil {
             return nil, err
         }
+        if len(ids) > 0 {
+            _ = json.Unmarshal(ids, &r.DeviceIDs)
+        }
         if finished.Valid {
             t := finished.Time
             r.FinishedAt = &t
@@ -58,53 +72,77 @@ func (s *Store) CompleteRolloutRun(ctx context.Context, runID, status string, fi
     return err
 }
 
+// InsertRolloutEvent записва rollout-level преход (paused/resumed/cancelled)
+// в history-то. Такива редове са с wave_index = 0 и са веднага приключени.
+func (s *Store) InsertRolloutEvent(ctx context.Context, rolloutID, status string) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    now := time.Now().UTC()
+    id := "evt-" + rolloutID + "-" + itoa(int(now.UnixNano()))
+    _, err := s.pool.Exec(ctx, `
+        INSERT INTO rollout_runs (id, rollout_id, wave_index, status, started_at, finished_at)
+        VALUES ($1,$2,0,$3,$4,$4)`,
+        id, rolloutID, status, now)
+    return err
+}
+
+// TransitionRolloutStatus сменя статуса само ако текущият е един от from.
+// Връща false, ако rollout-ът не е бил в някое от очакваните състояния.
+func (s *Store) TransitionRolloutStatus(ctx context.Context, id string, from []string, to string) (bool, error) {
+    if s == nil || !s.Enabled {
+        return false, errors.New("store disabled")
+    }
+    tag, err := s.pool.Exec(ctx, `
+        UPDATE rollouts SET status = $1
+        WHERE id = $2 AND status = ANY($3)`, to, id, from)
+    if err != nil {
+        return false, err
+    }
+    return tag.RowsAffected() == 1, nil
+}
+
 // ========== METHODS, които очаква scheduler ==========
 
 // FilterDevicesBySelector: практичен филтър по tenant + selector (labels JSONB).
-// Поддържаме (tenant, selector) или само (selector).
+// Поддържаме (tenant, selector) или само (selector); selector е
+// selector.Selector или map[string]string (само равенства).
 func (s *Store) FilterDevicesBySelector(ctx context.Context, args ...any) ([]Device, error) {
     if s == nil || !s.Enabled {
         return []Device{}, errors.New("store disabled")
     }
     var tenant string
-    var selector map[string]string
+    var sel selector.Selector
 
-    if len(args) == 1 {
-        if m, ok := args[0].(map[string]string); ok {
-            selector = m
+    asSelector := func(v any) selector.Selector {
+        switch x := v.(type) {
+        case selector.Selector:
+            return x
+        case map[string]string:
+            return selector.FromMap(x)
         }
+        return nil
+    }
+    if len(args) == 1 {
+        sel = asSelector(args[0])
     } else if len(args) >= 2 {
         if t, ok := args[0].(string); ok {
             tenant = t
         }
-        if m, ok := args[1].(map[string]string); ok {
-            selector = m
-        }
-    }
-    if selector == nil {
-        selector = map[string]string{}
-    }
-
-    // Ще мачнем по всяка двойка key=value от selector в labels JSONB (@>)
-    type kv struct{ k, v string }
-    var pairs []kv
-    for k, v := range selector {
-        pairs = append(pairs, kv{k, v})
+        sel = asSelector(args[1])
     }
 
     q := `
-        SELECT id, tenant, labels, location, version, channel, status, last_seen, created_at
+        SELECT ` + deviceCols + `
         FROM devices
         WHERE ($1 = '' OR tenant = $1)
     `
-    // динамично изграждаме AND условията
+    // условията на selector-а идват като параметри ($2...)
     params := []any{tenant}
-    i := 2
-    for _, p := range pairs {
-        q += "\n  AND (labels ->> $" + itoa(i) + ") = $" + itoa(i+1)
-        params = append(params, p.k, p.v)
-        i += 2
-    }
+    q += "\n  AND " + sel.SQL("labels", func(v any) string {
+        params = append(params, v)
+        return "$" + itoa(len(params))
+    })
     q += "\nORDER BY last_seen DESC NULLS LAST, id ASC"
 
     rows, err := s.pool.Query(ctx, q, params...)
@@ -115,8 +153,8 @@ func (s *Store) FilterDevicesBySelector(ctx context.Context, args ...any) ([]Dev
 
     var out []Device
     for rows.Next() {
-        var d Device
-        if err := rows.Scan(&d.ID, &d.Tenant, &d.Labels, &d.Location, &d.Version, &d.Channel, &d.Status, &d.LastSeen, &d.CreatedAt); err != nil {
+        d, err := scanDevice(rows)
+        if err != nil {
             return nil, err
         }
         out = append(out, d)
@@ -165,6 +203,15 @@ func (s *Store) InsertRolloutRun(ctx context.Context, args ...any) error {
     rolloutID, _ := args[1].(string)
     waveIndex, _ := args[2].(int)
 
+    // списъкът с устройства на вълната (ако е подаден) е checkpoint за resume
+    var deviceIDs []string
+    for _, a := range args[3:] {
+        if ids, ok := a.([]string); ok {
+            deviceIDs = ids
+            break
+        }
+    }
+
     // status и startedAt най-често са последните 2 аргумента
     var status string
     var startedAt time.Time
@@ -179,15 +226,31 @@ func (s *Store) InsertRolloutRun(ctx context.Context, args ...any) error {
     if startedAt.IsZero() {
         startedAt = time.Now().UTC()
     }
-    if runID == "" || rolloutID == "" || waveIndex <= 0 || status == "" {
+    // wave_index 0 е запазен за rollout-level записи (напр. rollback)
+    if runID == "" || rolloutID == "" || waveIndex < 0 || status == "" {
         return errors.New("invalid InsertRolloutRun args")
     }
 
+    if deviceIDs == nil {
+        deviceIDs = []string{}
+    }
+    ids, _ := json.Marshal(deviceIDs)
+
+    // Вълна, прекъсната от рестарт, се стартира наново със същото id.
     _, err := s.pool.Exec(ctx, `
-        INSERT INTO rollout_runs (id, rollout_id, wave_index, status, started_at)
-        VALUES ($1,$2,$3,$4,$5)`,
-        runID, rolloutID, waveIndex, status, startedAt)
-    return err
+        INSERT INTO rollout_runs (id, rollout_id, wave_index, status, started_at, device_ids)
+        VALUES ($1,$2,$3,$4,$5,$6)
+        ON CONFLICT (id) DO UPDATE SET
+            status = EXCLUDED.status,
+            started_at = EXCLUDED.started_at,
+            finished_at = NULL,
+            device_ids = EXCLUDED.device_ids`,
+        runID, rolloutID, waveIndex, status, startedAt, ids)
+    if err != nil || waveIndex == 0 {
+        return err
+    }
+    // всяко устройство от вълната получава pending ред в rollout_targets
+    return s.insertPendingTargets(ctx, rolloutID, waveIndex, deviceIDs)
 }
 
 // малки помощници
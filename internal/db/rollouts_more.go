@@ -2,7 +2,6 @@ package db
 
 import (
     "context"
-    "encoding/json"
     "time"
 )
 
@@ -22,6 +21,34 @@ CREATE TABLE IF NOT EXISTS rollout_runs (
 );
 CREATE INDEX IF NOT EXISTS idx_rollout_runs_ro ON rollout_runs(rollout_id);
 CREATE INDEX IF NOT EXISTS idx_rollout_runs_ro_wave ON rollout_runs(rollout_id, wave_index);
+-- device_ids е checkpoint-ът, по който scheduler-ът продължава след рестарт
+ALTER TABLE rollout_runs ADD COLUMN IF NOT EXISTS device_ids JSONB;
+
+-- версия/канал на устройството преди rollout-а да го докосне (за rollback)
+CREATE TABLE IF NOT EXISTS rollout_snapshots (
+    rollout_id   TEXT NOT NULL REFERENCES rollouts(id) ON DELETE CASCADE,
+    device_id    TEXT NOT NULL,
+    prev_version TEXT,
+    prev_channel TEXT,
+    taken_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    restored_at  TIMESTAMPTZ NULL,
+    PRIMARY KEY (rollout_id, device_id)
+);
+
+-- резултат за всяко устройство във всяка вълна
+CREATE TABLE IF NOT EXISTS rollout_targets (
+    rollout_id   TEXT NOT NULL REFERENCES rollouts(id) ON DELETE CASCADE,
+    wave_index   INT  NOT NULL,
+    device_id    TEXT NOT NULL,
+    state        TEXT NOT NULL,
+    reason       TEXT,
+    prev_version TEXT,
+    new_version  TEXT,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (rollout_id, wave_index, device_id)
+);
+CREATE INDEX IF NOT EXISTS idx_rollout_targets_device ON rollout_targets(device_id);
 `
     _, err := s.pool.Exec(ctx, sql)
     return err
@@ -29,29 +56,15 @@ CREATE INDEX IF NOT EXISTS idx_rollout_runs_ro_wave ON rollout_runs(rollout_id,
 
 // GetRollout връща един rollout по ID.
 func (s *Store) GetRollout(ctx context.Context, id string) (Rollout, error) {
-    var out Rollout
     if s == nil || !s.Enabled {
-        return out, ErrStoreDisabled
+        return Rollout{}, ErrStoreDisabled
     }
-    var selBytes []byte
-    // Включваме created_at; finished_at е по желание (може да липсва в модела)
-    err := s.pool.QueryRow(ctx, `
-        SELECT id, tenant, artifact, channel, selector, waves, status, created_at
+    row := s.pool.QueryRow(ctx, `
+        SELECT `+rolloutCols+`
         FROM rollouts
         WHERE id = $1
-    `, id).Scan(
-        &out.ID, &out.Tenant, &out.Artifact, &out.Channel,
-        &selBytes, &out.Waves, &out.Status, &out.CreatedAt,
-    )
-    if err != nil {
-        return Rollout{}, err
-    }
-    if len(selBytes) > 0 {
-        _ = json.Unmarshal(selBytes, &out.Selector)
-    } else if out.Selector == nil {
-        out.Selector = map[string]string{}
-    }
-    return out, nil
+    `, id)
+    return scanRollout(row)
 }
 
 // Лека помощна грешка за по-ясни съобщения.
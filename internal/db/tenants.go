@@ -0,0 +1,75 @@
+package db
+
+import (
+    "context"
+    "errors"
+    "time"
+)
+
+// Tenant-wide policy when a rollout overlaps a running one.
+const (
+    ConflictReject = "reject"
+    ConflictQueue  = "queue"
+)
+
+// TenantSettings holds per-tenant knobs. Tenants without a row get defaults.
+type TenantSettings struct {
+    Tenant          string    `json:"tenant"`
+    RolloutConflict string    `json:"rollout_conflict"` // reject|queue
+    UpdatedAt       time.Time `json:"updated_at,omitempty"`
+}
+
+// DefaultTenantSettings is what a tenant without stored settings gets.
+func DefaultTenantSettings(tenant string) TenantSettings {
+    return TenantSettings{Tenant: tenant, RolloutConflict: ConflictReject}
+}
+
+// MigrateTenants ensures the tenant_settings table exists.
+func (s *Store) MigrateTenants(ctx context.Context) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+    CREATE TABLE IF NOT EXISTS tenant_settings (
+        tenant TEXT PRIMARY KEY,
+        rollout_conflict TEXT NOT NULL DEFAULT 'reject',
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    );
+    `)
+    return err
+}
+
+// GetTenantSettings returns the stored settings or the defaults.
+func (s *Store) GetTenantSettings(ctx context.Context, tenant string) (TenantSettings, error) {
+    if s == nil || !s.Enabled {
+        return TenantSettings{}, errors.New("store disabled")
+    }
+    out := DefaultTenantSettings(tenant)
+    rows, err := s.pool.Query(ctx, `
+        SELECT tenant, rollout_conflict, updated_at FROM tenant_settings WHERE tenant = $1`, tenant)
+    if err != nil {
+        return out, err
+    }
+    defer rows.Close()
+    if rows.Next() {
+        if err := rows.Scan(&out.Tenant, &out.RolloutConflict, &out.UpdatedAt); err != nil {
+            return out, err
+        }
+    }
+    return out, rows.Err()
+}
+
+// PutTenantSettings inserts or replaces the tenant's settings.
+func (s *Store) PutTenantSettings(ctx context.Context, ts TenantSettings) error {
+    if s == nil || !s.Enabled {
+        return errors.New("store disabled")
+    }
+    _, err := s.pool.Exec(ctx, `
+        INSERT INTO tenant_settings (tenant, rollout_conflict, updated_at)
+        VALUES ($1,$2,now())
+        ON CONFLICT (tenant) DO UPDATE SET
+            rollout_conflict = EXCLUDED.rollout_conflict,
+            updated_at = now()`,
+        ts.Tenant, ts.RolloutConflict)
+    return err
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+    "encoding/json"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// WaveStep sizes one wave of a rollout: either a fixed device count for that
+// wave, or a cumulative percentage of the matched fleet ("25%" means that
+// after this wave at least a quarter of all devices have been targeted).
+type WaveStep struct {
+    Count   int     `json:"-"`
+    Percent float64 `json:"-"`
+}
+
+// WavePlan is an explicit wave plan, e.g. [1, "5%", "25%", "100%"]. The last
+// step is always "100%", so every matched device is targeted.
+type WavePlan []WaveStep
+
+// UnmarshalJSON accepts a number (count) or a string "N" / "N%".
+func (w *WaveStep) UnmarshalJSON(b []byte) error {
+    var n int
+    if err := json.Unmarshal(b, &n); err == nil {
+        *w = WaveStep{Count: n}
+        return nil
+    }
+    var s string
+    if err := json.Unmarshal(b, &s); err != nil {
+        return fmt.Errorf("wave step must be a count or a percentage string: %s", b)
+    }
+    s = strings.TrimSpace(s)
+    if strings.HasSuffix(s, "%") {
+        p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+        if err != nil {
+            return fmt.Errorf("bad wave step %q", s)
+        }
+        *w = WaveStep{Percent: p}
+        return nil
+    }
+    n, err := strconv.Atoi(s)
+    if err != nil {
+        return fmt.Errorf("bad wave step %q", s)
+    }
+    *w = WaveStep{Count: n}
+    return nil
+}
+
+// MarshalJSON writes counts as numbers and percentages as "N%".
+func (w WaveStep) MarshalJSON() ([]byte, error) {
+    if w.Percent > 0 {
+        return json.Marshal(strconv.FormatFloat(w.Percent, 'f', -1, 64) + "%")
+    }
+    return json.Marshal(w.Count)
+}
+
+// Validate checks that every step is a positive count or a percentage in
+// (0,100], that percentages grow from step to step, that nothing follows
+// "100%" and that the plan ends with "100%"; a plan ending short would
+// leave the rest of the fleet untouched while the rollout still completes.
+// Steps that could not take a device would run as empty waves.
+func (p WavePlan) Validate() error {
+    if len(p) > 0 && p[len(p)-1].Percent != 100 {
+        return fmt.Errorf("last wave must be \"100%%\" so every matched device is targeted")
+    }
+    prev := 0.0 // cumulative percentage reached so far
+    for i, st := range p {
+        switch {
+        case prev >= 100:
+            return fmt.Errorf("wave %d: nothing is left after \"100%%\"", i+1)
+        case st.Percent > 0:
+            if st.Percent > 100 {
+                return fmt.Errorf("wave %d: percentage above 100", i+1)
+            }
+            if st.Percent <= prev {
+                return fmt.Errorf("wave %d: %s%% does not grow past the previous %s%%", i+1,
+                    strconv.FormatFloat(st.Percent, 'f', -1, 64), strconv.FormatFloat(prev, 'f', -1, 64))
+            }
+            prev = st.Percent
+        case st.Count < 1:
+            return fmt.Errorf("wave %d: count must be >= 1", i+1)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,91 @@
+package installer
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+var timeNow = time.Now
+
+// fileInstaller writes the artifact to a single file (e.g. a config bundle or
+// a static binary). Every version is kept as <path>.versions/<version>; the
+// target is replaced by copy + rename.
+type fileInstaller struct {
+    source string
+    path   string
+    client *http.Client
+}
+
+func (f *fileInstaller) versionsDir() string { return f.path + ".versions" }
+
+func (f *fileInstaller) Install(ctx context.Context, a Artifact) error {
+    if err := os.MkdirAll(f.versionsDir(), 0o755); err != nil {
+        return err
+    }
+    stored := filepath.Join(f.versionsDir(), dirName(a.Version))
+    if _, err := os.Stat(stored); err != nil {
+        rc, err := Open(ctx, f.client, expand(f.source, a))
+        if err != nil {
+            return err
+        }
+        err = writeAtomic(stored, rc)
+        rc.Close()
+        if err != nil {
+            return err
+        }
+    }
+    return f.Activate(ctx, a)
+}
+
+func (f *fileInstaller) Activate(ctx context.Context, a Artifact) error {
+    stored := filepath.Join(f.versionsDir(), dirName(a.Version))
+    src, err := os.Open(stored)
+    if err != nil {
+        return fmt.Errorf("version %s not installed", a.Version)
+    }
+    defer src.Close()
+    if err := writeAtomic(f.path, src); err != nil {
+        return err
+    }
+    _ = os.Chtimes(stored, timeNow(), timeNow())
+    return nil
+}
+
+func (f *fileInstaller) Prune(keep int) error {
+    // the newest stored version is the active one (Activate touches it)
+    return pruneDir(f.versionsDir(), "", keep)
+}
+
+// writeAtomic writes r to a temp file next to path and renames it over path.
+func writeAtomic(path string, r io.Reader) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := io.Copy(tmp, r); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if fi, err := os.Stat(path); err == nil {
+        _ = os.Chmod(tmp.Name(), fi.Mode())
+    } else {
+        _ = os.Chmod(tmp.Name(), 0o755)
+    }
+    return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,19 @@
+package installer
+
+import "context"
+
+// hookInstaller delegates to a shell command. It keeps nothing on disk itself,
+// so Activate simply runs the hook for the older version.
+type hookInstaller struct {
+    cmd string
+}
+
+func (h *hookInstaller) Install(ctx context.Context, a Artifact) error {
+    return runShell(ctx, h.cmd, a, nil)
+}
+
+func (h *hookInstaller) Activate(ctx context.Context, a Artifact) error {
+    return runShell(ctx, h.cmd, a, []string{"XDP47_ROLLBACK=1"})
+}
+
+func (h *hookInstaller) Prune(keep int) error { return nil }
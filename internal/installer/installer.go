@@ -0,0 +1,178 @@
+// Package installer puts artifact versions on an agent's disk and switches
+// between them. Drivers: "hook" (shell command), "tarball" (unpack into a
+// versioned directory, flip a `current` symlink) and "file" (write one file).
+package installer
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "os/exec"
+    "strings"
+    "time"
+)
+
+const (
+    DriverHook    = "hook"
+    DriverTarball = "tarball"
+    DriverFile    = "file"
+)
+
+// Artifact is one version the control plane asks for.
+type Artifact struct {
+    Version string
+    Channel string
+}
+
+// Installer installs and activates artifact versions.
+type Installer interface {
+    // Install fetches a and makes it the active version. On error the
+    // previously active version stays active.
+    Install(ctx context.Context, a Artifact) error
+    // Activate switches back to a version installed earlier.
+    Activate(ctx context.Context, a Artifact) error
+    // Prune removes all but the newest keep versions; the active one is always kept.
+    Prune(keep int) error
+}
+
+// Config selects and configures a driver.
+type Config struct {
+    Driver string // hook|tarball|file
+    Hook   string // hook: sh command; gets XDP47_DESIRED_VERSION/_CHANNEL
+    Source string // tarball/file: URL or path; {version} and {channel} are expanded
+    Root   string // tarball: directory with versions/ and current; file: target file
+    Client *http.Client // tarball/file: for http(s) sources; nil = http.DefaultClient
+}
+
+// New returns the driver named in cfg.
+func New(cfg Config) (Installer, error) {
+    switch cfg.Driver {
+    case DriverHook:
+        if cfg.Hook == "" {
+            return nil, errors.New("hook installer: command required")
+        }
+        return &hookInstaller{cmd: cfg.Hook}, nil
+    case DriverTarball:
+        if cfg.Source == "" || cfg.Root == "" {
+            return nil, errors.New("tarball installer: source and root required")
+        }
+        return &tarballInstaller{source: cfg.Source, root: cfg.Root, client: cfg.Client}, nil
+    case DriverFile:
+        if cfg.Source == "" || cfg.Root == "" {
+            return nil, errors.New("file installer: source and root required")
+        }
+        return &fileInstaller{source: cfg.Source, path: cfg.Root, client: cfg.Client}, nil
+    }
+    return nil, fmt.Errorf("unknown installer %q (want hook|tarball|file)", cfg.Driver)
+}
+
+// ErrUnhealthy is returned by Apply when the new version failed its health check
+// and the previous one was re-activated.
+var ErrUnhealthy = errors.New("health check failed; rolled back")
+
+// ErrUnhealthyNoPrevious is returned by Apply when the first version installed
+// failed its health check. There is nothing to go back to, so it stays active.
+var ErrUnhealthyNoPrevious = errors.New("health check failed; no previous version, new one stays active")
+
+// Health is the post-install check: a shell command that must exit 0
+// within Timeout. An empty command always passes.
+type Health struct {
+    Cmd     string
+    Timeout time.Duration
+}
+
+func (h Health) check(ctx context.Context, a Artifact) error {
+    if h.Cmd == "" {
+        return nil
+    }
+    if h.Timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+        defer cancel()
+    }
+    return runShell(ctx, h.Cmd, a, nil)
+}
+
+// Apply installs to, runs the health check and, when it fails, re-activates
+// from on its own. Afterwards only the newest keep versions are left on disk.
+func Apply(ctx context.Context, inst Installer, from, to Artifact, health Health, keep int) error {
+    if err := inst.Install(ctx, to); err != nil {
+        return fmt.Errorf("install %s: %w", to.Version, err)
+    }
+    if err := health.check(ctx, to); err != nil {
+        if from.Version == "" {
+            return fmt.Errorf("%w: %v", ErrUnhealthyNoPrevious, err)
+        }
+        if rerr := inst.Activate(ctx, from); rerr != nil {
+            return fmt.Errorf("health check failed: %v; rollback to %s: %w", err, from.Version, rerr)
+        }
+        return fmt.Errorf("%w: %v", ErrUnhealthy, err)
+    }
+    if keep > 0 {
+        if err := inst.Prune(keep); err != nil {
+            return fmt.Errorf("prune: %w", err)
+        }
+    }
+    return nil
+}
+
+func runShell(ctx context.Context, command string, a Artifact, extra []string) error {
+    cmd := exec.CommandContext(ctx, "sh", "-c", command)
+    cmd.Env = append(os.Environ(),
+        "XDP47_DESIRED_VERSION="+a.Version,
+        "XDP47_DESIRED_CHANNEL="+a.Channel,
+    )
+    cmd.Env = append(cmd.Env, extra...)
+    if out, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+    }
+    return nil
+}
+
+// expand fills {version} and {channel} in a source template.
+func expand(src string, a Artifact) string {
+    return strings.NewReplacer("{version}", a.Version, "{channel}", a.Channel).Replace(src)
+}
+
+// Open returns the artifact stream for an http(s) URL, file:// URL or path.
+// URLs are fetched with client (nil = http.DefaultClient); ctx bounds the
+// whole download, so callers should give it a deadline.
+func Open(ctx context.Context, client *http.Client, src string) (io.ReadCloser, error) {
+    if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+        if err != nil {
+            return nil, err
+        }
+        if client == nil {
+            client = http.DefaultClient
+        }
+        resp, err := client.Do(req)
+        if err != nil {
+            return nil, err
+        }
+        if resp.StatusCode != http.StatusOK {
+            resp.Body.Close()
+            return nil, fmt.Errorf("GET %s: %s", src, resp.Status)
+        }
+        return resp.Body, nil
+    }
+    return os.Open(strings.TrimPrefix(src, "file://"))
+}
+
+// dirName turns a version such as "app:v2.1.2" into a safe directory name.
+func dirName(version string) string {
+    b := []byte(version)
+    for i, c := range b {
+        ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_'
+        if !ok {
+            b[i] = '_'
+        }
+    }
+    if s := string(b); s != "" && s != "." && s != ".." {
+        return s
+    }
+    return "_"
+}
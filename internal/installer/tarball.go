@@ -0,0 +1,217 @@
+package installer
+
+import (
+    "archive/tar"
+    "compress/gzip"
+    "context"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// tarballInstaller unpacks each version into <root>/versions/<version> and
+// points <root>/current at the active one. The symlink is replaced with a
+// rename, so readers never see a half-switched tree.
+type tarballInstaller struct {
+    source string
+    root   string
+    client *http.Client
+}
+
+func (t *tarballInstaller) versionsDir() string { return filepath.Join(t.root, "versions") }
+
+func (t *tarballInstaller) Install(ctx context.Context, a Artifact) error {
+    dir := filepath.Join(t.versionsDir(), dirName(a.Version))
+    if _, err := os.Stat(dir); err != nil {
+        if err := os.MkdirAll(t.versionsDir(), 0o755); err != nil {
+            return err
+        }
+        tmp, err := os.MkdirTemp(t.versionsDir(), ".staging-")
+        if err != nil {
+            return err
+        }
+        defer os.RemoveAll(tmp)
+        rc, err := Open(ctx, t.client, expand(t.source, a))
+        if err != nil {
+            return err
+        }
+        err = untar(rc, tmp)
+        rc.Close()
+        if err != nil {
+            return err
+        }
+        if err := os.Rename(tmp, dir); err != nil {
+            return err
+        }
+    }
+    return t.Activate(ctx, a)
+}
+
+func (t *tarballInstaller) Activate(ctx context.Context, a Artifact) error {
+    target := filepath.Join("versions", dirName(a.Version))
+    if _, err := os.Stat(filepath.Join(t.root, target)); err != nil {
+        return fmt.Errorf("version %s not installed", a.Version)
+    }
+    link := filepath.Join(t.root, "current")
+    tmp := link + ".tmp"
+    _ = os.Remove(tmp)
+    if err := os.Symlink(target, tmp); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, link); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    // touch, so Prune sees the most recently active versions as newest
+    _ = os.Chtimes(filepath.Join(t.root, target), timeNow(), timeNow())
+    return nil
+}
+
+func (t *tarballInstaller) Prune(keep int) error {
+    active, _ := os.Readlink(filepath.Join(t.root, "current"))
+    return pruneDir(t.versionsDir(), filepath.Base(active), keep)
+}
+
+// untar extracts a gzip'ed tar into dir, refusing entries that escape it.
+// Symlinks must be relative and must not contain "..", and nothing is
+// created through a symlink, so a chain of links cannot point a later entry
+// outside dir.
+func untar(r io.Reader, dir string) error {
+    gz, err := gzip.NewReader(r)
+    if err != nil {
+        return err
+    }
+    defer gz.Close()
+    tr := tar.NewReader(gz)
+    for {
+        h, err := tr.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        name := filepath.Clean(h.Name)
+        if filepath.IsAbs(name) || hasDotDot(name) {
+            return fmt.Errorf("tar entry %q escapes target", h.Name)
+        }
+        if name == "." {
+            continue
+        }
+        dst := filepath.Join(dir, name)
+        switch h.Typeflag {
+        case tar.TypeDir:
+            if err := mkdirNoLinks(dir, name); err != nil {
+                return fmt.Errorf("tar entry %q: %w", h.Name, err)
+            }
+        case tar.TypeReg:
+            if err := mkdirNoLinks(dir, filepath.Dir(name)); err != nil {
+                return fmt.Errorf("tar entry %q: %w", h.Name, err)
+            }
+            if fi, err := os.Lstat(dst); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+                return fmt.Errorf("tar entry %q: would write through a symlink", h.Name)
+            }
+            f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(h.Mode)&0o777)
+            if err != nil {
+                return err
+            }
+            _, err = io.Copy(f, tr)
+            if cerr := f.Close(); err == nil {
+                err = cerr
+            }
+            if err != nil {
+                return err
+            }
+        case tar.TypeSymlink:
+            if filepath.IsAbs(h.Linkname) || hasDotDot(filepath.ToSlash(h.Linkname)) {
+                return fmt.Errorf("tar symlink %q -> %q escapes target", h.Name, h.Linkname)
+            }
+            if err := mkdirNoLinks(dir, filepath.Dir(name)); err != nil {
+                return fmt.Errorf("tar entry %q: %w", h.Name, err)
+            }
+            if err := os.Symlink(h.Linkname, dst); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+// hasDotDot reports whether any element of the slash- or
+// separator-separated path p is "..".
+func hasDotDot(p string) bool {
+    for _, e := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == filepath.Separator }) {
+        if e == ".." {
+            return true
+        }
+    }
+    return false
+}
+
+// mkdirNoLinks creates the directories of rel under dir one component at a
+// time, failing if any of them already exists as a symlink or a non-directory.
+func mkdirNoLinks(dir, rel string) error {
+    p := dir
+    for _, e := range strings.Split(filepath.Clean(rel), string(filepath.Separator)) {
+        if e == "." || e == "" {
+            continue
+        }
+        p = filepath.Join(p, e)
+        fi, err := os.Lstat(p)
+        switch {
+        case os.IsNotExist(err):
+            if err := os.Mkdir(p, 0o755); err != nil {
+                return err
+            }
+        case err != nil:
+            return err
+        case fi.Mode()&os.ModeSymlink != 0:
+            return fmt.Errorf("%s is a symlink", e)
+        case !fi.IsDir():
+            return fmt.Errorf("%s is not a directory", e)
+        }
+    }
+    return nil
+}
+
+// pruneDir removes entries of dir beyond the newest keep (by mtime), never
+// touching active or hidden staging entries.
+func pruneDir(dir, active string, keep int) error {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return err
+    }
+    type ver struct {
+        name string
+        mod  int64
+    }
+    var vs []ver
+    for _, e := range entries {
+        if strings.HasPrefix(e.Name(), ".") {
+            continue
+        }
+        info, err := e.Info()
+        if err != nil {
+            continue
+        }
+        vs = append(vs, ver{e.Name(), info.ModTime().UnixNano()})
+    }
+    sort.Slice(vs, func(i, j int) bool { return vs[i].mod > vs[j].mod })
+    kept := 0
+    for _, v := range vs {
+        if v.name == active || kept < keep {
+            kept++
+            continue
+        }
+        if err := os.RemoveAll(filepath.Join(dir, v.name)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
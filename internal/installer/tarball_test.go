@@ -0,0 +1,122 @@
+package installer
+
+import (
+    "archive/tar"
+    "bytes"
+    "compress/gzip"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// entry is one tar entry: a directory (name ends in /), a symlink (link set)
+// or a regular file.
+type entry struct {
+    name, link, body string
+}
+
+func tarball(t *testing.T, entries []entry) *bytes.Buffer {
+    t.Helper()
+    var buf bytes.Buffer
+    gz := gzip.NewWriter(&buf)
+    tw := tar.NewWriter(gz)
+    for _, e := range entries {
+        h := &tar.Header{Name: e.name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+        switch {
+        case e.link != "":
+            h.Typeflag, h.Linkname, h.Size = tar.TypeSymlink, e.link, 0
+        case e.name[len(e.name)-1] == '/':
+            h.Typeflag, h.Mode, h.Size = tar.TypeDir, 0o755, 0
+        }
+        if err := tw.WriteHeader(h); err != nil {
+            t.Fatal(err)
+        }
+        if h.Size > 0 {
+            if _, err := tw.Write([]byte(e.body)); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+    if err := tw.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if err := gz.Close(); err != nil {
+        t.Fatal(err)
+    }
+    return &buf
+}
+
+func TestUntar(t *testing.T) {
+    tests := []struct {
+        name    string
+        entries []entry
+        ok      bool
+    }{
+        {"plain", []entry{
+            {name: "bin/"},
+            {name: "bin/xdp47", body: "binary"},
+            {name: "bin/current", link: "xdp47"},
+            {name: "etc/conf", body: "x=1"},
+        }, true},
+        {"dot-dot entry", []entry{{name: "../evil", body: "x"}}, false},
+        {"dot-dot inside entry", []entry{{name: "a/../../evil", body: "x"}}, false},
+        {"absolute entry", []entry{{name: "/tmp/evil", body: "x"}}, false},
+        {"absolute symlink", []entry{{name: "etc", link: "/etc"}}, false},
+        {"dot-dot symlink", []entry{{name: "a/l", link: ".."}}, false},
+        {"symlink chain", []entry{
+            {name: "a/"},
+            {name: "a/l", link: ".."},
+            {name: "a/l/a/l/a/l/a/l/x", link: "../../../../etc"},
+            {name: "a/l/a/l/a/l/a/l/x/cron.d/evil", body: "* * * * * root sh"},
+        }, false},
+        {"file through in-tree symlink", []entry{
+            {name: "real/"},
+            {name: "l", link: "real"},
+            {name: "l/f", body: "x"},
+        }, false},
+        {"overwrite in-tree symlink", []entry{
+            {name: "real", body: "x"},
+            {name: "l", link: "real"},
+            {name: "l", body: "y"},
+        }, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            outside := t.TempDir()
+            dir := filepath.Join(outside, "stage")
+            if err := os.Mkdir(dir, 0o755); err != nil {
+                t.Fatal(err)
+            }
+            err := untar(tarball(t, tt.entries), dir)
+            if tt.ok && err != nil {
+                t.Fatalf("untar: %v", err)
+            }
+            if !tt.ok && err == nil {
+                t.Fatal("untar: want an error")
+            }
+            // nothing may land next to the staging directory
+            ents, err := os.ReadDir(outside)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(ents) != 1 {
+                t.Fatalf("untar wrote outside the target: %v", ents)
+            }
+        })
+    }
+}
+
+func TestUntarContents(t *testing.T) {
+    dir := t.TempDir()
+    err := untar(tarball(t, []entry{
+        {name: "bin/xdp47", body: "binary"},
+        {name: "bin/current", link: "xdp47"},
+    }), dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    b, err := os.ReadFile(filepath.Join(dir, "bin", "current"))
+    if err != nil || string(b) != "binary" {
+        t.Fatalf("bin/current = %q, %v; want %q", b, err, "binary")
+    }
+}
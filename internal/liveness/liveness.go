@@ -0,0 +1,62 @@
+// Package liveness derives device connectivity from heartbeats. A device is
+// online while its last heartbeat is younger than Stale, stale until it is
+// older than Offline, and offline after that (or if it never sent one).
+//
+// Run sweeps all devices periodically; every change is stored on the device
+// (connectivity, connectivity_since) and recorded as a connectivity_<state>
+// device event, so alerts and reports do not have to re-derive it.
+package liveness
+
+import (
+    "context"
+    "errors"
+    "log"
+    "time"
+
+    xdb "github.com/example/xdp47/internal/db"
+)
+
+type Options struct {
+    Stale   time.Duration // online -> stale after this long without a heartbeat (e.g. 1m)
+    Offline time.Duration // stale -> offline (e.g. 5m)
+    Every   time.Duration // how often devices are swept (e.g. 15s)
+}
+
+// Validate checks that the thresholds are ordered.
+func (o Options) Validate() error {
+    if o.Stale <= 0 || o.Offline <= o.Stale {
+        return errors.New("liveness thresholds must satisfy 0 < stale < offline")
+    }
+    if o.Every <= 0 {
+        return errors.New("liveness sweep interval must be > 0")
+    }
+    return nil
+}
+
+// Run sweeps every device each opt.Every until ctx is done.
+func Run(ctx context.Context, store *xdb.Store, opt Options) {
+    for {
+        SweepOnce(ctx, store, opt, "")
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(opt.Every):
+        }
+    }
+}
+
+// SweepOnce reclassifies all devices (id == "") or one and logs the
+// transitions. Errors are logged only; the next sweep retries.
+func SweepOnce(ctx context.Context, store *xdb.Store, opt Options, id string) {
+    changes, err := store.SweepConnectivity(ctx, time.Now().UTC(), opt.Stale, opt.Offline, id)
+    if err != nil {
+        log.Printf("[liveness] sweep: %v", err)
+        return
+    }
+    for _, c := range changes {
+        if c.From == "" {
+            continue // first classification, not worth a log line
+        }
+        log.Printf("[liveness] device %s: %s -> %s", c.DeviceID, c.From, c.To)
+    }
+}
@@ -0,0 +1,126 @@
+// Package planner decides which devices go into which wave of a rollout.
+// The scheduler, :simulate and :retry all use it, so a simulated plan is
+// exactly what runs.
+package planner
+
+import (
+    "hash/fnv"
+    "math"
+    "sort"
+
+    xdb "github.com/example/xdp47/internal/db"
+)
+
+// WaveCount is the number of waves a rollout runs.
+func WaveCount(rollout xdb.Rollout) int {
+    if len(rollout.Plan) > 0 {
+        return len(rollout.Plan)
+    }
+    if rollout.Waves <= 0 {
+        return 1
+    }
+    return rollout.Waves
+}
+
+// WaveSizes returns how many of total devices go into each wave. Without an
+// explicit plan the devices are split evenly over rollout.Waves. With a plan,
+// count steps take that many devices and percentage steps fill up to the
+// cumulative share (rounded up, so "5%" of a small fleet is still one device).
+func WaveSizes(rollout xdb.Rollout, total int) []int {
+    n := WaveCount(rollout)
+    sizes := make([]int, n)
+    if len(rollout.Plan) == 0 {
+        for i := range sizes {
+            sizes[i] = total / n
+            if i < total%n {
+                sizes[i]++
+            }
+        }
+        return sizes
+    }
+    done := 0
+    for i, st := range rollout.Plan {
+        want := st.Count
+        if st.Percent > 0 {
+            want = int(math.Ceil(float64(total)*st.Percent/100)) - done
+        }
+        if want < 0 {
+            want = 0
+        }
+        if done+want > total {
+            want = total - done
+        }
+        sizes[i] = want
+        done += want
+    }
+    return sizes
+}
+
+// Order sorts device IDs by a stable hash of (rollout ID, device ID). The
+// order does not depend on heartbeat timing or list order, and differs per
+// rollout so the same devices are not always the canaries.
+func Order(rolloutID string, ids []string) []string {
+    type keyed struct {
+        id string
+        h  uint64
+    }
+    ks := make([]keyed, len(ids))
+    for i, id := range ids {
+        f := fnv.New64a()
+        f.Write([]byte(rolloutID))
+        f.Write([]byte{0})
+        f.Write([]byte(id))
+        ks[i] = keyed{id: id, h: f.Sum64()}
+    }
+    sort.Slice(ks, func(i, j int) bool {
+        if ks[i].h == ks[j].h {
+            return ks[i].id < ks[j].id
+        }
+        return ks[i].h < ks[j].h
+    })
+    out := make([]string, len(ks))
+    for i, k := range ks {
+        out[i] = k.id
+    }
+    return out
+}
+
+// Plan assigns the matched devices to waves.
+func Plan(rollout xdb.Rollout, ids []string) [][]string {
+    return Resume(rollout, ids, nil, nil)
+}
+
+// Resume is Plan for a rollout that already finished some waves: finished
+// waves (done[i]) get no devices, and devices in handled are left out. The
+// remaining waves are filled in hash order up to their planned size, which is
+// computed over the whole matched fleet so the plan does not shrink.
+func Resume(rollout xdb.Rollout, ids []string, done []bool, handled map[string]bool) [][]string {
+    sizes := WaveSizes(rollout, len(ids))
+    var todo []string
+    for _, id := range Order(rollout.ID, ids) {
+        if !handled[id] {
+            todo = append(todo, id)
+        }
+    }
+    for wi := range sizes {
+        if wi < len(done) && done[wi] {
+            sizes[wi] = 0
+        }
+    }
+    return SplitWaves(todo, sizes)
+}
+
+// SplitWaves cuts ids into consecutive waves of the given sizes.
+func SplitWaves(ids []string, sizes []int) [][]string {
+    out := make([][]string, len(sizes))
+    pos := 0
+    for i, n := range sizes {
+        end := pos + n
+        if end > len(ids) {
+            end = len(ids)
+        }
+        out[i] = ids[pos:end]
+        pos = end
+    }
+    return out
+}
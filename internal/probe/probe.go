@@ -0,0 +1,338 @@
+// Package probe runs the agent's local health probes. Each probe runs on its
+// own interval; a probe counts as failing after FailureThreshold consecutive
+// failures, and the worst failing probe decides the device status.
+package probe
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "os/exec"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/example/xdp47/internal/collector"
+)
+
+const (
+    StatusOK   = "ok"
+    StatusWarn = "warn"
+    StatusCrit = "crit"
+)
+
+const (
+    TypeHTTP   = "http"
+    TypeTCP    = "tcp"
+    TypeExec   = "exec"
+    TypeMetric = "metric"
+)
+
+// Duration is a time.Duration written as "30s" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+    var s string
+    if err := json.Unmarshal(b, &s); err != nil {
+        return fmt.Errorf("duration must be a string like \"30s\"")
+    }
+    v, err := time.ParseDuration(s)
+    if err != nil {
+        return err
+    }
+    *d = Duration(v)
+    return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
+}
+
+// Spec configures one probe.
+type Spec struct {
+    Name     string `json:"name"`
+    Type     string `json:"type"`   // http|tcp|exec|metric
+    Target   string `json:"target"` // http: URL; tcp: host:port; exec: sh command; metric: path, e.g. "memory.used_percent", "disks./.used_percent"
+    Severity string `json:"severity,omitempty"` // http/tcp/exec: status when failing, warn|crit (default crit)
+    // metric: value >= Warn is warn, >= Crit is crit
+    Warn *float64 `json:"warn,omitempty"`
+    Crit *float64 `json:"crit,omitempty"`
+    // http: accepted status code; 0 = any 2xx
+    ExpectStatus     int      `json:"expect_status,omitempty"`
+    Interval         Duration `json:"interval,omitempty"`          // default 30s
+    Timeout          Duration `json:"timeout,omitempty"`           // default 5s
+    FailureThreshold int      `json:"failure_threshold,omitempty"` // consecutive failures; default 1
+}
+
+// Validate checks the spec and fills defaults.
+func (s *Spec) Validate() error {
+    if s.Name == "" {
+        return errors.New("probe name required")
+    }
+    switch s.Type {
+    case TypeHTTP, TypeTCP, TypeExec:
+        if s.Target == "" {
+            return fmt.Errorf("probe %s: target required", s.Name)
+        }
+        switch s.Severity {
+        case "":
+            s.Severity = StatusCrit
+        case StatusWarn, StatusCrit:
+        default:
+            return fmt.Errorf("probe %s: severity must be warn|crit", s.Name)
+        }
+    case TypeMetric:
+        if s.Target == "" {
+            return fmt.Errorf("probe %s: metric path required", s.Name)
+        }
+        if s.Warn == nil && s.Crit == nil {
+            return fmt.Errorf("probe %s: warn and/or crit threshold required", s.Name)
+        }
+    default:
+        return fmt.Errorf("probe %s: type must be http|tcp|exec|metric", s.Name)
+    }
+    if s.Interval <= 0 {
+        s.Interval = Duration(30 * time.Second)
+    }
+    if s.Timeout <= 0 {
+        s.Timeout = Duration(5 * time.Second)
+    }
+    if s.FailureThreshold <= 0 {
+        s.FailureThreshold = 1
+    }
+    return nil
+}
+
+// Parse reads a JSON array of specs and validates them.
+func Parse(b []byte) ([]Spec, error) {
+    var specs []Spec
+    if err := json.Unmarshal(b, &specs); err != nil {
+        return nil, err
+    }
+    seen := map[string]bool{}
+    for i := range specs {
+        if err := specs[i].Validate(); err != nil {
+            return nil, err
+        }
+        if seen[specs[i].Name] {
+            return nil, fmt.Errorf("duplicate probe %q", specs[i].Name)
+        }
+        seen[specs[i].Name] = true
+    }
+    return specs, nil
+}
+
+// Result is the latest outcome of one probe.
+type Result struct {
+    Name      string    `json:"name"`
+    Type      string    `json:"type"`
+    Status    string    `json:"status"`           // after FailureThreshold
+    Detail    string    `json:"detail,omitempty"` // why it failed
+    Failures  int       `json:"failures"`         // consecutive
+    CheckedAt time.Time `json:"checked_at"`
+}
+
+// Runner runs a set of probes.
+type Runner struct {
+    specs  []Spec
+    sample func() *collector.Metrics // latest host sample for metric probes
+
+    mu      sync.Mutex
+    results map[string]Result
+}
+
+// NewRunner returns a runner for validated specs. sample may return nil
+// while no metrics have been collected yet.
+func NewRunner(specs []Spec, sample func() *collector.Metrics) *Runner {
+    return &Runner{specs: specs, sample: sample, results: map[string]Result{}}
+}
+
+// Run starts every probe and blocks until ctx is done.
+func (r *Runner) Run(ctx context.Context) {
+    var wg sync.WaitGroup
+    for _, s := range r.specs {
+        wg.Add(1)
+        go func(s Spec) {
+            defer wg.Done()
+            t := time.NewTicker(time.Duration(s.Interval))
+            defer t.Stop()
+            for {
+                r.check(ctx, s)
+                select {
+                case <-ctx.Done():
+                    return
+                case <-t.C:
+                }
+            }
+        }(s)
+    }
+    wg.Wait()
+}
+
+func (r *Runner) check(ctx context.Context, s Spec) {
+    ctx, cancel := context.WithTimeout(ctx, time.Duration(s.Timeout))
+    defer cancel()
+    status, detail := r.probe(ctx, s)
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    res := r.results[s.Name]
+    res.Name, res.Type, res.CheckedAt = s.Name, s.Type, time.Now().UTC()
+    if status == StatusOK {
+        res.Failures, res.Status, res.Detail = 0, StatusOK, ""
+    } else {
+        res.Failures++
+        res.Detail = detail
+        if res.Failures >= s.FailureThreshold {
+            res.Status = status
+        } else if res.Status == "" {
+            res.Status = StatusOK
+        }
+    }
+    r.results[s.Name] = res
+}
+
+// probe runs s once and returns its raw status and failure detail.
+func (r *Runner) probe(ctx context.Context, s Spec) (string, string) {
+    switch s.Type {
+    case TypeHTTP:
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Target, nil)
+        if err != nil {
+            return s.Severity, err.Error()
+        }
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            return s.Severity, err.Error()
+        }
+        resp.Body.Close()
+        ok := resp.StatusCode >= 200 && resp.StatusCode < 300
+        if s.ExpectStatus != 0 {
+            ok = resp.StatusCode == s.ExpectStatus
+        }
+        if !ok {
+            return s.Severity, "GET " + s.Target + ": " + resp.Status
+        }
+    case TypeTCP:
+        var d net.Dialer
+        conn, err := d.DialContext(ctx, "tcp", s.Target)
+        if err != nil {
+            return s.Severity, err.Error()
+        }
+        conn.Close()
+    case TypeExec:
+        out, err := exec.CommandContext(ctx, "sh", "-c", s.Target).CombinedOutput()
+        if err != nil {
+            msg := strings.TrimSpace(string(out))
+            if len(msg) > 200 {
+                msg = msg[:200] + "..."
+            }
+            return s.Severity, strings.TrimSpace(err.Error() + ": " + msg)
+        }
+    case TypeMetric:
+        m := r.sample()
+        if m == nil {
+            return StatusOK, "" // nothing collected yet
+        }
+        v, err := Lookup(m, s.Target)
+        if err != nil {
+            return StatusWarn, err.Error()
+        }
+        if s.Crit != nil && v >= *s.Crit {
+            return StatusCrit, fmt.Sprintf("%s = %.2f >= %.2f", s.Target, v, *s.Crit)
+        }
+        if s.Warn != nil && v >= *s.Warn {
+            return StatusWarn, fmt.Sprintf("%s = %.2f >= %.2f", s.Target, v, *s.Warn)
+        }
+    }
+    return StatusOK, ""
+}
+
+// Status returns the worst probe status and the results of probes that are
+// not ok, in spec order.
+func (r *Runner) Status() (string, []Result) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    worst := StatusOK
+    var failing []Result
+    for _, s := range r.specs {
+        res, ok := r.results[s.Name]
+        if !ok || res.Status == StatusOK {
+            continue
+        }
+        failing = append(failing, res)
+        worst = Worst(worst, res.Status)
+    }
+    return worst, failing
+}
+
+// Results returns the latest result of every probe, in spec order. Probes
+// that have not run yet have an empty Status.
+func (r *Runner) Results() []Result {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    out := make([]Result, 0, len(r.specs))
+    for _, s := range r.specs {
+        res, ok := r.results[s.Name]
+        if !ok {
+            res = Result{Name: s.Name, Type: s.Type}
+        }
+        out = append(out, res)
+    }
+    return out
+}
+
+// Worst returns the more severe of two statuses.
+func Worst(a, b string) string {
+    rank := map[string]int{StatusOK: 0, StatusWarn: 1, StatusCrit: 2}
+    if rank[b] > rank[a] {
+        return b
+    }
+    return a
+}
+
+// Lookup resolves a dotted path in a metrics sample, e.g. "cpu.usage_percent",
+// "pressure.io.some.avg10" or "disks./.used_percent" (disks are keyed by path).
+func Lookup(m *collector.Metrics, path string) (float64, error) {
+    b, err := json.Marshal(m)
+    if err != nil {
+        return 0, err
+    }
+    var cur any
+    if err := json.Unmarshal(b, &cur); err != nil {
+        return 0, err
+    }
+    for _, seg := range strings.Split(path, ".") {
+        switch v := cur.(type) {
+        case map[string]any:
+            cur = v[seg]
+        case []any:
+            var next any
+            for _, el := range v {
+                if obj, ok := el.(map[string]any); ok && obj["path"] == seg {
+                    next = obj
+                    break
+                }
+            }
+            if next == nil {
+                if i, err := strconv.Atoi(seg); err == nil && i >= 0 && i < len(v) {
+                    next = v[i]
+                }
+            }
+            cur = next
+        default:
+            cur = nil
+        }
+        if cur == nil {
+            return 0, fmt.Errorf("metric %s not found", path)
+        }
+    }
+    f, ok := cur.(float64)
+    if !ok {
+        return 0, fmt.Errorf("metric %s is not a number", path)
+    }
+    return f, nil
+}
@@ -0,0 +1,56 @@
+package scheduler
+
+import (
+    "context"
+
+    xdb "github.com/example/xdp47/internal/db"
+)
+
+// Agent rollouts (artifact "xdp47-agent:<version>") go through the same waves,
+// windows, bake and rollback as any other rollout; they only change which
+// device fields are set and checked. The helpers below hide the difference.
+
+// TargetVersion is the version the rollout asks devices to run: the artifact,
+// or for an agent rollout the agent version.
+func TargetVersion(rollout xdb.Rollout) string {
+    if v, ok := xdb.AgentArtifact(rollout.Artifact); ok {
+        return v
+    }
+    return rollout.Artifact
+}
+
+// Current returns what the rollout would replace on dv. For agent rollouts
+// that is the desired agent version, or the one the device reports when none
+// was ever set, so a rollback returns it to the binary it actually ran.
+func Current(rollout xdb.Rollout, dv xdb.Device) (version, channel string) {
+    if _, ok := xdb.AgentArtifact(rollout.Artifact); ok {
+        if dv.AgentVersion != "" {
+            return dv.AgentVersion, ""
+        }
+        return dv.ReportedAgentVersion, ""
+    }
+    return dv.Version, dv.Channel
+}
+
+// reported is the version dv says it runs, as compared during bake.
+func reported(rollout xdb.Rollout, dv xdb.Device) string {
+    if _, ok := xdb.AgentArtifact(rollout.Artifact); ok {
+        return dv.ReportedAgentVersion
+    }
+    return dv.ReportedVersion
+}
+
+// applyTo sets version/channel on a device, or only the agent version for an
+// agent rollout.
+func applyTo(ctx context.Context, store *xdb.Store, rollout xdb.Rollout, deviceID, version, channel string) error {
+    if _, ok := xdb.AgentArtifact(rollout.Artifact); ok {
+        return store.ApplyAgentVersion(ctx, deviceID, version)
+    }
+    return store.ApplyVersionChannel(ctx, deviceID, version, channel)
+}
+
+// snapshot records what the rollout is about to replace on dv (for rollback).
+func snapshot(ctx context.Context, store *xdb.Store, rollout xdb.Rollout, dv xdb.Device) error {
+    dv.Version, dv.Channel = Current(rollout, dv)
+    return store.SnapshotDevice(ctx, rollout.ID, dv)
+}
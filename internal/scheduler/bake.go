@@ -0,0 +1,84 @@
+package scheduler
+
+import (
+    "context"
+    "fmt"
+    "time"
+
+    xdb "github.com/example/xdp47/internal/db"
+)
+
+// bakeWave watches the devices applied in a wave for the bake period.
+// A device passes when, after appliedAt, it heartbeats with the rollout's
+// artifact (see TargetVersion) as its version and status "ok", never reports "crit" afterwards,
+// and is still ok and online when the period ends. It returns the devices
+// that did not pass, with a reason.
+func bakeWave(ctx context.Context, store *xdb.Store, rollout xdb.Rollout, devs []xdb.Device, appliedAt time.Time, bake time.Duration, opt Options) (map[string]string, error) {
+    poll := opt.BakePoll
+    if poll <= 0 {
+        poll = 5 * time.Second
+    }
+    ids := make([]string, 0, len(devs))
+    for _, d := range devs {
+        ids = append(ids, d.ID)
+    }
+
+    want := TargetVersion(rollout)
+    confirmed := map[string]bool{}
+    crit := map[string]bool{}
+    deadline := time.Now().Add(bake)
+    var cur []xdb.Device
+    for {
+        var err error
+        cur, err = store.GetDevicesByIDs(ctx, ids)
+        if err != nil {
+            return nil, err
+        }
+        for _, d := range cur {
+            if !d.LastSeen.After(appliedAt) {
+                continue
+            }
+            if reported(rollout, d) == want && d.Status == "ok" {
+                confirmed[d.ID] = true
+            } else if confirmed[d.ID] && d.Status == "crit" {
+                crit[d.ID] = true
+            }
+        }
+
+        left := time.Until(deadline)
+        if left <= 0 {
+            break
+        }
+        if left > poll {
+            left = poll
+        }
+        select {
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        case <-time.After(left):
+        }
+    }
+
+    bad := map[string]string{}
+    seen := map[string]bool{}
+    for _, d := range cur {
+        seen[d.ID] = true
+        switch {
+        case !confirmed[d.ID]:
+            bad[d.ID] = fmt.Sprintf("did not report version %s with status ok (reported=%q, status=%s)",
+                want, reported(rollout, d), d.Status)
+        case crit[d.ID]:
+            bad[d.ID] = "reported crit during bake"
+        case time.Since(d.LastSeen) > opt.HeartbeatGrace:
+            bad[d.ID] = "offline at end of bake"
+        case d.Status != "ok":
+            bad[d.ID] = "status=" + d.Status + " at end of bake"
+        }
+    }
+    for _, id := range ids {
+        if !seen[id] {
+            bad[id] = "device disappeared during bake"
+        }
+    }
+    return bad, nil
+}
@@ -0,0 +1,49 @@
+package scheduler
+
+import (
+    "context"
+    "errors"
+    "log"
+    "time"
+
+    xdb "github.com/example/xdp47/internal/db"
+)
+
+// errCancelled is returned by gate once an operator has cancelled the rollout.
+var errCancelled = errors.New("rollout cancelled")
+
+// gate blocks while the rollout is paused and returns errCancelled when it has
+// been cancelled. Status lives in the rollouts table, so pause/resume/cancel
+// work from any control-plane instance.
+func gate(ctx context.Context, store *xdb.Store, rolloutID string, opt Options) error {
+    poll := opt.ControlPoll
+    if poll <= 0 {
+        poll = 2 * time.Second
+    }
+    paused := false
+    for {
+        ro, err := store.GetRollout(ctx, rolloutID)
+        if err != nil {
+            return err
+        }
+        switch ro.Status {
+        case "cancelled":
+            return errCancelled
+        case "paused":
+            if !paused {
+                log.Printf("[sched] rollout %s: paused", rolloutID)
+                paused = true
+            }
+            select {
+            case <-ctx.Done():
+                return ctx.Err()
+            case <-time.After(poll):
+            }
+        default:
+            if paused {
+                log.Printf("[sched] rollout %s: resumed", rolloutID)
+            }
+            return nil
+        }
+    }
+}
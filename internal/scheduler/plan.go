@@ -0,0 +1,111 @@
+package scheduler
+
+import (
+    "context"
+    "encoding/json"
+    "strings"
+    "time"
+
+    xdb "github.com/example/xdp47/internal/db"
+    "github.com/example/xdp47/internal/planner"
+)
+
+// RolloutPlan is what StartRollout would run for a rollout right now.
+type RolloutPlan struct {
+    Devices []xdb.Device // devices matching tenant + selector
+    Waves   [][]string   // device IDs per wave; finished waves are empty
+    Done    []bool       // waves already finished (completed/partial)
+    Handled int          // devices covered by finished waves
+    Started bool         // the rollout has history in rollout_runs
+}
+
+// PlanRollout matches the rollout's devices and assigns them to waves,
+// taking already finished waves from rollout_runs into account. Both the
+// scheduler and :simulate use it.
+func PlanRollout(ctx context.Context, store *xdb.Store, rollout xdb.Rollout) (RolloutPlan, error) {
+    var p RolloutPlan
+    devs, err := store.FilterDevicesBySelector(ctx, rollout.Tenant, rollout.Selector)
+    if err != nil {
+        return p, err
+    }
+    history, err := store.ListRolloutRuns(ctx, rollout.ID)
+    if err != nil {
+        return p, err
+    }
+    waves := planner.WaveCount(rollout)
+
+    done := make([]bool, waves)
+    handled := map[string]bool{}
+    for _, run := range history {
+        if !run.Done() || run.WaveIndex < 1 || run.WaveIndex > waves {
+            continue
+        }
+        done[run.WaveIndex-1] = true
+        for _, id := range run.DeviceIDs {
+            handled[id] = true
+        }
+    }
+    p.Devices = devs
+    p.Waves = planner.Resume(rollout, p.DeviceIDs(), done, handled)
+    p.Done = done
+    p.Handled = len(handled)
+    p.Started = len(history) > 0
+    return p, nil
+}
+
+// DeviceIDs returns the IDs of all matched devices.
+func (p RolloutPlan) DeviceIDs() []string {
+    ids := make([]string, 0, len(p.Devices))
+    for _, d := range p.Devices {
+        ids = append(ids, d.ID)
+    }
+    return ids
+}
+
+// Outcome is the pre-apply verdict for one device.
+type Outcome struct {
+    State   string // xdb.TargetApplied, TargetSkippedCordoned, TargetSkippedOffline or TargetFailedStatus
+    Failure bool   // counts against the wave
+    Reason  string
+}
+
+// Classify decides, from the device's cordon and last heartbeat, whether the
+// scheduler applies to it, skips it as cordoned or offline
+// (HeartbeatGrace/SkipOffline) or fails it on status (RequireOK).
+func Classify(dv xdb.Device, opt Options, now time.Time) Outcome {
+    if c := dv.Cordon; c != nil {
+        reason := "cordoned by " + c.By
+        if c.Drain {
+            reason = "drained by " + c.By
+        }
+        if c.Reason != "" {
+            reason += ": " + c.Reason
+        }
+        return Outcome{State: xdb.TargetSkippedCordoned, Reason: reason}
+    }
+    if dv.LastSeen.IsZero() || now.Sub(dv.LastSeen) > opt.HeartbeatGrace {
+        if opt.SkipOffline {
+            return Outcome{State: xdb.TargetSkippedOffline, Reason: "no heartbeat within grace"}
+        }
+        return Outcome{State: xdb.TargetSkippedOffline, Failure: true, Reason: "no heartbeat within grace; counted as failure"}
+    }
+    if opt.RequireOK && dv.Status != "ok" {
+        return Outcome{State: xdb.TargetFailedStatus, Failure: true, Reason: "status=" + dv.Status + failingProbes(dv)}
+    }
+    return Outcome{State: xdb.TargetApplied}
+}
+
+// failingProbes names the agent probes behind a non-ok status, e.g. " (kiosk-ui, disk-root)".
+func failingProbes(dv xdb.Device) string {
+    var probes []struct {
+        Name string `json:"name"`
+    }
+    if len(dv.Probes) == 0 || json.Unmarshal(dv.Probes, &probes) != nil || len(probes) == 0 {
+        return ""
+    }
+    names := make([]string, len(probes))
+    for i, p := range probes {
+        names[i] = p.Name
+    }
+    return " (" + strings.Join(names, ", ") + ")"
+}
@@ -0,0 +1,93 @@
+package scheduler
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "time"
+
+    xdb "github.com/example/xdp47/internal/db"
+)
+
+// Rollback policies. A rollout may set its own; otherwise Options.Rollback applies.
+const (
+    RollbackOff       = "off"        // never roll back
+    RollbackOnFailed  = "on_failed"  // roll back when a wave fails
+    RollbackOnPartial = "on_partial" // roll back when a wave fails or ends partial
+)
+
+// ValidRollbackPolicy reports whether p is a known policy ("" means default).
+func ValidRollbackPolicy(p string) bool {
+    switch p {
+    case "", RollbackOff, RollbackOnFailed, RollbackOnPartial:
+        return true
+    }
+    return false
+}
+
+// shouldRollback decides whether a wave that ended with waveStatus triggers a rollback.
+func shouldRollback(rollout xdb.Rollout, opt Options, waveStatus string) bool {
+    policy := rollout.Rollback
+    if policy == "" {
+        policy = opt.Rollback
+    }
+    switch policy {
+    case RollbackOnFailed:
+        return waveStatus == "failed"
+    case RollbackOnPartial:
+        return waveStatus == "failed" || waveStatus == "partial"
+    }
+    return false
+}
+
+// rollback returns every device the rollout touched to the version/channel
+// recorded before apply. Progress is kept in rollout_snapshots, so an
+// interrupted rollback is resumed (status "rolling_back") after a restart.
+func rollback(ctx context.Context, store *xdb.Store, rollout xdb.Rollout, reason string) error {
+    ok, err := store.TransitionRolloutStatus(ctx, rollout.ID, []string{"running", "paused", "rolling_back"}, "rolling_back")
+    if err != nil {
+        return err
+    }
+    if !ok {
+        log.Printf("[sched] rollout %s: not rolling back (status changed)", rollout.ID)
+        return nil
+    }
+    log.Printf("[sched] rollout %s: ROLLBACK (%s)", rollout.ID, reason)
+
+    snaps, err := store.ListSnapshots(ctx, rollout.ID, false)
+    if err != nil {
+        return err
+    }
+    ids := make([]string, 0, len(snaps))
+    for _, sn := range snaps {
+        ids = append(ids, sn.DeviceID)
+    }
+    runID := fmt.Sprintf("rollback-%s", rollout.ID)
+    now := time.Now().UTC()
+    _ = store.InsertRolloutRun(ctx, runID, rollout.ID, 0, ids, "rolling_back", &now)
+
+    failed := 0
+    for _, sn := range snaps {
+        if sn.RestoredAt != nil {
+            continue
+        }
+        if err := applyTo(ctx, store, rollout, sn.DeviceID, sn.PrevVersion, sn.PrevChannel); err != nil {
+            failed++
+            log.Printf("[sched] rollout %s: device %s ROLLBACK ERROR: %v", rollout.ID, sn.DeviceID, err)
+            continue
+        }
+        _ = store.MarkSnapshotRestored(ctx, rollout.ID, sn.DeviceID, time.Now().UTC())
+        _ = store.MarkTargetsRolledBack(ctx, rollout.ID, sn.DeviceID, "rollback: "+reason)
+        log.Printf("[sched] rollout %s: device %s ROLLED BACK (version=%s, channel=%s)",
+            rollout.ID, sn.DeviceID, sn.PrevVersion, sn.PrevChannel)
+    }
+
+    if failed > 0 {
+        _ = store.CompleteRolloutRun(ctx, runID, "partial", time.Now().UTC())
+        _, _ = store.TransitionRolloutStatus(ctx, rollout.ID, []string{"rolling_back"}, "failed")
+        return nil
+    }
+    _ = store.CompleteRolloutRun(ctx, runID, "rolled_back", time.Now().UTC())
+    _, _ = store.TransitionRolloutStatus(ctx, rollout.ID, []string{"rolling_back"}, "rolled_back")
+    return nil
+}
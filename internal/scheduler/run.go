@@ -0,0 +1,164 @@
+package scheduler
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "sync"
+    "time"
+
+    xdb "github.com/example/xdp47/internal/db"
+)
+
+// leaseTTL is how long a rollout stays owned by an instance that stopped renewing.
+const leaseTTL = 30 * time.Second
+
+// instanceID identifies this control-plane process as a lease owner.
+var instanceID = func() string {
+    host, _ := os.Hostname()
+    return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+}()
+
+// running guards against two goroutines of this process executing one rollout;
+// the lease in the rollouts table does the same across instances.
+var running = struct {
+    sync.Mutex
+    ids map[string]bool
+}{ids: map[string]bool{}}
+
+// Begin claims the rollout's devices (see Store.ClaimRolloutStart) and, when
+// it ends up "running", executes it in the background. With queue the
+// rollout is queued instead of rejected if it overlaps a running one; the
+// supervisor starts it once the overlap is gone.
+func Begin(ctx context.Context, store *xdb.Store, rollout xdb.Rollout, opt Options, queue bool) (string, error) {
+    if store == nil || !store.Enabled {
+        return "", fmt.Errorf("scheduler requires db store")
+    }
+    p, err := PlanRollout(ctx, store, rollout)
+    if err != nil {
+        return "", err
+    }
+    status, err := store.ClaimRolloutStart(ctx, rollout.ID, p.DeviceIDs(), queue)
+    if err != nil {
+        return "", err
+    }
+    if status == "running" {
+        rollout.Status = status
+        go func() {
+            if err := Run(context.Background(), store, rollout, opt); err != nil {
+                log.Printf("[sched] rollout %s: %v", rollout.ID, err)
+            }
+        }()
+    } else {
+        log.Printf("[sched] rollout %s: %s behind overlapping rollouts", rollout.ID, status)
+    }
+    return status, nil
+}
+
+// Run executes the rollout unless another goroutine or control-plane
+// instance already does. The lease is renewed while the rollout runs; if it
+// is lost, execution stops and whoever holds the lease continues.
+func Run(ctx context.Context, store *xdb.Store, rollout xdb.Rollout, opt Options) error {
+    running.Lock()
+    if running.ids[rollout.ID] {
+        running.Unlock()
+        return nil
+    }
+    running.ids[rollout.ID] = true
+    running.Unlock()
+    defer func() {
+        running.Lock()
+        delete(running.ids, rollout.ID)
+        running.Unlock()
+    }()
+
+    ok, err := store.AcquireRolloutLease(ctx, rollout.ID, instanceID, leaseTTL)
+    if err != nil {
+        return err
+    }
+    if !ok {
+        return nil // another instance runs it
+    }
+    runCtx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    defer store.ReleaseRolloutLease(context.Background(), rollout.ID, instanceID)
+
+    go func() {
+        t := time.NewTicker(leaseTTL / 3)
+        defer t.Stop()
+        for {
+            select {
+            case <-runCtx.Done():
+                return
+            case <-t.C:
+                ok, err := store.AcquireRolloutLease(runCtx, rollout.ID, instanceID, leaseTTL)
+                if err == nil && !ok {
+                    log.Printf("[sched] rollout %s: lease lost, stopping", rollout.ID)
+                    cancel()
+                    return
+                }
+            }
+        }
+    }()
+    return StartRollout(runCtx, store, rollout, opt)
+}
+
+// Supervise periodically picks up rollouts nobody executes: ones left
+// "running", "paused" or "rolling_back" by a restarted or dead instance,
+// and "queued" ones whose overlapping rollouts have finished. It blocks
+// until ctx is done.
+func Supervise(ctx context.Context, store *xdb.Store, opt Options, every time.Duration) {
+    if every <= 0 {
+        every = 15 * time.Second
+    }
+    for {
+        superviseOnce(ctx, store, opt)
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(every):
+        }
+    }
+}
+
+func superviseOnce(ctx context.Context, store *xdb.Store, opt Options) {
+    active, err := store.ListRolloutsByStatus(ctx, "running", "paused", "rolling_back")
+    if err != nil {
+        log.Printf("[sched] supervise: %v", err)
+        return
+    }
+    for _, ro := range active {
+        ro := ro
+        go func() {
+            if err := Run(ctx, store, ro, opt); err != nil {
+                log.Printf("[sched] rollout %s: %v", ro.ID, err)
+            }
+        }()
+    }
+
+    queued, err := store.ListRolloutsByStatus(ctx, "queued")
+    if err != nil {
+        log.Printf("[sched] supervise: %v", err)
+        return
+    }
+    for _, ro := range queued {
+        p, err := PlanRollout(ctx, store, ro)
+        if err != nil {
+            log.Printf("[sched] rollout %s: plan: %v", ro.ID, err)
+            continue
+        }
+        status, err := store.ClaimRolloutStart(ctx, ro.ID, p.DeviceIDs(), true)
+        if err != nil || status != "running" {
+            continue
+        }
+        log.Printf("[sched] rollout %s: dequeued", ro.ID)
+        ro := ro
+        ro.Status = status
+        go func() {
+            if err := Run(ctx, store, ro, opt); err != nil {
+                log.Printf("[sched] rollout %s: %v", ro.ID, err)
+            }
+        }()
+    }
+}
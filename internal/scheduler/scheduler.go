@@ -2,6 +2,7 @@ package scheduler
 
 import (
     "context"
+    "errors"
     "fmt"
     "log"
     "time"
@@ -14,101 +15,121 @@ type Options struct {
     HeartbeatGrace time.Duration // consider offline if older (e.g. 2m)
     RequireOK      bool          // fail device if status != ok
     SkipOffline    bool          // if true, skip offline devices instead of failing wave
+    ControlPoll    time.Duration // how often a paused rollout re-checks its status (default 2s)
+    Rollback       string        // default rollback policy for rollouts that do not set one
+    MaxFailureRatio float64      // default max failed/(healthy+failed) for a wave to pass (1 = only all-failed fails)
+    BakePoll       time.Duration // how often devices are checked during bake (default 5s)
+    WindowPoll     time.Duration // how often deferred devices re-check their maintenance window (default 1m)
+    WindowDeadline time.Duration // default time a rollout waits for maintenance windows
 }
 
 // StartRollout executes waves sequentially based on selector.
 // For each OK device in a wave, it applies rollout artifact/channel to the device.
+//
+// Progress is checkpointed in rollout_runs: waves that already finished
+// (completed/partial) are skipped together with their devices, so calling
+// StartRollout again after a control-plane restart continues where it stopped.
+//
+// Between devices and between waves the rollout status is re-read, so an
+// operator can pause, resume or cancel it while it runs.
+//
+// When a wave fails (or ends partial) and the rollback policy asks for it,
+// every device touched by the rollout is returned to its previous
+// version/channel and the rollout ends as "rolled_back".
+//
+// Devices outside their maintenance window are deferred; after the last wave
+// they are applied as their windows open, until the rollout's deadline.
 func StartRollout(ctx context.Context, store *xdb.Store, rollout xdb.Rollout, opt Options) error {
     if store == nil || !store.Enabled {
         return fmt.Errorf("scheduler requires db store")
     }
-    devs, err := store.FilterDevicesBySelector(ctx, rollout.Tenant, rollout.Selector)
+    if rollout.Status == "rolling_back" {
+        return rollback(ctx, store, rollout, "resumed after restart")
+    }
+    p, err := PlanRollout(ctx, store, rollout)
     if err != nil {
         return err
     }
-    if len(devs) == 0 {
+    if len(p.Devices) == 0 && !p.Started {
         log.Printf("[sched] rollout %s: no matching devices", rollout.ID)
         _ = store.UpdateRolloutStatus(ctx, rollout.ID, "failed")
         return nil
     }
-    waves := rollout.Waves
-    if waves <= 0 {
-        waves = 1
+    devs, done, buckets := p.Devices, p.Done, p.Waves
+    waves := len(buckets)
+    if p.Handled > 0 {
+        log.Printf("[sched] rollout %s: resuming, %d device(s) already handled by finished waves", rollout.ID, p.Handled)
     }
 
-    // split devices into waves round-robin
-    buckets := make([][]string, waves)
-    for i, d := range devs {
-        buckets[i%waves] = append(buckets[i%waves], d.ID)
+    if err := gate(ctx, store, rollout.ID, opt); err != nil {
+        if errors.Is(err, errCancelled) {
+            return nil
+        }
+        return err
     }
     if err := store.UpdateRolloutStatus(ctx, rollout.ID, "running"); err != nil {
         return err
     }
+    windows, err := store.ListMaintenanceWindows(ctx, rollout.Tenant)
+    if err != nil {
+        return err
+    }
+    byID := make(map[string]xdb.Device, len(devs))
+    for _, d := range devs {
+        byID[d.ID] = d
+    }
 
     for wi := 0; wi < waves; wi++ {
+        if done[wi] {
+            continue
+        }
         select {
         case <-ctx.Done():
             return ctx.Err()
         default:
         }
+        if err := gate(ctx, store, rollout.ID, opt); err != nil {
+            if errors.Is(err, errCancelled) {
+                log.Printf("[sched] rollout %s: cancelled before wave %d", rollout.ID, wi+1)
+                return nil
+            }
+            return err
+        }
         waveID := fmt.Sprintf("run-%s-%d", rollout.ID, wi+1)
         now := time.Now().UTC()
         _ = store.InsertRolloutRun(ctx, waveID, rollout.ID, wi+1, buckets[wi], "running", &now)
+        if len(buckets[wi]) == 0 {
+            // планът може да остави вълна празна (напр. "5%" след "1" при малък парк)
+            log.Printf("[sched] rollout %s wave %d: no devices planned", rollout.ID, wi+1)
+            _ = store.CompleteRolloutRun(ctx, waveID, "completed", time.Now().UTC())
+            continue
+        }
 
-        applied := 0
-        anyFailed := false
-
+        items := make([]item, 0, len(buckets[wi]))
         for _, id := range buckets[wi] {
-            // lookup device by id
-            var dv *xdb.Device
-            for i := range devs {
-                if devs[i].ID == id {
-                    dv = &devs[i]
-                    break
-                }
-            }
-            if dv == nil {
-                continue
-            }
-            offline := dv.LastSeen.IsZero() || time.Since(dv.LastSeen) > opt.HeartbeatGrace
-            badStatus := opt.RequireOK && dv.Status != "ok"
-
-            if offline {
-                if opt.SkipOffline {
-                    log.Printf("[sched] rollout %s wave %d: device %s SKIPPED (offline)", rollout.ID, wi+1, id)
-                    continue
-                }
-                anyFailed = true
-                log.Printf("[sched] rollout %s wave %d: device %s FAILED (offline)", rollout.ID, wi+1, id)
-                continue
-            }
-            if badStatus {
-                anyFailed = true
-                log.Printf("[sched] rollout %s wave %d: device %s FAILED (status=%s)", rollout.ID, wi+1, id, dv.Status)
-                continue
-            }
-
-            // APPLY version/channel
-            if err := store.ApplyVersionChannel(ctx, dv.ID, rollout.Artifact, rollout.Channel); err != nil {
-                anyFailed = true
-                log.Printf("[sched] rollout %s wave %d: device %s APPLY ERROR: %v", rollout.ID, wi+1, dv.ID, err)
-                continue
+            if dv, ok := byID[id]; ok {
+                items = append(items, item{wave: wi + 1, dev: dv})
             }
-            applied++
-            log.Printf("[sched] rollout %s wave %d: device %s APPLY OK (version=%s, channel=%s)",
-                rollout.ID, wi+1, dv.ID, rollout.Artifact, rollout.Channel)
+        }
+        res, err := applyBatch(ctx, store, rollout, items, windows, opt)
+        if errors.Is(err, errCancelled) {
+            log.Printf("[sched] rollout %s: cancelled during wave %d", rollout.ID, wi+1)
+            _ = store.CompleteRolloutRun(ctx, waveID, "cancelled", time.Now().UTC())
+            return nil
+        }
+        if err != nil {
+            return err
         }
 
-        // критерий за вълна:
-        // - ако сме приложили поне на 1 устройство и няма критични грешки -> completed
-        // - ако нито едно не е приложено -> failed
-        if applied > 0 && !anyFailed {
-            _ = store.CompleteRolloutRun(ctx, waveID, "completed", time.Now().UTC())
-        } else if applied > 0 && anyFailed {
-            _ = store.CompleteRolloutRun(ctx, waveID, "partial", time.Now().UTC())
-        } else {
-            _ = store.CompleteRolloutRun(ctx, waveID, "failed", time.Now().UTC())
-            _ = store.UpdateRolloutStatus(ctx, rollout.ID, "failed")
+        waveStatus := waveVerdict(res, maxFailureRatio(rollout, opt))
+        log.Printf("[sched] rollout %s wave %d: %s (healthy=%d, failed=%d, deferred=%d, cordoned=%d)",
+            rollout.ID, wi+1, waveStatus, res.healthy, res.failed, res.deferred, res.cordoned)
+        _ = store.CompleteRolloutRun(ctx, waveID, waveStatus, time.Now().UTC())
+        if shouldRollback(rollout, opt, waveStatus) {
+            return rollback(ctx, store, rollout, fmt.Sprintf("wave %d %s", wi+1, waveStatus))
+        }
+        if waveStatus == "failed" {
+            _, _ = store.TransitionRolloutStatus(ctx, rollout.ID, []string{"running", "paused"}, "failed")
             return nil
         }
 
@@ -121,6 +142,241 @@ func StartRollout(ctx context.Context, store *xdb.Store, rollout xdb.Rollout, op
         }
     }
 
-    _ = store.UpdateRolloutStatus(ctx, rollout.ID, "completed")
+    return finishDeferred(ctx, store, rollout, opt)
+}
+
+// item is one device to handle in a given wave.
+type item struct {
+    wave int
+    dev  xdb.Device
+}
+
+// batchResult counts the outcomes of applyBatch.
+type batchResult struct {
+    healthy  int // applied (and, with bake, confirmed healthy)
+    failed   int
+    deferred int // outside their maintenance window
+    cordoned int // skipped because cordoned
+}
+
+// applyBatch runs the per-device steps for items: gate (pause/cancel),
+// pre-checks, maintenance window, snapshot and apply; then bakes the devices
+// it applied. Every outcome is recorded in rollout_targets. It returns
+// errCancelled when an operator cancelled the rollout mid-batch.
+func applyBatch(ctx context.Context, store *xdb.Store, rollout xdb.Rollout, items []item, windows []xdb.MaintenanceWindow, opt Options) (batchResult, error) {
+    var res batchResult
+    var applied []item
+    appliedAt := time.Now().UTC()
+
+    for _, it := range items {
+        if err := gate(ctx, store, rollout.ID, opt); err != nil {
+            return res, err
+        }
+        dv, wave := it.dev, it.wave
+        // re-read: the device may have been cordoned since the rollout was planned
+        if cur, err := store.GetDevice(ctx, dv.ID); err == nil {
+            dv = cur
+        }
+        if c := Classify(dv, opt, time.Now()); c.State != xdb.TargetApplied {
+            if c.State == xdb.TargetSkippedCordoned {
+                res.cordoned++
+            }
+            if c.Failure {
+                res.failed++
+                log.Printf("[sched] rollout %s wave %d: device %s FAILED (%s)", rollout.ID, wave, dv.ID, c.Reason)
+            } else {
+                log.Printf("[sched] rollout %s wave %d: device %s SKIPPED (%s)", rollout.ID, wave, dv.ID, c.Reason)
+            }
+            recordTarget(ctx, store, rollout, wave, dv, c.State, c.Reason)
+            continue
+        }
+        if !xdb.MaintenanceAllowed(windows, dv, time.Now()) {
+            res.deferred++
+            log.Printf("[sched] rollout %s wave %d: device %s DEFERRED (outside maintenance window)", rollout.ID, wave, dv.ID)
+            recordTarget(ctx, store, rollout, wave, dv, xdb.TargetDeferred, "outside maintenance window")
+            continue
+        }
+
+        // запазваме предишната версия/канал преди apply (за rollback)
+        if err := snapshot(ctx, store, rollout, dv); err != nil {
+            res.failed++
+            log.Printf("[sched] rollout %s wave %d: device %s SNAPSHOT ERROR: %v", rollout.ID, wave, dv.ID, err)
+            recordTarget(ctx, store, rollout, wave, dv, xdb.TargetApplyError, "snapshot: "+err.Error())
+            continue
+        }
+
+        // APPLY version/channel
+        if err := applyTo(ctx, store, rollout, dv.ID, TargetVersion(rollout), rollout.Channel); err != nil {
+            res.failed++
+            log.Printf("[sched] rollout %s wave %d: device %s APPLY ERROR: %v", rollout.ID, wave, dv.ID, err)
+            recordTarget(ctx, store, rollout, wave, dv, xdb.TargetApplyError, err.Error())
+            continue
+        }
+        applied = append(applied, item{wave: wave, dev: dv})
+        log.Printf("[sched] rollout %s wave %d: device %s APPLY OK (version=%s, channel=%s)",
+            rollout.ID, wave, dv.ID, rollout.Artifact, rollout.Channel)
+        recordTarget(ctx, store, rollout, wave, dv, xdb.TargetApplied, "")
+    }
+
+    // bake: приложените устройства трябва да потвърдят новата версия с ok
+    res.healthy = len(applied)
+    if bake := time.Duration(rollout.BakeSeconds) * time.Second; bake > 0 && len(applied) > 0 {
+        devs := make([]xdb.Device, len(applied))
+        for i, it := range applied {
+            devs[i] = it.dev
+        }
+        log.Printf("[sched] rollout %s: baking %d device(s) for %s", rollout.ID, len(devs), bake)
+        bad, err := bakeWave(ctx, store, rollout, devs, appliedAt, bake, opt)
+        if err != nil {
+            return res, err
+        }
+        for _, it := range applied {
+            if reason, ok := bad[it.dev.ID]; ok {
+                res.healthy--
+                res.failed++
+                log.Printf("[sched] rollout %s wave %d: device %s BAKE FAILED (%s)", rollout.ID, it.wave, it.dev.ID, reason)
+                recordTarget(ctx, store, rollout, it.wave, it.dev, xdb.TargetBakeFailed, reason)
+            }
+        }
+    }
+    return res, nil
+}
+
+// finishDeferred applies devices deferred by maintenance windows as their
+// windows open, until none are left or the rollout's deadline passes; the
+// rest are marked deferred_expired. It then completes the rollout. Deferred
+// devices live in rollout_targets, so this phase survives restarts.
+func finishDeferred(ctx context.Context, store *xdb.Store, rollout xdb.Rollout, opt Options) error {
+    deadline := time.Now().Add(opt.WindowDeadline)
+    if rollout.Deadline != nil {
+        deadline = *rollout.Deadline
+    }
+    deadline, err := store.EnsureRolloutDeadline(ctx, rollout.ID, deadline)
+    if err != nil {
+        return err
+    }
+    poll := opt.WindowPoll
+    if poll <= 0 {
+        poll = time.Minute
+    }
+
+    for {
+        pending, err := store.ListRolloutTargetsByState(ctx, rollout.ID, xdb.TargetDeferred)
+        if err != nil {
+            return err
+        }
+        if len(pending) == 0 {
+            break
+        }
+        if time.Now().After(deadline) {
+            for _, t := range pending {
+                t.State, t.Reason = xdb.TargetDeferredExpired, "deadline passed before maintenance window opened"
+                _ = store.SetRolloutTarget(ctx, t)
+            }
+            log.Printf("[sched] rollout %s: deadline passed, %d deferred device(s) not updated", rollout.ID, len(pending))
+            break
+        }
+
+        windows, err := store.ListMaintenanceWindows(ctx, rollout.Tenant)
+        if err != nil {
+            return err
+        }
+        ids := make([]string, len(pending))
+        waveOf := make(map[string]int, len(pending))
+        for i, t := range pending {
+            ids[i] = t.DeviceID
+            waveOf[t.DeviceID] = t.WaveIndex
+        }
+        devs, err := store.GetDevicesByIDs(ctx, ids)
+        if err != nil {
+            return err
+        }
+        var items []item
+        for _, d := range devs {
+            if xdb.MaintenanceAllowed(windows, d, time.Now()) {
+                items = append(items, item{wave: waveOf[d.ID], dev: d})
+            }
+        }
+        if len(items) > 0 {
+            log.Printf("[sched] rollout %s: maintenance window open for %d deferred device(s)", rollout.ID, len(items))
+            res, err := applyBatch(ctx, store, rollout, items, windows, opt)
+            if errors.Is(err, errCancelled) {
+                log.Printf("[sched] rollout %s: cancelled while waiting for maintenance windows", rollout.ID)
+                return nil
+            }
+            if err != nil {
+                return err
+            }
+            status := waveVerdict(res, maxFailureRatio(rollout, opt))
+            if shouldRollback(rollout, opt, status) {
+                return rollback(ctx, store, rollout, "deferred devices "+status)
+            }
+            if status == "failed" {
+                _, _ = store.TransitionRolloutStatus(ctx, rollout.ID, []string{"running", "paused"}, "failed")
+                return nil
+            }
+        }
+
+        wait := time.Until(deadline)
+        if wait > poll {
+            wait = poll
+        }
+        if wait < 0 {
+            wait = 0
+        }
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(wait):
+        }
+    }
+
+    // условно, за да не презапишем cancel, пристигнал след последното устройство
+    _, _ = store.TransitionRolloutStatus(ctx, rollout.ID, []string{"running", "paused"}, "completed")
     return nil
-}
\ No newline at end of file
+}
+
+// waveVerdict decides a wave's status: "failed" when nothing is healthy or the
+// failure ratio exceeds maxRatio, "partial" when some devices failed within the
+// threshold, otherwise "completed". Skipped-offline devices are not counted;
+// a wave whose devices were all deferred to their maintenance window or
+// cordoned completes.
+func waveVerdict(res batchResult, maxRatio float64) string {
+    healthy, failed := res.healthy, res.failed
+    if healthy == 0 {
+        if failed == 0 && res.deferred+res.cordoned > 0 {
+            return "completed"
+        }
+        return "failed"
+    }
+    if failed == 0 {
+        return "completed"
+    }
+    if float64(failed)/float64(healthy+failed) > maxRatio {
+        return "failed"
+    }
+    return "partial"
+}
+
+func maxFailureRatio(rollout xdb.Rollout, opt Options) float64 {
+    if rollout.MaxFailureRatio != nil {
+        return *rollout.MaxFailureRatio
+    }
+    return opt.MaxFailureRatio
+}
+
+// recordTarget persists the device's outcome in rollout_targets. Failures to
+// write are only logged; they must not stop the rollout.
+func recordTarget(ctx context.Context, store *xdb.Store, rollout xdb.Rollout, wave int, dv xdb.Device, state, reason string) {
+    prev, _ := Current(rollout, dv)
+    t := xdb.RolloutTarget{
+        RolloutID: rollout.ID, WaveIndex: wave, DeviceID: dv.ID,
+        State: state, Reason: reason, PrevVersion: prev,
+    }
+    if state == xdb.TargetApplied {
+        t.NewVersion = TargetVersion(rollout)
+    }
+    if err := store.SetRolloutTarget(ctx, t); err != nil {
+        log.Printf("[sched] rollout %s wave %d: device %s: record target: %v", rollout.ID, wave, dv.ID, err)
+    }
+}
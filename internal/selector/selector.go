@@ -0,0 +1,362 @@
+// Package selector is the label selector language used wherever a set of
+// devices is picked by labels: rollouts, maintenance windows, remote exec and
+// the device list.
+//
+// A selector is a comma-separated list of requirements, all of which must hold:
+//
+//    site=sofia-1          label equals the value (also ==)
+//    tier!=canary          label differs or is missing
+//    zone in (a,b)         label is one of the values
+//    zone notin (a,b)      label is none of the values, or is missing
+//    beta                  label is set (also "beta exists")
+//    !beta                 label is not set (also "beta !exists")
+//
+// Parse builds the requirement list once; Matches evaluates it in memory and
+// SQL compiles it to a parameterized condition on a JSONB labels column. In
+// JSON a selector is either that string or, as before, an object of labels
+// that must be equal; selectors of equalities only are written as an object.
+package selector
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "slices"
+    "sort"
+    "strings"
+)
+
+// Op is a requirement operator.
+type Op string
+
+const (
+    Equals    Op = "="
+    NotEquals Op = "!="
+    In        Op = "in"
+    NotIn     Op = "notin"
+    Exists    Op = "exists"
+    NotExists Op = "!exists"
+)
+
+// Requirement is one condition on one label.
+type Requirement struct {
+    Key    string
+    Op     Op
+    Values []string // one for Equals/NotEquals, one or more for In/NotIn, none otherwise
+}
+
+// Selector is a conjunction of requirements. The empty selector matches
+// every device.
+type Selector []Requirement
+
+// Parse parses the selector language. "" gives the empty selector.
+func Parse(s string) (Selector, error) {
+    p := parser{toks: tokenize(s)}
+    var sel Selector
+    for !p.done() {
+        r, err := p.requirement()
+        if err != nil {
+            return nil, fmt.Errorf("selector %q: %w", s, err)
+        }
+        sel = append(sel, r)
+        if p.done() {
+            break
+        }
+        if t := p.next(); t != "," {
+            return nil, fmt.Errorf("selector %q: want , between requirements, got %q", s, t)
+        }
+        if p.done() {
+            return nil, fmt.Errorf("selector %q: trailing ,", s)
+        }
+    }
+    return sel, nil
+}
+
+// FromMap is the selector of label equalities, in key order.
+func FromMap(m map[string]string) Selector {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    sel := make(Selector, 0, len(keys))
+    for _, k := range keys {
+        sel = append(sel, Requirement{Key: k, Op: Equals, Values: []string{m[k]}})
+    }
+    return sel
+}
+
+// Empty reports whether the selector matches everything.
+func (s Selector) Empty() bool { return len(s) == 0 }
+
+// Equalities returns the selector as a label map when it consists of
+// equalities only (at most one per key).
+func (s Selector) Equalities() (map[string]string, bool) {
+    m := make(map[string]string, len(s))
+    for _, r := range s {
+        if r.Op != Equals {
+            return nil, false
+        }
+        if v, dup := m[r.Key]; dup && v != r.Values[0] {
+            return nil, false
+        }
+        m[r.Key] = r.Values[0]
+    }
+    return m, true
+}
+
+// Matches reports whether labels satisfy every requirement.
+func (s Selector) Matches(labels map[string]string) bool {
+    for _, r := range s {
+        v, ok := labels[r.Key]
+        switch r.Op {
+        case Equals:
+            if !ok || v != r.Values[0] {
+                return false
+            }
+        case NotEquals:
+            if ok && v == r.Values[0] {
+                return false
+            }
+        case In:
+            if !ok || !slices.Contains(r.Values, v) {
+                return false
+            }
+        case NotIn:
+            if ok && slices.Contains(r.Values, v) {
+                return false
+            }
+        case Exists:
+            if !ok {
+                return false
+            }
+        case NotExists:
+            if ok {
+                return false
+            }
+        default:
+            return false
+        }
+    }
+    return true
+}
+
+// SQL compiles the selector to a condition on col, a JSONB object of string
+// labels. arg binds a parameter and returns its placeholder ($n). Equalities
+// are folded into one containment test (@>) so a GIN index on col serves
+// them. The empty selector gives "TRUE".
+func (s Selector) SQL(col string, arg func(any) string) string {
+    var conds []string
+    eq := map[string]string{}
+    for _, r := range s {
+        if r.Op == Equals {
+            if v, dup := eq[r.Key]; dup && v != r.Values[0] {
+                return "FALSE"
+            }
+            eq[r.Key] = r.Values[0]
+        }
+    }
+    if len(eq) > 0 {
+        b, _ := json.Marshal(eq)
+        conds = append(conds, col+" @> "+arg(string(b))+"::jsonb")
+    }
+    for _, r := range s {
+        switch r.Op {
+        case NotEquals:
+            b, _ := json.Marshal(map[string]string{r.Key: r.Values[0]})
+            conds = append(conds, "NOT COALESCE("+col+" @> "+arg(string(b))+"::jsonb, false)")
+        case In:
+            conds = append(conds, "("+col+" ->> "+arg(r.Key)+"::text) = ANY("+arg(r.Values)+"::text[])")
+        case NotIn:
+            conds = append(conds, "NOT COALESCE(("+col+" ->> "+arg(r.Key)+"::text) = ANY("+arg(r.Values)+"::text[]), false)")
+        case Exists:
+            conds = append(conds, col+" ? "+arg(r.Key)+"::text")
+        case NotExists:
+            conds = append(conds, "NOT COALESCE("+col+" ? "+arg(r.Key)+"::text, false)")
+        }
+    }
+    if len(conds) == 0 {
+        return "TRUE"
+    }
+    return strings.Join(conds, " AND ")
+}
+
+// String formats the selector in the selector language.
+func (s Selector) String() string {
+    parts := make([]string, 0, len(s))
+    for _, r := range s {
+        switch r.Op {
+        case Equals, NotEquals:
+            parts = append(parts, r.Key+string(r.Op)+r.Values[0])
+        case In, NotIn:
+            parts = append(parts, r.Key+" "+string(r.Op)+" ("+strings.Join(r.Values, ",")+")")
+        case Exists:
+            parts = append(parts, r.Key)
+        case NotExists:
+            parts = append(parts, "!"+r.Key)
+        }
+    }
+    return strings.Join(parts, ",")
+}
+
+// MarshalJSON writes equality-only selectors as a label object (what older
+// clients and stored rows expect) and anything else as a string.
+func (s Selector) MarshalJSON() ([]byte, error) {
+    if m, ok := s.Equalities(); ok {
+        return json.Marshal(m)
+    }
+    return json.Marshal(s.String())
+}
+
+// UnmarshalJSON reads a selector string, a label object or null.
+func (s *Selector) UnmarshalJSON(b []byte) error {
+    var str string
+    if err := json.Unmarshal(b, &str); err == nil {
+        sel, err := Parse(str)
+        if err != nil {
+            return err
+        }
+        *s = sel
+        return nil
+    }
+    var m map[string]string
+    if err := json.Unmarshal(b, &m); err != nil {
+        return errors.New("selector must be a string or an object of labels")
+    }
+    *s = FromMap(m)
+    return nil
+}
+
+// --- parsing ---
+
+// special is what ends a bare word.
+const special = " \t\r\n,()=!"
+
+func tokenize(s string) []string {
+    var toks []string
+    for i := 0; i < len(s); {
+        c := s[i]
+        switch {
+        case strings.IndexByte(" \t\r\n", c) >= 0:
+            i++
+        case c == ',' || c == '(' || c == ')':
+            toks = append(toks, string(c))
+            i++
+        case c == '=' || c == '!':
+            if i+1 < len(s) && s[i+1] == '=' {
+                toks = append(toks, s[i:i+2])
+                i += 2
+            } else {
+                toks = append(toks, string(c))
+                i++
+            }
+        default:
+            j := i
+            for j < len(s) && strings.IndexByte(special, s[j]) < 0 {
+                j++
+            }
+            toks = append(toks, s[i:j])
+            i = j
+        }
+    }
+    return toks
+}
+
+type parser struct {
+    toks []string
+    pos  int
+}
+
+func (p *parser) done() bool { return p.pos >= len(p.toks) }
+
+func (p *parser) peek() string {
+    if p.done() {
+        return ""
+    }
+    return p.toks[p.pos]
+}
+
+func (p *parser) next() string {
+    t := p.peek()
+    p.pos++
+    return t
+}
+
+func isWord(t string) bool {
+    return t != "" && strings.IndexByte(special, t[0]) < 0
+}
+
+func (p *parser) key() (string, error) {
+    t := p.next()
+    if !isWord(t) {
+        if t == "" {
+            return "", errors.New("want a label key at the end")
+        }
+        return "", fmt.Errorf("want a label key, got %q", t)
+    }
+    return t, nil
+}
+
+func (p *parser) requirement() (Requirement, error) {
+    if p.peek() == "!" {
+        p.next()
+        k, err := p.key()
+        return Requirement{Key: k, Op: NotExists}, err
+    }
+    k, err := p.key()
+    if err != nil {
+        return Requirement{}, err
+    }
+    switch t := p.peek(); t {
+    case "", ",":
+        return Requirement{Key: k, Op: Exists}, nil
+    case "exists":
+        p.next()
+        return Requirement{Key: k, Op: Exists}, nil
+    case "!":
+        p.next()
+        if p.next() != "exists" {
+            return Requirement{}, fmt.Errorf("%s: want != or !exists", k)
+        }
+        return Requirement{Key: k, Op: NotExists}, nil
+    case "=", "==", "!=":
+        p.next()
+        op := Equals
+        if t == "!=" {
+            op = NotEquals
+        }
+        // a missing value means the empty string: "k=" or "k=,..."
+        v := ""
+        if isWord(p.peek()) {
+            v = p.next()
+        }
+        return Requirement{Key: k, Op: op, Values: []string{v}}, nil
+    case "in", "notin":
+        p.next()
+        vs, err := p.set(k)
+        return Requirement{Key: k, Op: Op(t), Values: vs}, err
+    default:
+        return Requirement{}, fmt.Errorf("%s: want =, !=, in, notin, exists or !exists, got %q", k, t)
+    }
+}
+
+func (p *parser) set(k string) ([]string, error) {
+    if p.next() != "(" {
+        return nil, fmt.Errorf("%s: want ( after in/notin", k)
+    }
+    var vs []string
+    for {
+        v := p.next()
+        if !isWord(v) {
+            return nil, fmt.Errorf("%s: want a value in the set, got %q", k, v)
+        }
+        vs = append(vs, v)
+        switch p.next() {
+        case ",":
+        case ")":
+            return vs, nil
+        default:
+            return nil, fmt.Errorf("%s: unterminated set", k)
+        }
+    }
+}
@@ -0,0 +1,274 @@
+package selector
+
+import (
+    "context"
+    "encoding/json"
+    "os"
+    "reflect"
+    "strconv"
+    "strings"
+    "testing"
+
+    "github.com/jackc/pgx/v5"
+)
+
+func TestParseErrors(t *testing.T) {
+    for _, in := range []string{
+        "a=b,",         // trailing ,
+        ",",            // nothing before ,
+        "a,,b",         // empty requirement
+        "k in ()",      // empty set
+        "k in (a,b",    // unterminated set
+        "k in (a,",     // unterminated set
+        "k notin a",    // no set
+        "k !",          // ! without exists
+        "k ! foo",      // ! without exists
+        "!",            // no key
+        "=a",           // no key
+        "a b",          // unknown operator
+        "k = = a",      // second =
+    } {
+        if sel, err := Parse(in); err == nil {
+            t.Errorf("Parse(%q) = %v, want an error", in, sel)
+        }
+    }
+}
+
+func TestParse(t *testing.T) {
+    tests := []struct {
+        in   string
+        want Selector
+    }{
+        {"", nil},
+        {"site=sofia-1", Selector{{Key: "site", Op: Equals, Values: []string{"sofia-1"}}}},
+        {"site == sofia-1", Selector{{Key: "site", Op: Equals, Values: []string{"sofia-1"}}}},
+        {"site=", Selector{{Key: "site", Op: Equals, Values: []string{""}}}},
+        {"tier!=canary", Selector{{Key: "tier", Op: NotEquals, Values: []string{"canary"}}}},
+        {"zone in (a, b)", Selector{{Key: "zone", Op: In, Values: []string{"a", "b"}}}},
+        {"zone notin (a)", Selector{{Key: "zone", Op: NotIn, Values: []string{"a"}}}},
+        {"beta", Selector{{Key: "beta", Op: Exists}}},
+        {"beta exists", Selector{{Key: "beta", Op: Exists}}},
+        {"!beta", Selector{{Key: "beta", Op: NotExists}}},
+        {"beta !exists", Selector{{Key: "beta", Op: NotExists}}},
+        {"a=1, !b ,c in (x)", Selector{
+            {Key: "a", Op: Equals, Values: []string{"1"}},
+            {Key: "b", Op: NotExists},
+            {Key: "c", Op: In, Values: []string{"x"}},
+        }},
+    }
+    for _, tt := range tests {
+        got, err := Parse(tt.in)
+        if err != nil {
+            t.Errorf("Parse(%q): %v", tt.in, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("Parse(%q) = %#v, want %#v", tt.in, got, tt.want)
+        }
+    }
+}
+
+// matchTests are shared by the in-memory and the SQL evaluation, so both
+// are held to the same answers.
+var matchTests = []struct {
+    sel    string
+    labels map[string]string
+    want   bool
+}{
+    {"", nil, true},
+    {"", map[string]string{"zone": "a"}, true},
+
+    {"zone=a", map[string]string{"zone": "a"}, true},
+    {"zone=a", map[string]string{"zone": "b"}, false},
+    {"zone=a", nil, false},
+    {"zone=", map[string]string{"zone": ""}, true},
+    {"zone=", nil, false},
+
+    {"zone!=a", map[string]string{"zone": "a"}, false},
+    {"zone!=a", map[string]string{"zone": "b"}, true},
+    {"zone!=a", nil, true},
+    {"zone!=a", map[string]string{"tier": "a"}, true},
+
+    {"zone in (a,b)", map[string]string{"zone": "b"}, true},
+    {"zone in (a,b)", map[string]string{"zone": "c"}, false},
+    {"zone in (a,b)", nil, false},
+
+    {"zone notin (a,b)", map[string]string{"zone": "b"}, false},
+    {"zone notin (a,b)", map[string]string{"zone": "c"}, true},
+    {"zone notin (a,b)", nil, true},
+
+    {"beta", map[string]string{"beta": ""}, true},
+    {"beta", map[string]string{"zone": "a"}, false},
+    {"beta", nil, false},
+
+    {"!beta", map[string]string{"beta": "1"}, false},
+    {"!beta", map[string]string{"zone": "a"}, true},
+    {"!beta", nil, true},
+
+    {"zone=a,zone=a", map[string]string{"zone": "a"}, true},
+    {"zone=a,zone=b", map[string]string{"zone": "a"}, false},
+    {"zone=a,zone=b", map[string]string{"zone": "b"}, false},
+
+    {"zone=a,tier!=canary", map[string]string{"zone": "a", "tier": "prod"}, true},
+    {"zone=a,tier!=canary", map[string]string{"zone": "a", "tier": "canary"}, false},
+    {"zone=a,tier!=canary", map[string]string{"zone": "a"}, true},
+    {"site in (x,y),!old,beta", map[string]string{"site": "y", "beta": "on"}, true},
+    {"site in (x,y),!old,beta", map[string]string{"site": "y", "beta": "on", "old": ""}, false},
+}
+
+func TestMatches(t *testing.T) {
+    for _, tt := range matchTests {
+        sel, err := Parse(tt.sel)
+        if err != nil {
+            t.Fatalf("Parse(%q): %v", tt.sel, err)
+        }
+        if got := sel.Matches(tt.labels); got != tt.want {
+            t.Errorf("%q.Matches(%v) = %v, want %v", tt.sel, tt.labels, got, tt.want)
+        }
+    }
+}
+
+// compile runs SQL with numbered placeholders, the way the store binds them.
+func compile(sel Selector, first int) (string, []any) {
+    var args []any
+    cond := sel.SQL("labels", func(v any) string {
+        args = append(args, v)
+        return "$" + strconv.Itoa(first+len(args)-1)
+    })
+    return cond, args
+}
+
+func TestSQL(t *testing.T) {
+    tests := []struct {
+        sel  string
+        cond string
+        args []any
+    }{
+        {"", "TRUE", nil},
+        {"zone=a,zone=b", "FALSE", nil},
+        {"zone=a,tier=b,zone=a", `labels @> $1::jsonb`, []any{`{"tier":"b","zone":"a"}`}},
+        {"zone!=a", `NOT COALESCE(labels @> $1::jsonb, false)`, []any{`{"zone":"a"}`}},
+        {"zone in (a,b)", `(labels ->> $1::text) = ANY($2::text[])`, []any{"zone", []string{"a", "b"}}},
+        {"zone notin (a)", `NOT COALESCE((labels ->> $1::text) = ANY($2::text[]), false)`, []any{"zone", []string{"a"}}},
+        {"beta", `labels ? $1::text`, []any{"beta"}},
+        {"!beta", `NOT COALESCE(labels ? $1::text, false)`, []any{"beta"}},
+        // equalities are folded into one containment test ahead of the rest
+        {"!old,zone=a", `labels @> $1::jsonb AND NOT COALESCE(labels ? $2::text, false)`, []any{`{"zone":"a"}`, "old"}},
+    }
+    for _, tt := range tests {
+        sel, err := Parse(tt.sel)
+        if err != nil {
+            t.Fatalf("Parse(%q): %v", tt.sel, err)
+        }
+        cond, args := compile(sel, 1)
+        if cond != tt.cond || !reflect.DeepEqual(args, tt.args) {
+            t.Errorf("%q.SQL() = %s %#v, want %s %#v", tt.sel, cond, args, tt.cond, tt.args)
+        }
+    }
+}
+
+// TestSQLAgreesWithMatches evaluates every matchTests case in Postgres. It
+// needs a database: XDP47_TEST_DB_URL=postgres://... go test ./internal/selector
+func TestSQLAgreesWithMatches(t *testing.T) {
+    url := os.Getenv("XDP47_TEST_DB_URL")
+    if url == "" {
+        t.Skip("XDP47_TEST_DB_URL not set")
+    }
+    ctx := context.Background()
+    conn, err := pgx.Connect(ctx, url)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close(ctx)
+    for _, tt := range matchTests {
+        sel, err := Parse(tt.sel)
+        if err != nil {
+            t.Fatalf("Parse(%q): %v", tt.sel, err)
+        }
+        labels := tt.labels
+        if labels == nil {
+            labels = map[string]string{}
+        }
+        b, _ := json.Marshal(labels)
+        cond, args := compile(sel, 2)
+        var got bool
+        err = conn.QueryRow(ctx, "SELECT "+cond+" FROM (SELECT $1::jsonb AS labels) d",
+            append([]any{string(b)}, args...)...).Scan(&got)
+        if err != nil {
+            t.Fatalf("%q: %s: %v", tt.sel, cond, err)
+        }
+        if got != tt.want {
+            t.Errorf("%q on %s: SQL gives %v, want %v", tt.sel, b, got, tt.want)
+        }
+    }
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+    tests := []struct {
+        sel  string
+        json string // what MarshalJSON writes
+    }{
+        {"", `{}`},
+        {"zone=a", `{"zone":"a"}`},
+        {"zone=a,site=s1", `{"site":"s1","zone":"a"}`},
+        {"zone=a,zone=a", `{"zone":"a"}`},
+        {"zone=a,zone=b", `"zone=a,zone=b"`},
+        {"zone=a,tier!=canary", `"zone=a,tier!=canary"`},
+        {"zone in (a,b),!old,beta", `"zone in (a,b),!old,beta"`},
+        {"zone notin (a)", `"zone notin (a)"`},
+    }
+    for _, tt := range tests {
+        sel, err := Parse(tt.sel)
+        if err != nil {
+            t.Fatalf("Parse(%q): %v", tt.sel, err)
+        }
+        b, err := json.Marshal(sel)
+        if err != nil {
+            t.Fatalf("%q: MarshalJSON: %v", tt.sel, err)
+        }
+        if string(b) != tt.json {
+            t.Errorf("%q: MarshalJSON = %s, want %s", tt.sel, b, tt.json)
+        }
+        var back Selector
+        if err := json.Unmarshal(b, &back); err != nil {
+            t.Fatalf("%q: UnmarshalJSON(%s): %v", tt.sel, b, err)
+        }
+        // an object comes back in key order with duplicates merged; the
+        // selector must still select the same devices
+        for _, mt := range matchTests {
+            if sel.Matches(mt.labels) != back.Matches(mt.labels) {
+                t.Errorf("%q: round trip through %s changed the result for %v", tt.sel, b, mt.labels)
+            }
+        }
+        if strings.HasPrefix(tt.json, `"`) && back.String() != sel.String() {
+            t.Errorf("%q: round trip gives %q", tt.sel, back.String())
+        }
+    }
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+    tests := []struct {
+        in      string
+        want    string // String() of the result
+        wantErr bool
+    }{
+        {`null`, "", false},
+        {`""`, "", false},
+        {`{"role":"kiosk","store":"demo"}`, "role=kiosk,store=demo", false},
+        {`"role=kiosk,!beta"`, "role=kiosk,!beta", false},
+        {`"role in ()"`, "", true},
+        {`42`, "", true},
+        {`{"role":1}`, "", true},
+    }
+    for _, tt := range tests {
+        var sel Selector
+        err := json.Unmarshal([]byte(tt.in), &sel)
+        if (err != nil) != tt.wantErr {
+            t.Errorf("Unmarshal(%s): err = %v, want error %v", tt.in, err, tt.wantErr)
+            continue
+        }
+        if err == nil && sel.String() != tt.want {
+            t.Errorf("Unmarshal(%s) = %q, want %q", tt.in, sel.String(), tt.want)
+        }
+    }
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package selfupdate
+
+import "errors"
+
+func Exec(exe string) error {
+    return errors.New("exec not supported on this platform")
+}
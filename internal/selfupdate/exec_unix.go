@@ -0,0 +1,14 @@
+//go:build unix
+
+package selfupdate
+
+import (
+    "os"
+    "syscall"
+)
+
+// Exec replaces the current process with exe, keeping arguments, environment
+// and PID (so systemd keeps tracking it). It only returns on error.
+func Exec(exe string) error {
+    return syscall.Exec(exe, os.Args, os.Environ())
+}
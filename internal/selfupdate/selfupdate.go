@@ -0,0 +1,222 @@
+// Package selfupdate replaces the running agent binary with another version.
+//
+// Stage downloads the new binary next to the running one (<exe>.new), checks
+// it against the SHA-256 published at <source>.sha256 and asks it for its
+// version. Switch renames it over the running binary, keeping the old one as
+// <exe>.prev for Revert; Exec then restarts the process in place.
+//
+// Mark leaves <exe>.update next to the binary for the length of the switch.
+// RevertOverdue reads it first thing at startup, so a new binary that dies
+// before its own watchdog runs is still put back once its deadline passed.
+package selfupdate
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/example/xdp47/internal/installer"
+)
+
+// Executable returns the path of the running binary with symlinks resolved,
+// so that Switch replaces the real file.
+func Executable() (string, error) {
+    exe, err := os.Executable()
+    if err != nil {
+        return "", err
+    }
+    return filepath.EvalSymlinks(exe)
+}
+
+// Stage fetches source ({version} expanded; URL or path) with client to
+// exe+".new" and verifies it. It returns the staged path.
+//
+// The checksum comes from the same place as the binary, so it only catches a
+// truncated or corrupted download: whoever can replace the binary can replace
+// its .sha256 too. The rollout does not carry a digest of its own yet; until
+// it does, the source must be trusted (TLS to a host you control, or a path).
+func Stage(ctx context.Context, client *http.Client, exe, source, version string) (string, error) {
+    src := strings.ReplaceAll(source, "{version}", version)
+    want, err := checksum(ctx, client, src+".sha256")
+    if err != nil {
+        return "", fmt.Errorf("checksum: %w", err)
+    }
+
+    staged := exe + ".new"
+    if err := download(ctx, client, src, staged, want); err != nil {
+        os.Remove(staged)
+        return "", err
+    }
+
+    // the binary must run here (arch, libc) and be the version we asked for
+    vctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+    defer cancel()
+    out, err := exec.CommandContext(vctx, staged, "version").Output()
+    if err != nil {
+        os.Remove(staged)
+        return "", fmt.Errorf("%s version: %w", staged, err)
+    }
+    if got := strings.TrimSpace(string(out)); got != version {
+        os.Remove(staged)
+        return "", fmt.Errorf("downloaded binary reports version %q, want %q", got, version)
+    }
+    return staged, nil
+}
+
+// checksum reads a sha256sum-style file ("<hex>  <name>" or just "<hex>").
+func checksum(ctx context.Context, client *http.Client, src string) ([]byte, error) {
+    rc, err := installer.Open(ctx, client, src)
+    if err != nil {
+        return nil, err
+    }
+    defer rc.Close()
+    b, err := io.ReadAll(io.LimitReader(rc, 4096))
+    if err != nil {
+        return nil, err
+    }
+    fields := strings.Fields(string(b))
+    if len(fields) == 0 {
+        return nil, fmt.Errorf("%s: empty", src)
+    }
+    sum, err := hex.DecodeString(fields[0])
+    if err != nil || len(sum) != sha256.Size {
+        return nil, fmt.Errorf("%s: not a sha256 checksum", src)
+    }
+    return sum, nil
+}
+
+func download(ctx context.Context, client *http.Client, src, dst string, want []byte) error {
+    rc, err := installer.Open(ctx, client, src)
+    if err != nil {
+        return err
+    }
+    defer rc.Close()
+    f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o755)
+    if err != nil {
+        return err
+    }
+    h := sha256.New()
+    if _, err := io.Copy(io.MultiWriter(f, h), rc); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    if got := h.Sum(nil); !bytes.Equal(got, want) {
+        return fmt.Errorf("sha256 mismatch: got %x, want %x", got, want)
+    }
+    return nil
+}
+
+// Switch makes staged the binary at exe. The current binary is kept as
+// exe+".prev"; the final rename is atomic, so exe is never missing.
+func Switch(exe, staged string) error {
+    prev := exe + ".prev"
+    if err := os.Remove(prev); err != nil && !errors.Is(err, os.ErrNotExist) {
+        return err
+    }
+    if err := os.Link(exe, prev); err != nil {
+        // no hard links on this filesystem
+        if err := copyFile(exe, prev); err != nil {
+            return fmt.Errorf("keep previous binary: %w", err)
+        }
+    }
+    return os.Rename(staged, exe)
+}
+
+// Revert puts the binary kept by Switch back at exe and drops the marker.
+func Revert(exe string) error {
+    if err := os.Rename(exe+".prev", exe); err != nil {
+        return err
+    }
+    return Unmark(exe)
+}
+
+// Marker is what Mark records next to the binary during a switch.
+type Marker struct {
+    From     string    `json:"from"`
+    To       string    `json:"to"`
+    Deadline time.Time `json:"deadline"`
+}
+
+// Mark records an update to m.To at exe before Switch. It is written to a
+// temporary file and renamed, so a crash leaves either no marker or all of it.
+func Mark(exe string, m Marker) error {
+    b, err := json.Marshal(m)
+    if err != nil {
+        return err
+    }
+    tmp := exe + ".update.tmp"
+    if err := os.WriteFile(tmp, b, 0o644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, exe+".update")
+}
+
+// Unmark removes the marker left by Mark, if any.
+func Unmark(exe string) error {
+    if err := os.Remove(exe + ".update"); err != nil && !errors.Is(err, os.ErrNotExist) {
+        return err
+    }
+    return nil
+}
+
+// RevertOverdue puts the previous binary back when running (the version of
+// this process) is the new binary of a marked update whose deadline has
+// passed. It reports whether it did; the caller should then Exec into exe.
+// It reads nothing but the marker, so call it before anything that can fail.
+func RevertOverdue(exe, running string, now time.Time) (bool, error) {
+    b, err := os.ReadFile(exe + ".update")
+    if errors.Is(err, os.ErrNotExist) {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    var m Marker
+    if err := json.Unmarshal(b, &m); err != nil {
+        return false, fmt.Errorf("%s.update: %w", exe, err)
+    }
+    // the old binary (crash before the switch, or after a revert) leaves the
+    // marker for its state store to settle
+    if m.To != running || now.Before(m.Deadline) {
+        return false, nil
+    }
+    if err := Revert(exe); err != nil {
+        return false, fmt.Errorf("revert %s to %s: %w", m.To, m.From, err)
+    }
+    return true, nil
+}
+
+func copyFile(src, dst string) error {
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o755)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        return err
+    }
+    return out.Close()
+}